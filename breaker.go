@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+type BreakerConfig struct {
+	ErrorThreshold   int    `json:"errorThreshold"`
+	SuccessThreshold int    `json:"successThreshold"`
+	Timeout          string `json:"timeout"`
+}
+
+func (this *BreakerConfig) setDefaults() {
+	if this.ErrorThreshold == 0 {
+		this.ErrorThreshold = 5
+	}
+	if this.SuccessThreshold == 0 {
+		this.SuccessThreshold = 1
+	}
+	if this.Timeout == "" {
+		this.Timeout = "30s"
+	}
+}
+
+func (this *BreakerConfig) Validate() error {
+	if this.ErrorThreshold < 0 {
+		return fmt.Errorf("invalid errorThreshold %d", this.ErrorThreshold)
+	}
+	if this.SuccessThreshold < 0 {
+		return fmt.Errorf("invalid successThreshold %d", this.SuccessThreshold)
+	}
+	return validateDuration("timeout", this.Timeout)
+}
+
+/* clusterUnavailableError is returned without calling the cluster while its breaker is open */
+type clusterUnavailableError struct {
+	zookeeper string
+	cause     string
+}
+
+func (this *clusterUnavailableError) Error() string {
+	return fmt.Sprintf("cluster unavailable: %s, last error: %s", this.zookeeper, this.cause)
+}
+
+func isClusterUnavailable(err error) bool {
+	_, ok := err.(*clusterUnavailableError)
+	return ok
+}
+
+/*
+clusterBreaker guards the zookeeper and kafka calls of one cluster. After
+errorThreshold failed calls without a pause of timeout the breaker opens
+and calls fail at once. After timeout one call is let through to probe
+the cluster, successThreshold successful probes close the breaker again.
+Calls canceled by their caller count neither way.
+
+The vendored go-resiliency breaker is not used: it counts every error, a
+canceled call could only be passed off as a success, which closes it when
+half-open. It also lets every call through while half-open and does not
+expose its state and last error for the status page.
+*/
+type clusterBreaker struct {
+	zookeeper        string
+	errorThreshold   int
+	successThreshold int
+	timeout          time.Duration
+
+	lock      sync.Mutex
+	state     int
+	errors    int
+	successes int
+	probing   bool
+	lastFail  time.Time
+	openedAt  time.Time
+	since     time.Time
+	lastError string
+	rejected  int64
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+/* Run calls work unless the breaker is open, ctx tells whether a failure was the caller giving up */
+func (this *clusterBreaker) Run(ctx context.Context, work func() error) error {
+	probe, err := this.enter()
+	if err != nil {
+		return err
+	}
+
+	err = errors.New("call panicked")
+	defer func() {
+		this.leave(probe, err != nil && (err == context.Canceled || ctx.Err() == context.Canceled), err)
+	}()
+	err = work()
+	return err
+}
+
+func (this *clusterBreaker) enter() (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.state == breakerOpen && time.Since(this.openedAt) >= this.timeout {
+		this.state = breakerHalfOpen
+		this.successes = 0
+	}
+	if this.state == breakerOpen || this.state == breakerHalfOpen && this.probing {
+		this.rejected++
+		metrics.IncrCounter([]string{"breaker", "rejected"}, 1)
+		return false, &clusterUnavailableError{zookeeper: this.zookeeper, cause: this.lastError}
+	}
+	if this.state == breakerHalfOpen {
+		this.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+/* leave records the result of a call, only the probe counts while the breaker is not closed */
+func (this *clusterBreaker) leave(probe bool, canceled bool, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if probe {
+		this.probing = false
+	}
+	if canceled || this.state != breakerClosed && !probe {
+		return
+	}
+
+	now := time.Now()
+	if err == nil {
+		if this.state == breakerHalfOpen {
+			this.successes++
+			if this.successes >= this.successThreshold {
+				this.state = breakerClosed
+				this.errors = 0
+				this.since = now
+			}
+		}
+		return
+	}
+
+	this.lastError = err.Error()
+	if this.state == breakerHalfOpen {
+		this.state = breakerOpen
+		this.openedAt = now
+		return
+	}
+	if this.errors > 0 && now.Sub(this.lastFail) > this.timeout {
+		this.errors = 0
+	}
+	this.errors++
+	this.lastFail = now
+	if this.errors >= this.errorThreshold {
+		this.state = breakerOpen
+		this.openedAt = now
+		this.since = now
+	}
+}
+
+func (this *clusterBreaker) Status() *ComponentStatus {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	status := &ComponentStatus{Component: "breaker", Name: this.zookeeper, State: "ok", Since: this.since}
+	if this.state != breakerClosed {
+		status.State = "degraded"
+		status.Error = fmt.Sprintf("open, %d calls rejected, last error: %s", this.rejected, this.lastError)
+	}
+	return status
+}
+
+var clusterBreakers = struct {
+	sync.Mutex
+	config   BreakerConfig
+	breakers map[string]*clusterBreaker
+}{breakers: map[string]*clusterBreaker{}}
+
+/* setBreakerConfig applies to the breakers created from now on, changing it drops the existing ones */
+func setBreakerConfig(config *BreakerConfig) {
+	clusterBreakers.Lock()
+	defer clusterBreakers.Unlock()
+
+	c := *config
+	c.setDefaults()
+	if c != clusterBreakers.config {
+		clusterBreakers.config = c
+		clusterBreakers.breakers = map[string]*clusterBreaker{}
+	}
+}
+
+/* clusterBreakerFor returns the breaker shared by every worker of a cluster */
+func clusterBreakerFor(zookeeper string) *clusterBreaker {
+	clusterBreakers.Lock()
+	defer clusterBreakers.Unlock()
+
+	if b, ok := clusterBreakers.breakers[zookeeper]; ok {
+		return b
+	}
+
+	config := clusterBreakers.config
+	config.setDefaults()
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	b := &clusterBreaker{
+		zookeeper:        zookeeper,
+		errorThreshold:   config.ErrorThreshold,
+		successThreshold: config.SuccessThreshold,
+		timeout:          timeout,
+		since:            time.Now(),
+	}
+	clusterBreakers.breakers[zookeeper] = b
+	return b
+}
+
+/* breakerStatus returns the state of every breaker, ordered by cluster */
+func breakerStatus() []*ComponentStatus {
+	clusterBreakers.Lock()
+	zookeepers := []string{}
+	breakers := map[string]*clusterBreaker{}
+	for zookeeper, b := range clusterBreakers.breakers {
+		zookeepers = append(zookeepers, zookeeper)
+		breakers[zookeeper] = b
+	}
+	clusterBreakers.Unlock()
+
+	sort.Strings(zookeepers)
+	status := []*ComponentStatus{}
+	for _, zookeeper := range zookeepers {
+		status = append(status, breakers[zookeeper].Status())
+	}
+	return status
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClusterBreaker(t *testing.T) {
+	b := &clusterBreaker{zookeeper: "zk", errorThreshold: 2, successThreshold: 1, timeout: 50 * time.Millisecond}
+	ctx := context.Background()
+	fail := func() error { return errors.New("connection refused") }
+	ok := func() error { return nil }
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	/* the cause of a canceled call may be wrapped beyond recognition */
+	wrapped := func() error { return fmt.Errorf("get offsets failed:%s", canceled.Err()) }
+
+	for i := 0; i < 5; i++ {
+		b.Run(canceled, wrapped)
+		b.Run(ctx, func() error { return context.Canceled })
+	}
+	if err := b.Run(ctx, fail); err == nil || isClusterUnavailable(err) {
+		t.Fatalf("first failure returned %v", err)
+	}
+	if err := b.Run(ctx, fail); err == nil || isClusterUnavailable(err) {
+		t.Fatalf("second failure returned %v", err)
+	}
+	called := false
+	if err := b.Run(ctx, func() error { called = true; return nil }); !isClusterUnavailable(err) || called {
+		t.Fatalf("open breaker returned %v, called %v", err, called)
+	}
+	if status := b.Status(); status.State != "degraded" {
+		t.Errorf("open breaker state %s", status.State)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	/* a canceled probe neither closes nor reopens the breaker, the next call probes again */
+	if err := b.Run(canceled, wrapped); isClusterUnavailable(err) {
+		t.Fatalf("probe rejected: %s", err)
+	}
+
+	/* calls are rejected while the probe runs */
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Run(ctx, func() error {
+			close(probing)
+			<-release
+			return nil
+		})
+	}()
+	<-probing
+	if err := b.Run(ctx, ok); !isClusterUnavailable(err) {
+		t.Errorf("call during the probe returned %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("probe failed: %s", err)
+	}
+
+	if err := b.Run(ctx, ok); err != nil {
+		t.Errorf("closed breaker returned %v", err)
+	}
+	if status := b.Status(); status.State != "ok" {
+		t.Errorf("closed breaker state %s", status.State)
+	}
+
+	/* a failed probe opens the breaker again */
+	b.Run(ctx, fail)
+	b.Run(ctx, fail)
+	time.Sleep(60 * time.Millisecond)
+	b.Run(ctx, fail)
+	if err := b.Run(ctx, ok); !isClusterUnavailable(err) {
+		t.Errorf("breaker after a failed probe returned %v", err)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cliCommand struct {
+	name  string
+	usage string
+	run   func(name string, args []string, out io.Writer) int
+}
+
+/* the subcommands querying a cluster from the shell, without running the daemon */
+var cliCommands = []*cliCommand{
+	{"lag", "the offset and lag of every consumer group per partition", runCli},
+	{"offsets", "the latest offset of every topic per partition", runCli},
+	{"groups", "the consumer groups with their topics, partitions and total lag", runCli},
+	{"topics", "the topics with their partitions, latest offset and consumer groups", runCli},
+	{"top", "a live full screen view of the consumer groups by lag", runTop},
+}
+
+func findCliCommand(name string) *cliCommand {
+	for _, command := range cliCommands {
+		if command.name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func cliUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: %s <command> [options]\n\nCommands:\n", os.Args[0])
+	for _, command := range cliCommands {
+		fmt.Fprintf(out, "  %-8s %s\n", command.name, command.usage)
+	}
+	fmt.Fprintf(out, "\nRun %s <command> -h for the options.\n", os.Args[0])
+}
+
+/* the columns of the table of each query command */
+var cliColumns = map[string][]string{
+	"lag":     {"group", "topic", "partition", "offset", "latest", "lag"},
+	"offsets": {"topic", "partition", "offset"},
+	"groups":  {"group", "topics", "partitions", "lag"},
+	"topics":  {"topic", "partitions", "offset", "groups"},
+}
+
+type cliOptions struct {
+	zookeeper string
+	groups    []string
+	topics    []string
+	format    string
+	sort      string
+	watch     time.Duration
+	timeout   time.Duration
+}
+
+/* runCli runs a subcommand and returns the exit status */
+func runCli(name string, args []string, out io.Writer) int {
+	options := &cliOptions{}
+	var groups, topics string
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&options.zookeeper, "zookeeper", defaultHttpZookeeper, "the zookeeper of the cluster, with its chroot")
+	flags.StringVar(&groups, "group", "", "only these consumer groups, comma separated")
+	flags.StringVar(&topics, "topic", "", "only these topics, comma separated")
+	flags.StringVar(&options.format, "format", "table", "table, json or csv")
+	flags.StringVar(&options.sort, "sort", "", "sort by this column, descending with a leading -")
+	flags.DurationVar(&options.watch, "watch", 0, "query again at this interval until interrupted")
+	flags.DurationVar(&options.timeout, "timeout", 30*time.Second, "timeout of one query")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [options]\n\n", os.Args[0], name)
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		return 2
+	}
+	options.groups = splitList(groups)
+	options.topics = splitList(topics)
+
+	switch options.format {
+	case "table", "json", "csv":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %s, should be table, json or csv\n", options.format)
+		return 2
+	}
+	if name == "offsets" && len(options.groups) > 0 {
+		fmt.Fprintf(os.Stderr, "--group does not apply to %s\n", name)
+		return 2
+	}
+	_, err = parseSortKeys(cliColumns[name], options.sort)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	quietLogs()
+
+	var worker *Worker
+	defer func() {
+		if worker != nil {
+			worker.Close()
+		}
+	}()
+
+	for {
+		if worker == nil {
+			worker = NewWorker(options.zookeeper)
+			err = worker.Init()
+			if err != nil {
+				worker = nil
+			}
+		}
+
+		var table *cliTable
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), options.timeout)
+			table, err = cliQuery(ctx, name, worker, options)
+			cancel()
+		}
+		if err == nil {
+			err = table.sortBy(options.sort)
+		}
+
+		if options.watch > 0 && options.format == "table" && isTerminal(out) {
+			/* redraw in place */
+			fmt.Fprint(out, "\x1b[H\x1b[2J")
+		}
+		if options.watch > 0 && options.format == "table" {
+			fmt.Fprintf(out, "%s %s every %s, %s\n\n", name, options.zookeeper, options.watch, time.Now().Format("2006-01-02 15:04:05"))
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %s\n", name, err.Error())
+			if options.watch == 0 {
+				return 1
+			}
+			/* start over with new connections */
+			if worker != nil {
+				worker.Close()
+				worker = nil
+			}
+		} else {
+			err = table.write(out, options.format, options.watch > 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s failed: %s\n", name, err.Error())
+				return 1
+			}
+		}
+
+		if options.watch == 0 {
+			return 0
+		}
+		if options.format == "table" && !isTerminal(out) {
+			fmt.Fprintln(out)
+		}
+		err = nil
+		time.Sleep(options.watch)
+	}
+}
+
+/* quietLogs lets only the failures of the libraries reach the terminal */
+func quietLogs() {
+	setLogConfig(&LogConfig{Level: "warn"})
+	log.SetFlags(0)
+	log.SetOutput(&logWriter{logger: NewLogger("log")})
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+/* inList tells whether name is in list, an empty list matches everything */
+func inList(list []string, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+/* cliQuery reads what the command shows and returns it as a table */
+func cliQuery(ctx context.Context, name string, worker *Worker, options *cliOptions) (*cliTable, error) {
+	latestOffset, err := worker.GetLatestOffsetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var groupOffset map[string]map[string]map[string]int64
+	if name != "offsets" {
+		filter := func(group string) bool { return inList(options.groups, group) }
+		groupOffset, err = worker.GetConsumerGroupsOffsetContext(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch name {
+	case "lag":
+		return lagTable(latestOffset, groupOffset, options), nil
+	case "offsets":
+		return offsetsTable(latestOffset, options), nil
+	case "groups":
+		return groupsTable(latestOffset, groupOffset, options), nil
+	case "topics":
+		return topicsTable(latestOffset, groupOffset, options), nil
+	}
+	return nil, fmt.Errorf("unknown command %s", name)
+}
+
+func lagTable(latestOffset map[string]map[string]int64, groupOffset map[string]map[string]map[string]int64, options *cliOptions) *cliTable {
+	table := &cliTable{columns: cliColumns["lag"]}
+	for group, topics := range groupOffset {
+		for topic, partitions := range topics {
+			if !inList(options.topics, topic) {
+				continue
+			}
+			for partition, offset := range partitions {
+				if partition == "total" {
+					continue
+				}
+				latest := latestOffset[topic][partition]
+				table.add(group, topic, partitionNumber(partition), offset, latest, latest-offset)
+			}
+		}
+	}
+	table.sortBy("group,topic,partition")
+	return table
+}
+
+func offsetsTable(latestOffset map[string]map[string]int64, options *cliOptions) *cliTable {
+	table := &cliTable{columns: cliColumns["offsets"]}
+	for topic, partitions := range latestOffset {
+		if !inList(options.topics, topic) {
+			continue
+		}
+		for partition, offset := range partitions {
+			if partition == "total" {
+				continue
+			}
+			table.add(topic, partitionNumber(partition), offset)
+		}
+	}
+	table.sortBy("topic,partition")
+	return table
+}
+
+func groupsTable(latestOffset map[string]map[string]int64, groupOffset map[string]map[string]map[string]int64, options *cliOptions) *cliTable {
+	table := &cliTable{columns: cliColumns["groups"]}
+	for group, topics := range groupOffset {
+		var topicCount, partitionCount, lag int64
+		for topic, partitions := range topics {
+			if !inList(options.topics, topic) {
+				continue
+			}
+			topicCount++
+			for partition, offset := range partitions {
+				if partition == "total" {
+					continue
+				}
+				partitionCount++
+				lag += latestOffset[topic][partition] - offset
+			}
+		}
+		if topicCount > 0 || len(options.topics) == 0 {
+			table.add(group, topicCount, partitionCount, lag)
+		}
+	}
+	table.sortBy("group")
+	return table
+}
+
+func topicsTable(latestOffset map[string]map[string]int64, groupOffset map[string]map[string]map[string]int64, options *cliOptions) *cliTable {
+	table := &cliTable{columns: cliColumns["topics"]}
+	consumers := map[string]int64{}
+	for _, topics := range groupOffset {
+		for topic := range topics {
+			consumers[topic]++
+		}
+	}
+	for topic, partitions := range latestOffset {
+		if !inList(options.topics, topic) {
+			continue
+		}
+		table.add(topic, int64(len(partitions)-1), partitions["total"], consumers[topic])
+	}
+	table.sortBy("topic")
+	return table
+}
+
+func partitionNumber(partition string) int64 {
+	n, _ := strconv.ParseInt(partition, 10, 64)
+	return n
+}
+
+/* cliTable holds rows of strings and int64 numbers, numbers sort and align as numbers */
+type cliTable struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func (this *cliTable) add(values ...interface{}) {
+	this.rows = append(this.rows, values)
+}
+
+type cliSortKey struct {
+	column int
+	desc   bool
+}
+
+/* parseSortKeys parses comma separated columns, each descending with a leading - */
+func parseSortKeys(columns []string, spec string) ([]cliSortKey, error) {
+	keys := []cliSortKey{}
+	for _, name := range splitList(spec) {
+		k := cliSortKey{column: -1, desc: strings.HasPrefix(name, "-")}
+		name = strings.TrimPrefix(name, "-")
+		for i, column := range columns {
+			if column == name {
+				k.column = i
+			}
+		}
+		if k.column < 0 {
+			return nil, fmt.Errorf("unknown sort column %s, should be one of %s", name, strings.Join(columns, ", "))
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+/* sortBy sorts by the comma separated columns, each descending with a leading - */
+func (this *cliTable) sortBy(spec string) error {
+	keys, err := parseSortKeys(this.columns, spec)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(this.rows, func(i, j int) bool {
+		for _, k := range keys {
+			c := compareCells(this.rows[i][k.column], this.rows[j][k.column])
+			if c == 0 {
+				continue
+			}
+			if k.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
+
+func compareCells(a interface{}, b interface{}) int {
+	if x, ok := a.(int64); ok {
+		y, _ := b.(int64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+/* write prints the table, json is compact and one document per line when watching */
+func (this *cliTable) write(out io.Writer, format string, watching bool) error {
+	switch format {
+	case "json":
+		records := []map[string]interface{}{}
+		for _, row := range this.rows {
+			record := map[string]interface{}{}
+			for i, column := range this.columns {
+				record[column] = row[i]
+			}
+			records = append(records, record)
+		}
+		var data []byte
+		var err error
+		if watching {
+			data, err = json.Marshal(records)
+		} else {
+			data, err = json.MarshalIndent(records, "", "  ")
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write(this.columns)
+		for _, row := range this.rows {
+			record := make([]string, len(row))
+			for i, cell := range row {
+				record[i] = fmt.Sprint(cell)
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		return w.Error()
+
+	case "table":
+		widths := make([]int, len(this.columns))
+		for i, column := range this.columns {
+			widths[i] = len(column)
+		}
+		for _, row := range this.rows {
+			for i, cell := range row {
+				if n := len(fmt.Sprint(cell)); n > widths[i] {
+					widths[i] = n
+				}
+			}
+		}
+
+		line := func(cells []interface{}) string {
+			parts := make([]string, len(cells))
+			for i, cell := range cells {
+				if _, ok := cell.(int64); ok {
+					parts[i] = fmt.Sprintf("%*s", widths[i], fmt.Sprint(cell))
+				} else {
+					parts[i] = fmt.Sprintf("%-*s", widths[i], fmt.Sprint(cell))
+				}
+			}
+			return strings.TrimRight(strings.Join(parts, "  "), " ") + "\n"
+		}
+
+		header := make([]interface{}, len(this.columns))
+		for i, column := range this.columns {
+			header[i] = strings.ToUpper(column)
+			if len(this.rows) > 0 {
+				if _, ok := this.rows[0][i].(int64); ok {
+					/* right aligned over the numbers */
+					header[i] = fmt.Sprintf("%*s", widths[i], strings.ToUpper(column))
+				}
+			}
+		}
+		_, err := io.WriteString(out, line(header))
+		for _, row := range this.rows {
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(out, line(row))
+		}
+		return err
+	}
+	return errors.New("unknown format " + format)
+}
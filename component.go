@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	componentRetryMin = time.Second
+	componentRetryMax = 5 * time.Minute
+)
+
+/* ComponentStatus is the health of a worker, an output, the election or the sharding, as shown on the status page */
+type ComponentStatus struct {
+	Component string     `json:"component"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Since     time.Time  `json:"since"`
+	Retries   int        `json:"retries,omitempty"`
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+
+	/* workers only */
+	Cycles *CycleStats `json:"cycles,omitempty"`
+}
+
+/*
+componentHealth tracks the state of a component: starting until it was
+first set up, then ok or degraded. A degraded component scheduled for a
+retry waits an exponential backoff, doubling from componentRetryMin up to
+componentRetryMax and starting over once the component works again.
+*/
+type componentHealth struct {
+	lock      sync.RWMutex
+	component string
+	name      string
+	state     string
+	err       string
+	since     time.Time
+	retries   int
+	delay     time.Duration
+	retryAt   time.Time
+}
+
+func newComponentHealth(component string, name string) *componentHealth {
+	return &componentHealth{
+		component: component,
+		name:      name,
+		state:     "starting",
+		since:     time.Now(),
+	}
+}
+
+func (this *componentHealth) setState(state string, err error) {
+	if this.state != state {
+		this.state = state
+		this.since = time.Now()
+	}
+	this.err = ""
+	if err != nil {
+		this.err = err.Error()
+	}
+}
+
+/* succeed marks the component ok and resets the backoff */
+func (this *componentHealth) succeed() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.setState("ok", nil)
+	this.retries = 0
+	this.delay = 0
+	this.retryAt = time.Time{}
+}
+
+/* degrade marks the component degraded without scheduling a retry */
+func (this *componentHealth) degrade(err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.setState("degraded", err)
+}
+
+/* fail marks the component degraded and returns the delay until its next retry */
+func (this *componentHealth) fail(err error) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.setState("degraded", err)
+	this.delay *= 2
+	if this.delay == 0 {
+		this.delay = componentRetryMin
+	}
+	if this.delay > componentRetryMax {
+		this.delay = componentRetryMax
+	}
+	this.retries++
+	this.retryAt = time.Now().Add(this.delay)
+	return this.delay
+}
+
+/* nextRetry returns when the component is to be retried, false if it is not scheduled */
+func (this *componentHealth) nextRetry() (time.Time, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.retryAt, !this.retryAt.IsZero()
+}
+
+func (this *componentHealth) due(now time.Time) bool {
+	retryAt, ok := this.nextRetry()
+	return ok && !now.Before(retryAt)
+}
+
+func (this *componentHealth) Status() *ComponentStatus {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	status := &ComponentStatus{
+		Component: this.component,
+		Name:      this.name,
+		State:     this.state,
+		Error:     this.err,
+		Since:     this.since,
+		Retries:   this.retries,
+	}
+	if !this.retryAt.IsZero() {
+		retryAt := this.retryAt
+		status.NextRetry = &retryAt
+	}
+	return status
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wvanbergen/kazoo-go"
+)
+
+/* timeout of every connection made by the -t connectivity check */
+const checkDialTimeout = 5 * time.Second
+
+type checkResult struct {
+	component string
+	name      string
+	info      string
+	errs      []string
+}
+
+func (this *checkResult) addError(err error) {
+	if err != nil {
+		this.errs = append(this.errs, err.Error())
+	}
+}
+
+func (this *checkResult) String() string {
+	if len(this.errs) > 0 {
+		return "FAILED: " + strings.Join(this.errs, "; ")
+	}
+	if this.info != "" {
+		return "ok, " + this.info
+	}
+	return "ok"
+}
+
+/*
+checkConfig implements -t: the config file is parsed strictly, unknown
+keys and invalid values are reported per component, and with dial every
+zookeeper, kafka broker and influxdb of the config is connected to.
+The report is written to out, false is returned if any check failed.
+*/
+func checkConfig(configFile string, dial bool, out io.Writer) bool {
+	results := checkConfigFile(configFile, dial)
+
+	ok := true
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, result := range results {
+		if len(result.errs) > 0 {
+			ok = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.component, result.name, result)
+	}
+	w.Flush()
+
+	return ok
+}
+
+func checkConfigFile(configFile string, dial bool) []*checkResult {
+	file := &checkResult{component: "config", name: configFile}
+	results := []*checkResult{file}
+
+	data, err := readConfig(configFile)
+	if err != nil {
+		file.addError(err)
+		return results
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		file.addError(err)
+		return results
+	}
+
+	var config Config
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		file.addError(err)
+		return results
+	}
+
+	/* top level keys, the entries of the output lists are checked per output */
+	for _, key := range sortedRawKeys(raw) {
+		t, ok := lookupJsonField(jsonFields(reflect.TypeOf(config)), key)
+		if !ok {
+			file.addError(fmt.Errorf("unknown key %s", key))
+			continue
+		}
+		if t.Kind() == reflect.Slice && t.Elem() == reflect.TypeOf(&OutputConfig{}) {
+			continue
+		}
+		for _, k := range unknownKeys(key, raw[key], t) {
+			file.addError(fmt.Errorf("unknown key %s", k))
+		}
+	}
+
+	server := &checkResult{component: "http_server", name: config.HttpServer.ListenAddr}
+	if server.name == "" {
+		server.name = "-"
+		server.info = "disabled"
+	}
+	server.addError(config.HttpServer.Validate())
+	results = append(results, server)
+
+	election := &checkResult{component: "election", name: config.Election.Zookeeper}
+	if election.name == "" {
+		election.name = "-"
+		election.info = "disabled"
+	}
+	election.addError(config.Election.Validate())
+	results = append(results, election)
+
+	sharding := &checkResult{component: "sharding", name: config.Sharding.Zookeeper}
+	if sharding.name == "" {
+		sharding.name = "-"
+		sharding.info = "disabled"
+	}
+	sharding.addError(config.Sharding.Validate())
+	if config.Election.Zookeeper != "" && config.Sharding.Zookeeper != "" {
+		sharding.addError(errors.New("election and sharding can not be used together"))
+	}
+	results = append(results, sharding)
+
+	breaker := &checkResult{component: "breaker", name: "-"}
+	breaker.addError(config.Breaker.Validate())
+	results = append(results, breaker)
+
+	logConfig := &checkResult{component: "log", name: "-"}
+	logConfig.addError(config.Log.Validate())
+	results = append(results, logConfig)
+
+	shutdown := &checkResult{component: "shutdown", name: "-"}
+	shutdown.addError(validateDuration("shutdownTimeout", config.ShutdownTimeout))
+	results = append(results, shutdown)
+
+	rawEntries := map[string][]json.RawMessage{}
+	for key, data := range raw {
+		var entries []json.RawMessage
+		if json.Unmarshal(data, &entries) == nil {
+			rawEntries[key] = entries
+		}
+	}
+
+	for _, entry := range config.outputEntries() {
+		output := &checkResult{component: "output", name: entry.String() + " " + entry.config.Type}
+		if entry.index < len(rawEntries[entry.key]) {
+			for _, k := range unknownOutputKeys(rawEntries[entry.key][entry.index], entry.config.Type) {
+				output.addError(fmt.Errorf("unknown key %s", k))
+			}
+		}
+		output.addError(entry.config.Validate())
+		results = append(results, output)
+	}
+
+	if dial {
+		results = append(results, checkConnectivity(&config)...)
+	}
+
+	return results
+}
+
+/* unknownOutputKeys returns the keys of an output entry unknown to its type */
+func unknownOutputKeys(data json.RawMessage, outputType string) []string {
+	t, ok := outputTypes[outputType]
+	if !ok {
+		/* reported by Validate */
+		return nil
+	}
+
+	var m map[string]json.RawMessage
+	if json.Unmarshal(data, &m) != nil {
+		return nil
+	}
+
+	header := jsonFields(reflect.TypeOf(OutputConfig{}))
+	options := jsonFields(reflect.TypeOf(t.newOptions()))
+
+	unknown := []string{}
+	for _, key := range sortedRawKeys(m) {
+		if _, ok := lookupJsonField(header, key); ok {
+			continue
+		}
+		ft, ok := lookupJsonField(options, key)
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		unknown = append(unknown, unknownKeys(key, m[key], ft)...)
+	}
+	return unknown
+}
+
+/*
+unknownKeys returns the paths of the keys in data that encoding/json
+would silently drop when decoding into t.
+*/
+func unknownKeys(path string, data json.RawMessage, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+		return nil
+	}
+
+	unknown := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		var m map[string]json.RawMessage
+		if json.Unmarshal(data, &m) != nil {
+			return nil
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedRawKeys(m) {
+			ft, ok := lookupJsonField(fields, key)
+			if !ok {
+				unknown = append(unknown, path+"."+key)
+				continue
+			}
+			unknown = append(unknown, unknownKeys(path+"."+key, m[key], ft)...)
+		}
+
+	case reflect.Map:
+		var m map[string]json.RawMessage
+		if json.Unmarshal(data, &m) != nil {
+			return nil
+		}
+		for _, key := range sortedRawKeys(m) {
+			unknown = append(unknown, unknownKeys(path+"."+key, m[key], t.Elem())...)
+		}
+
+	case reflect.Slice, reflect.Array:
+		var l []json.RawMessage
+		if json.Unmarshal(data, &l) != nil {
+			return nil
+		}
+		for i, item := range l {
+			unknown = append(unknown, unknownKeys(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	}
+	return unknown
+}
+
+/* jsonFields maps the json keys of struct t to the field types */
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+/* keys match like encoding/json does, exactly or else case-insensitively */
+func lookupJsonField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return t, true
+	}
+	for name, t := range fields {
+		if strings.EqualFold(name, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func sortedRawKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/* checkConnectivity connects to every zookeeper, kafka broker and influxdb once */
+func checkConnectivity(config *Config) []*checkResult {
+	results := []*checkResult{}
+
+	zookeepers := []string{}
+	brokers := []string{}
+	influxdbs := []*InfluxdbOutputConfig{}
+	seen := map[string]bool{}
+
+	if config.Election.Zookeeper != "" {
+		seen["zookeeper|"+config.Election.Zookeeper] = true
+		zookeepers = append(zookeepers, config.Election.Zookeeper)
+	}
+	if config.Sharding.Zookeeper != "" && !seen["zookeeper|"+config.Sharding.Zookeeper] {
+		seen["zookeeper|"+config.Sharding.Zookeeper] = true
+		zookeepers = append(zookeepers, config.Sharding.Zookeeper)
+	}
+
+	for _, entry := range config.outputEntries() {
+		entry.config.setDefaults()
+		if !seen["zookeeper|"+entry.config.Zookeeper] {
+			seen["zookeeper|"+entry.config.Zookeeper] = true
+			zookeepers = append(zookeepers, entry.config.Zookeeper)
+		}
+
+		options, err := entry.config.Options()
+		if err != nil {
+			continue
+		}
+		switch o := options.(type) {
+		case *KafkaOutputConfig:
+			brokers = append(brokers, o.KafkaBrokers...)
+		case *InfluxdbOutputConfig:
+			NewInfluxdbOutput(o)
+			if !seen["influxdb|"+o.InfluxdbMode+"|"+o.InfluxdbHost+"|"+o.InfluxdbUdpAddr] {
+				seen["influxdb|"+o.InfluxdbMode+"|"+o.InfluxdbHost+"|"+o.InfluxdbUdpAddr] = true
+				influxdbs = append(influxdbs, o)
+			}
+		}
+	}
+
+	for _, zookeeper := range zookeepers {
+		result := &checkResult{component: "zookeeper", name: zookeeper}
+		zkBrokers, err := checkZookeeper(zookeeper)
+		if err != nil {
+			result.addError(err)
+		} else {
+			result.info = fmt.Sprintf("%d brokers", len(zkBrokers))
+			brokers = append(brokers, zkBrokers...)
+		}
+		results = append(results, result)
+	}
+
+	for _, broker := range brokers {
+		if seen["kafka|"+broker] {
+			continue
+		}
+		seen["kafka|"+broker] = true
+
+		result := &checkResult{component: "kafka", name: broker}
+		conn, err := net.DialTimeout("tcp", broker, checkDialTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		result.addError(err)
+		results = append(results, result)
+	}
+
+	for _, influxdb := range influxdbs {
+		result := &checkResult{component: "influxdb"}
+		if influxdb.InfluxdbMode == "udp" {
+			result.name = "udp://" + influxdb.InfluxdbUdpAddr
+			result.info = "resolved only, udp is connectionless"
+			_, err := net.ResolveUDPAddr("udp", influxdb.InfluxdbUdpAddr)
+			result.addError(err)
+		} else {
+			result.name = redactUrl(influxdb.InfluxdbHost)
+			info, err := checkInfluxdb(influxdb)
+			result.info = info
+			result.addError(err)
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+/* checkZookeeper returns the brokers registered in zookeeper */
+func checkZookeeper(zookeeper string) ([]string, error) {
+	type brokerList struct {
+		brokers []string
+		err     error
+	}
+	done := make(chan brokerList, 1)
+
+	/* requests of the zookeeper client wait for a session without a deadline */
+	go func() {
+		kazooConfig := kazoo.NewConfig()
+		kazooConfig.Timeout = checkDialTimeout
+		kazooClient, err := kazoo.NewKazooFromConnectionString(zookeeper, kazooConfig)
+		if err != nil {
+			done <- brokerList{nil, err}
+			return
+		}
+		defer kazooClient.Close()
+
+		brokers, err := kazooClient.BrokerList()
+		done <- brokerList{brokers, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.brokers, result.err
+	case <-time.After(checkDialTimeout):
+		return nil, fmt.Errorf("no answer within %s", checkDialTimeout)
+	}
+}
+
+/* checkInfluxdb pings influxdb and returns its version */
+func checkInfluxdb(config *InfluxdbOutputConfig) (string, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(config.InfluxdbHost, "/")+"/ping", nil)
+	if err != nil {
+		return "", err
+	}
+	if config.InfluxdbUser != "" {
+		req.SetBasicAuth(config.InfluxdbUser, config.InfluxdbPassword)
+	}
+
+	client := &http.Client{Timeout: checkDialTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return "", errors.New("ping returned " + res.Status)
+	}
+
+	version := res.Header.Get("X-Influxdb-Version")
+	if version != "" {
+		return "version " + version, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setTestEnv(t *testing.T, env map[string]string) func() {
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	defer setTestEnv(t, map[string]string{
+		"KOM_TEST_HOST":  "db.example.com",
+		"KOM_TEST_PORT":  "8086",
+		"KOM_TEST_EMPTY": "",
+	})()
+
+	for _, c := range []struct {
+		in   string
+		want string
+		err  string
+	}{
+		{in: "plain", want: "plain"},
+		{in: "", want: ""},
+		{in: "$HOME and $ alone", want: "$HOME and $ alone"},
+		{in: "${KOM_TEST_HOST}", want: "db.example.com"},
+		{in: "http://${KOM_TEST_HOST}:${KOM_TEST_PORT}/", want: "http://db.example.com:8086/"},
+		{in: "${KOM_TEST_EMPTY}", want: ""},
+		{in: "${KOM_TEST_UNSET:-fallback}", want: "fallback"},
+		{in: "${KOM_TEST_EMPTY:-fallback}", want: "fallback"},
+		{in: "${KOM_TEST_HOST:-fallback}", want: "db.example.com"},
+		{in: "${KOM_TEST_UNSET:-}", want: ""},
+		{in: "${KOM_TEST_UNSET:-a:-b}", want: "a:-b"},
+		{in: "${KOM_TEST_UNSET:-${KOM_TEST_HOST}}", want: "db.example.com"},
+		{in: "${KOM_TEST_UNSET:-${KOM_TEST_EMPTY:-${KOM_TEST_PORT}}}/x", want: "8086/x"},
+		{in: "${KOM_TEST_HOST:-${KOM_TEST_UNSET}}", want: "db.example.com"},
+		{in: "${KOM_TEST_UNSET:-x}}", want: "x}"},
+		{in: "$${KOM_TEST_HOST}", want: "${KOM_TEST_HOST}"},
+		{in: "${KOM_TEST_UNSET:-$${literal}", want: "${literal"},
+		{in: "${KOM_TEST_UNSET}", err: "environment variable KOM_TEST_UNSET is not set"},
+		{in: "${KOM_TEST_UNSET:-${KOM_TEST_UNSET2}}", err: "environment variable KOM_TEST_UNSET2 is not set"},
+		{in: "${KOM_TEST_HOST", err: "unterminated ${"},
+		{in: "${KOM_TEST_UNSET:-${KOM_TEST_HOST}", err: "unterminated ${"},
+		{in: "${}", err: "invalid environment variable name"},
+		{in: "${1ABC}", err: "invalid environment variable name"},
+		{in: "${A B}", err: "invalid environment variable name"},
+	} {
+		got, err := expandEnv(c.in)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expandEnv(%q) error = %v, want %q", c.in, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandEnv(%q) failed: %s", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-offset-mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setTestEnv(t, map[string]string{"KOM_TEST_DB": "monitor", "KOM_TEST_SECRET": secret})()
+
+	want := `{"http_server":{"listenAddr":":8100"},"outputs":[{"influxdbDb":"monitor","influxdbPassword":"s3cret","interval":"5s","type":"influxdb"}]}`
+	for _, c := range []struct {
+		name string
+		data string
+		want string
+		err  string
+	}{
+		{
+			name: "config.json",
+			data: `{"http_server": {"listenAddr": ":8100"}, "outputs": [{"type": "influxdb", "interval": "5s",
+				"influxdbDb": "${KOM_TEST_DB}", "influxdbPassword_file": "${KOM_TEST_SECRET}"}]}`,
+			want: want,
+		},
+		{
+			name: "config.yaml",
+			data: "http_server:\n  listenAddr: \":8100\"\noutputs:\n  - type: influxdb\n    interval: 5s\n" +
+				"    influxdbDb: ${KOM_TEST_DB}\n    influxdbPassword_file: ${KOM_TEST_SECRET}\n",
+			want: want,
+		},
+		{
+			name: "config.yml",
+			data: "http_server: {listenAddr: \":8100\"}\noutputs:\n- {type: influxdb, interval: 5s, influxdbDb: \"${KOM_TEST_DB}\", influxdbPassword_file: \"${KOM_TEST_SECRET}\"}\n",
+			want: want,
+		},
+		{
+			name: "config.toml",
+			data: "[http_server]\nlistenAddr = \":8100\"\n\n[[outputs]]\ntype = \"influxdb\"\ninterval = \"5s\"\n" +
+				"influxdbDb = \"${KOM_TEST_DB}\"\ninfluxdbPassword_file = \"${KOM_TEST_SECRET}\"\n",
+			want: want,
+		},
+		{
+			name: "both.json",
+			data: `{"outputs": [{"password": "x", "password_file": "${KOM_TEST_SECRET}"}]}`,
+			err:  "outputs[0]: both password and password_file are set",
+		},
+		{
+			name: "missing.json",
+			data: `{"outputs": [{"password_file": "` + filepath.Join(dir, "missing") + `"}]}`,
+			err:  "outputs[0].password_file:",
+		},
+		{
+			name: "unset.yaml",
+			data: "outputs:\n  - influxdbDb: ${KOM_TEST_UNSET}\n",
+			err:  "outputs[0].influxdbDb: environment variable KOM_TEST_UNSET is not set",
+		},
+		{
+			name: "trailing.json",
+			data: `{} {}`,
+			err:  "invalid data after the top-level value",
+		},
+	} {
+		path := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(path, []byte(c.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readConfig(path)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error = %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
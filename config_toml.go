@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+parseToml decodes a toml document into the values encoding/json produces.
+Tables, arrays of tables, dotted keys, inline tables, arrays, strings,
+integers, floats and booleans are supported, dates are kept as strings.
+*/
+func parseToml(data []byte) (interface{}, error) {
+	p := &tomlParser{text: strings.Replace(string(data), "\r\n", "\n", -1), line: 1}
+	root := map[string]interface{}{}
+	err := p.parseDocument(root)
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+type tomlParser struct {
+	text string
+	pos  int
+	line int
+
+	/* tables opened by a [header], which may not be opened again */
+	defined map[string]bool
+}
+
+func (this *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("toml: line %d: %s", this.line, fmt.Sprintf(format, args...))
+}
+
+func (this *tomlParser) eof() bool {
+	return this.pos >= len(this.text)
+}
+
+func (this *tomlParser) peek() byte {
+	if this.eof() {
+		return 0
+	}
+	return this.text[this.pos]
+}
+
+func (this *tomlParser) next() byte {
+	c := this.text[this.pos]
+	this.pos++
+	if c == '\n' {
+		this.line++
+	}
+	return c
+}
+
+func (this *tomlParser) skipSpace() {
+	for !this.eof() && (this.peek() == ' ' || this.peek() == '\t') {
+		this.pos++
+	}
+}
+
+/* skips blanks, newlines and comments */
+func (this *tomlParser) skipLines() {
+	for !this.eof() {
+		switch this.peek() {
+		case ' ', '\t', '\n':
+			this.next()
+		case '#':
+			for !this.eof() && this.peek() != '\n' {
+				this.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+/* expectLineEnd allows a comment after a key/value pair or a header */
+func (this *tomlParser) expectLineEnd() error {
+	this.skipSpace()
+	if this.peek() == '#' {
+		for !this.eof() && this.peek() != '\n' {
+			this.pos++
+		}
+	}
+	if this.eof() {
+		return nil
+	}
+	if this.peek() != '\n' {
+		return this.errorf("expected end of line, got %q", this.rest())
+	}
+	this.next()
+	return nil
+}
+
+func (this *tomlParser) rest() string {
+	end := strings.IndexByte(this.text[this.pos:], '\n')
+	if end < 0 {
+		return this.text[this.pos:]
+	}
+	return this.text[this.pos : this.pos+end]
+}
+
+func (this *tomlParser) parseDocument(root map[string]interface{}) error {
+	this.defined = map[string]bool{}
+	current := root
+
+	for {
+		this.skipLines()
+		if this.eof() {
+			return nil
+		}
+
+		if this.peek() != '[' {
+			err := this.parseKeyValue(current)
+			if err != nil {
+				return err
+			}
+			err = this.expectLineEnd()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		this.next()
+		array := this.peek() == '['
+		if array {
+			this.next()
+		}
+		keys, err := this.parseKey()
+		if err != nil {
+			return err
+		}
+		closing := "]"
+		if array {
+			closing = "]]"
+		}
+		this.skipSpace()
+		if !strings.HasPrefix(this.text[this.pos:], closing) {
+			return this.errorf("expected %s after table name", closing)
+		}
+		this.pos += len(closing)
+
+		name := strings.Join(keys, ".")
+		if array {
+			parent, err := this.table(root, keys[:len(keys)-1])
+			if err != nil {
+				return err
+			}
+			last := keys[len(keys)-1]
+			l, ok := parent[last].([]interface{})
+			if parent[last] != nil && !ok {
+				return this.errorf("%s is not an array of tables", name)
+			}
+			current = map[string]interface{}{}
+			parent[last] = append(l, current)
+		} else {
+			if this.defined[name] {
+				return this.errorf("table %s defined twice", name)
+			}
+			this.defined[name] = true
+			current, err = this.table(root, keys)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = this.expectLineEnd()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/* table returns the table at keys, creating missing ones, following arrays of tables to their last entry */
+func (this *tomlParser) table(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	t := root
+	for i, key := range keys {
+		switch v := t[key].(type) {
+		case nil:
+			next := map[string]interface{}{}
+			t[key] = next
+			t = next
+		case map[string]interface{}:
+			t = v
+		case []interface{}:
+			last, ok := interface{}(nil), false
+			if len(v) > 0 {
+				last = v[len(v)-1]
+			}
+			if t, ok = last.(map[string]interface{}); !ok {
+				return nil, this.errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+			}
+		default:
+			return nil, this.errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return t, nil
+}
+
+func (this *tomlParser) parseKeyValue(t map[string]interface{}) error {
+	keys, err := this.parseKey()
+	if err != nil {
+		return err
+	}
+	this.skipSpace()
+	if this.peek() != '=' {
+		return this.errorf("expected = after key %s", strings.Join(keys, "."))
+	}
+	this.next()
+
+	value, err := this.parseValue()
+	if err != nil {
+		return err
+	}
+
+	t, err = this.table(t, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, dup := t[last]; dup {
+		return this.errorf("duplicate key %s", strings.Join(keys, "."))
+	}
+	t[last] = value
+	return nil
+}
+
+/* parseKey parses a dotted key of bare and quoted parts */
+func (this *tomlParser) parseKey() ([]string, error) {
+	keys := []string{}
+	for {
+		this.skipSpace()
+		var key string
+		switch c := this.peek(); {
+		case c == '"' || c == '\'':
+			s, err := this.parseString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			start := this.pos
+			for !this.eof() && isTomlBareKeyChar(this.peek()) {
+				this.pos++
+			}
+			if start == this.pos {
+				return nil, this.errorf("expected a key, got %q", this.rest())
+			}
+			key = this.text[start:this.pos]
+		}
+		keys = append(keys, key)
+
+		this.skipSpace()
+		if this.peek() != '.' {
+			return keys, nil
+		}
+		this.next()
+	}
+}
+
+func isTomlBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+var (
+	tomlIntRegexp   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	tomlFloatRegexp = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+	tomlDateRegexp  = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}([Tt ][0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?)?([Zz]|[-+][0-9]{2}:[0-9]{2})?$|^[0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?$`)
+)
+
+func (this *tomlParser) parseValue() (interface{}, error) {
+	this.skipSpace()
+	if this.eof() {
+		return nil, this.errorf("expected a value")
+	}
+
+	switch c := this.peek(); c {
+	case '"', '\'':
+		return this.parseString()
+
+	case '[':
+		this.next()
+		l := []interface{}{}
+		for {
+			this.skipLines()
+			if this.peek() == ']' {
+				this.next()
+				return l, nil
+			}
+			v, err := this.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+			this.skipLines()
+			switch this.peek() {
+			case ',':
+				this.next()
+			case ']':
+			default:
+				return nil, this.errorf("expected , or ] in array, got %q", this.rest())
+			}
+		}
+
+	case '{':
+		this.next()
+		t := map[string]interface{}{}
+		this.skipSpace()
+		if this.peek() == '}' {
+			this.next()
+			return t, nil
+		}
+		for {
+			err := this.parseKeyValue(t)
+			if err != nil {
+				return nil, err
+			}
+			this.skipSpace()
+			switch this.peek() {
+			case ',':
+				this.next()
+			case '}':
+				this.next()
+				return t, nil
+			default:
+				return nil, this.errorf("expected , or } in inline table, got %q", this.rest())
+			}
+		}
+	}
+
+	start := this.pos
+	for !this.eof() && strings.IndexByte(" \t\n#,]}", this.peek()) < 0 {
+		this.pos++
+	}
+	token := this.text[start:this.pos]
+
+	/* a date followed by a time may be separated by a space */
+	if len(token) == 10 && this.peek() == ' ' && this.pos+3 < len(this.text) && this.text[this.pos+1] >= '0' && this.text[this.pos+1] <= '9' {
+		end := this.pos + 1
+		for end < len(this.text) && strings.IndexByte(" \t\n#,]}", this.text[end]) < 0 {
+			end++
+		}
+		if tomlDateRegexp.MatchString(token + this.text[this.pos:end]) {
+			token += this.text[this.pos:end]
+			this.pos = end
+		}
+	}
+
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "":
+		return nil, this.errorf("expected a value, got %q", this.rest())
+	}
+
+	number := strings.Replace(token, "_", "", -1)
+	switch {
+	case strings.HasPrefix(number, "0x") || strings.HasPrefix(number, "0o") || strings.HasPrefix(number, "0b"):
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[number[1]]
+		n, err := strconv.ParseInt(number[2:], base, 64)
+		if err != nil {
+			return nil, this.errorf("invalid integer %s", token)
+		}
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case tomlIntRegexp.MatchString(number):
+		n, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			return nil, this.errorf("invalid integer %s", token)
+		}
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case tomlFloatRegexp.MatchString(number):
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, this.errorf("invalid float %s", token)
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	case tomlDateRegexp.MatchString(token):
+		return token, nil
+	}
+	return nil, this.errorf("invalid value %s", token)
+}
+
+/* parseString parses basic, literal and multi-line strings */
+func (this *tomlParser) parseString() (string, error) {
+	quote := this.peek()
+	multi := strings.HasPrefix(this.text[this.pos:], strings.Repeat(string(quote), 3))
+	if multi {
+		this.pos += 3
+		/* a newline right after the opening quotes is trimmed */
+		if this.peek() == '\n' {
+			this.next()
+		}
+	} else {
+		this.next()
+	}
+
+	var buf []byte
+	for {
+		if this.eof() {
+			return "", this.errorf("unterminated string")
+		}
+		if multi && strings.HasPrefix(this.text[this.pos:], strings.Repeat(string(quote), 3)) {
+			this.pos += 3
+			return string(buf), nil
+		}
+		c := this.next()
+		switch {
+		case !multi && c == quote:
+			return string(buf), nil
+		case !multi && c == '\n':
+			return "", this.errorf("newline in string")
+		case quote == '"' && c == '\\':
+			s, err := this.parseEscape(multi)
+			if err != nil {
+				return "", err
+			}
+			buf = append(buf, s...)
+		default:
+			buf = append(buf, c)
+		}
+	}
+}
+
+func (this *tomlParser) parseEscape(multi bool) (string, error) {
+	if this.eof() {
+		return "", this.errorf("unterminated string")
+	}
+	c := this.next()
+	switch c {
+	case 'b':
+		return "\b", nil
+	case 't':
+		return "\t", nil
+	case 'n':
+		return "\n", nil
+	case 'f':
+		return "\f", nil
+	case 'r':
+		return "\r", nil
+	case '"':
+		return "\"", nil
+	case '\\':
+		return "\\", nil
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if this.pos+size > len(this.text) {
+			return "", this.errorf("invalid unicode escape")
+		}
+		n, err := strconv.ParseUint(this.text[this.pos:this.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(n)) {
+			return "", this.errorf("invalid unicode escape")
+		}
+		this.pos += size
+		return string(rune(n)), nil
+	case ' ', '\t', '\n':
+		/* a backslash at the end of a line trims the following whitespace */
+		if multi {
+			for !this.eof() && strings.IndexByte(" \t\n", this.peek()) >= 0 {
+				this.next()
+			}
+			return "", nil
+		}
+	}
+	return "", this.errorf("invalid escape \\%c", c)
+}
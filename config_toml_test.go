@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseToml(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", `{}`},
+		{"comments only", "# nothing\n\n  # here\n", `{}`},
+		{"scalars", "s = \"text\"\ni = 42\nn = -7\nbig = 1_000_000\nhex = 0x1f\noct = 0o17\nbin = 0b101\nf = 1.5\ne = 5e-1\nt = true\nfalse_ = false\n",
+			`{"big":1000000,"bin":5,"e":0.5,"f":1.5,"false_":false,"hex":31,"i":42,"n":-7,"oct":15,"s":"text","t":true}`},
+		{"dates are strings", "d = 2024-01-02\ndt = 2024-01-02T03:04:05Z\nspace = 2024-01-02 03:04:05+08:00\ntime = 03:04:05.5\n",
+			`{"d":"2024-01-02","dt":"2024-01-02T03:04:05Z","space":"2024-01-02 03:04:05+08:00","time":"03:04:05.5"}`},
+		{"basic strings", `s = "tab\there \"q\" \\ \u00e9 \U0001F600"` + "\n",
+			`{"s":"tab\there \"q\" \\ é 😀"}`},
+		{"literal strings", `path = 'C:\dir\file'` + "\nre = '<\\i\\c*\\s*>'\n",
+			`{"path":"C:\\dir\\file","re":"\u003c\\i\\c*\\s*\u003e"}`},
+		{"multi-line strings", "a = \"\"\"\nline 1\nline 2\"\"\"\nb = \"\"\"\\\n  joined \\\n  words\"\"\"\nc = '''\nraw \\n\n'''\n",
+			`{"a":"line 1\nline 2","b":"joined words","c":"raw \\n\n"}`},
+		{"comments", "# head\na = 1 # one\ns = \"x # not a comment\" # comment\n",
+			`{"a":1,"s":"x # not a comment"}`},
+		{"keys", "bare-key_1 = 1\n\"quoted key\" = 2\n'literal.key' = 3\na.b.c = 4\na . d = 5\n",
+			`{"a":{"b":{"c":4},"d":5},"bare-key_1":1,"literal.key":3,"quoted key":2}`},
+		{"tables", "top = 1\n[http_server]\nlistenAddr = \":8100\"\n\n[log.levels]\nscheduler = \"debug\"\n[log]\nlevel = \"info\"\n",
+			`{"http_server":{"listenAddr":":8100"},"log":{"level":"info","levels":{"scheduler":"debug"}},"top":1}`},
+		{"quoted table names", "[a.\"b.c\"]\nx = 1\n[ d . e ]\ny = 2\n",
+			`{"a":{"b.c":{"x":1}},"d":{"e":{"y":2}}}`},
+		{"arrays of tables", "[[outputs]]\ntype = \"file\"\n[outputs.labels]\nenv = \"prod\"\n\n[[outputs]]\ntype = \"statsd\"\n[[outputs.extra]]\nn = 1\n",
+			`{"outputs":[{"labels":{"env":"prod"},"type":"file"},{"extra":[{"n":1}],"type":"statsd"}]}`},
+		{"arrays", "a = [1, 2, 3]\nb = [\"x\", 'y']\nc = [\n  1, # one\n  2,\n]\nd = [[1, 2], [\"a\"]]\ne = []\n",
+			`{"a":[1,2,3],"b":["x","y"],"c":[1,2],"d":[[1,2],["a"]],"e":[]}`},
+		{"inline tables", "labels = {env = \"prod\", team = \"a, b\"}\nnested = {a = {b = 1}, c.d = 2}\nempty = {}\n",
+			`{"empty":{},"labels":{"env":"prod","team":"a, b"},"nested":{"a":{"b":1},"c":{"d":2}}}`},
+		{"crlf", "a = 1\r\n[t]\r\nb = \"x\"\r\n",
+			`{"a":1,"t":{"b":"x"}}`},
+		{"env references stay strings", "a = \"${HOST:-localhost}\"\n",
+			`{"a":"${HOST:-localhost}"}`},
+	} {
+		v, err := parseToml([]byte(c.in))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		got, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseTomlErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"duplicate key", "a = 1\na = 2\n", "line 2: duplicate key a"},
+		{"duplicate dotted key", "a.b = 1\na.b = 2\n", "duplicate key a.b"},
+		{"table defined twice", "[t]\na = 1\n[t]\nb = 2\n", "line 3: table t defined twice"},
+		{"value is not a table", "a = 1\n[a.b]\n", "a is not a table"},
+		{"table is not an array", "[a]\n[[a]]\n", "a is not an array of tables"},
+		{"missing equal sign", "a 1\n", "expected = after key a"},
+		{"missing value", "a =\n", "expected a value"},
+		{"two values on a line", "a = 1 b = 2\n", "expected end of line"},
+		{"unterminated string", "a = \"x", "unterminated string"},
+		{"newline in string", "a = \"x\ny\"\n", "newline in string"},
+		{"bad escape", `a = "\q"` + "\n", `invalid escape \q`},
+		{"bad unicode escape", `a = "\uZZZZ"` + "\n", "invalid unicode escape"},
+		{"bare word", "a = yes\n", "invalid value yes"},
+		{"leading zero", "a = 012\n", "invalid value 012"},
+		{"unclosed table header", "[t\na = 1\n", "expected ] after table name"},
+		{"unclosed array", "a = [1, 2\n", "expected , or ] in array"},
+		{"unclosed inline table", "a = {b = 1\n", "expected , or } in inline table"},
+		{"missing key", "= 1\n", "expected a key"},
+	} {
+		_, err := parseToml([]byte(c.in))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error = %v, want %q", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+parseYaml decodes the part of yaml used by config files into the values
+encoding/json produces: block and flow mappings and sequences, plain and
+quoted scalars, literal (|) and folded (>) block scalars and comments.
+Anchors, aliases, tags and multiple documents are rejected.
+*/
+func parseYaml(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, text := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		if strings.HasPrefix(text[indent:], "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed in indentation", i+1)
+		}
+		p.lines = append(p.lines, &yamlLine{num: i + 1, indent: indent, text: text[indent:], raw: text})
+	}
+
+	/* a leading document marker is fine, a second document is not */
+	if line := p.peek(); line != nil && isYamlDocumentStart(line) {
+		p.pos++
+	}
+
+	line := p.peek()
+	if line == nil {
+		return nil, nil
+	}
+	v, err := p.parseNode(line.indent)
+	if err != nil {
+		return nil, err
+	}
+	if line := p.peek(); line != nil && !(line.indent == 0 && line.text == "...") {
+		if isYamlDocumentStart(line) {
+			return nil, p.errorf(line, "multiple documents are not supported")
+		}
+		return nil, p.errorf(line, "unexpected %q", line.text)
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+	raw    string
+}
+
+type yamlParser struct {
+	lines []*yamlLine
+	pos   int
+}
+
+func (this *yamlParser) errorf(line *yamlLine, format string, args ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", line.num, fmt.Sprintf(format, args...))
+}
+
+/* peek returns the next line with content, skipping blank and comment lines */
+func (this *yamlParser) peek() *yamlLine {
+	for this.pos < len(this.lines) {
+		line := this.lines[this.pos]
+		if line.text != "" && !strings.HasPrefix(line.text, "#") {
+			return line
+		}
+		this.pos++
+	}
+	return nil
+}
+
+func isYamlDocumentStart(line *yamlLine) bool {
+	return line.indent == 0 && (line.text == "---" || strings.HasPrefix(line.text, "--- "))
+}
+
+/* isYamlDocumentEnd tells whether line ends the nodes of the document, --- or ... */
+func isYamlDocumentEnd(line *yamlLine) bool {
+	return isYamlDocumentStart(line) || line.indent == 0 && line.text == "..."
+}
+
+func isYamlSequenceEntry(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (this *yamlParser) parseNode(indent int) (interface{}, error) {
+	line := this.peek()
+	if line == nil || line.indent < indent || isYamlDocumentEnd(line) {
+		return nil, nil
+	}
+	if isYamlSequenceEntry(line.text) {
+		return this.parseSequence(line.indent)
+	}
+	if _, _, ok := splitYamlKey(line.text); ok {
+		return this.parseMapping(line.indent)
+	}
+
+	this.pos++
+	return this.parseInline(line, line.text)
+}
+
+func (this *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+
+	for {
+		line := this.peek()
+		if line == nil || line.indent < indent || isYamlDocumentEnd(line) {
+			return m, nil
+		}
+		if line.indent > indent {
+			return nil, this.errorf(line, "bad indentation")
+		}
+		key, rest, ok := splitYamlKey(line.text)
+		if !ok {
+			return nil, this.errorf(line, "expected a mapping key, got %q", line.text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, this.errorf(line, "duplicate key %s", key)
+		}
+		this.pos++
+
+		rest = stripYamlComment(rest)
+		var v interface{}
+		var err error
+		switch {
+		case rest == "":
+			/* the value is a block below, sequences may start at the same indent */
+			next := this.peek()
+			if next != nil && (next.indent > indent || next.indent == indent && isYamlSequenceEntry(next.text)) {
+				v, err = this.parseNode(next.indent)
+			}
+		case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+			v, err = this.parseBlockScalar(line, rest, indent)
+		default:
+			v, err = this.parseInline(line, rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+}
+
+func (this *yamlParser) parseSequence(indent int) (interface{}, error) {
+	l := []interface{}{}
+
+	for {
+		/* a sequence may be indented like the key it is the value of */
+		line := this.peek()
+		if line == nil || line.indent < indent || line.indent == indent && !isYamlSequenceEntry(line.text) || isYamlDocumentEnd(line) {
+			return l, nil
+		}
+		if line.indent > indent {
+			return nil, this.errorf(line, "bad indentation")
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if stripYamlComment(rest) == "" {
+			this.pos++
+			next := this.peek()
+			var v interface{}
+			if next != nil && next.indent > indent {
+				var err error
+				v, err = this.parseNode(next.indent)
+				if err != nil {
+					return nil, err
+				}
+			}
+			l = append(l, v)
+			continue
+		}
+
+		/* "- key: value" starts a mapping indented by the dash */
+		itemIndent := line.indent + len(line.text) - len(rest)
+		this.lines[this.pos] = &yamlLine{num: line.num, indent: itemIndent, text: rest, raw: line.raw}
+		v, err := this.parseNode(itemIndent)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+}
+
+/* parseInline parses a scalar or a flow collection, which may span lines */
+func (this *yamlParser) parseInline(line *yamlLine, text string) (interface{}, error) {
+	text = stripYamlComment(text)
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		for !yamlFlowClosed(text) {
+			next := this.peek()
+			if next == nil {
+				return nil, this.errorf(line, "unterminated flow collection")
+			}
+			this.pos++
+			text += " " + stripYamlComment(next.text)
+		}
+		f := &yamlFlow{text: text}
+		v, err := f.parseValue()
+		if err == nil {
+			f.skipSpace()
+			if f.pos < len(f.text) {
+				err = fmt.Errorf("unexpected %q after flow collection", f.text[f.pos:])
+			}
+		}
+		if err != nil {
+			return nil, this.errorf(line, "%s", err.Error())
+		}
+		return v, nil
+	}
+
+	v, err := parseYamlScalar(text)
+	if err != nil {
+		return nil, this.errorf(line, "%s", err.Error())
+	}
+	return v, nil
+}
+
+/* parseBlockScalar reads the lines of a | or > scalar indented below indent */
+func (this *yamlParser) parseBlockScalar(line *yamlLine, header string, indent int) (interface{}, error) {
+	style := header[0]
+	chomp := header[1:]
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, this.errorf(line, "unsupported block scalar header %q", header)
+	}
+
+	lines := []string{}
+	blockIndent := -1
+	for this.pos < len(this.lines) {
+		l := this.lines[this.pos]
+		if strings.TrimSpace(l.raw) == "" {
+			lines = append(lines, "")
+			this.pos++
+			continue
+		}
+		if l.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = l.indent
+		}
+		if l.indent < blockIndent {
+			return nil, this.errorf(l, "bad indentation in block scalar")
+		}
+		lines = append(lines, l.raw[blockIndent:])
+		this.pos++
+	}
+
+	/* trailing blank lines only matter for chomping */
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var text string
+	if style == '|' {
+		text = strings.Join(lines, "\n")
+	} else {
+		var buf []string
+		for i, l := range lines {
+			switch {
+			case l == "":
+				buf = append(buf, "\n")
+			case i > 0 && lines[i-1] != "":
+				buf = append(buf, " "+l)
+			default:
+				buf = append(buf, l)
+			}
+		}
+		text = strings.Join(buf, "")
+	}
+
+	switch chomp {
+	case "-":
+	case "+":
+		text += "\n" + strings.Repeat("\n", trailing)
+	default:
+		if len(lines) > 0 {
+			text += "\n"
+		}
+	}
+	return text, nil
+}
+
+/* splitYamlKey splits "key: rest", the key may be quoted */
+func splitYamlKey(text string) (string, string, bool) {
+	if text == "" || strings.IndexByte("[{#", text[0]) >= 0 || isYamlSequenceEntry(text) {
+		return "", "", false
+	}
+
+	if text[0] == '"' || text[0] == '\'' {
+		end := yamlQuoteEnd(text, 0)
+		if end < 0 {
+			return "", "", false
+		}
+		rest := strings.TrimLeft(text[end+1:], " ")
+		if !strings.HasPrefix(rest, ":") || len(rest) > 1 && rest[1] != ' ' {
+			return "", "", false
+		}
+		key, err := parseYamlScalar(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return key.(string), strings.TrimLeft(rest[1:], " "), true
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == '#' && i > 0 && text[i-1] == ' ' {
+			return "", "", false
+		}
+		if text[i] == ':' && (i == len(text)-1 || text[i+1] == ' ') {
+			key := strings.TrimRight(text[:i], " ")
+			if key == "" {
+				return "", "", false
+			}
+			return key, strings.TrimLeft(text[i+1:], " "), true
+		}
+	}
+	return "", "", false
+}
+
+/* yamlQuoteEnd returns the index of the quote closing the one at start */
+func yamlQuoteEnd(text string, start int) int {
+	q := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch {
+		case q == '"' && text[i] == '\\':
+			i++
+		case q == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+/* stripYamlComment removes a trailing " # comment" outside of quotes */
+func stripYamlComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [{,:", text[i-1]) >= 0) {
+			end := yamlQuoteEnd(text, i)
+			if end < 0 {
+				break
+			}
+			i = end
+			continue
+		}
+		if c == '#' && (i == 0 || text[i-1] == ' ') {
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return strings.TrimRight(text, " ")
+}
+
+func yamlFlowClosed(text string) bool {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			end := yamlQuoteEnd(text, i)
+			if end < 0 {
+				return false
+			}
+			i = end
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+var (
+	yamlIntRegexp   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlFloatRegexp = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
+
+func parseYamlScalar(text string) (interface{}, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	switch text[0] {
+	case '"':
+		if yamlQuoteEnd(text, 0) != len(text)-1 {
+			return nil, fmt.Errorf("bad double-quoted string %s", text)
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad double-quoted string %s", text)
+		}
+		return s, nil
+	case '\'':
+		if yamlQuoteEnd(text, 0) != len(text)-1 {
+			return nil, fmt.Errorf("bad single-quoted string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case '&', '*', '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	case '|', '>':
+		return nil, fmt.Errorf("block scalars are only supported as mapping values")
+	}
+
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if yamlIntRegexp.MatchString(text) {
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	}
+	if yamlFloatRegexp.MatchString(text) {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+	return text, nil
+}
+
+/* yamlFlow parses [a, b] and {k: v} collections */
+type yamlFlow struct {
+	text string
+	pos  int
+}
+
+func (this *yamlFlow) skipSpace() {
+	for this.pos < len(this.text) && this.text[this.pos] == ' ' {
+		this.pos++
+	}
+}
+
+func (this *yamlFlow) parseValue() (interface{}, error) {
+	this.skipSpace()
+	if this.pos >= len(this.text) {
+		return nil, fmt.Errorf("unexpected end of flow collection")
+	}
+
+	switch this.text[this.pos] {
+	case '[':
+		this.pos++
+		l := []interface{}{}
+		for {
+			this.skipSpace()
+			if this.pos < len(this.text) && this.text[this.pos] == ']' {
+				this.pos++
+				return l, nil
+			}
+			v, err := this.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+			if err := this.parseSeparator(']'); err != nil {
+				return nil, err
+			}
+		}
+
+	case '{':
+		this.pos++
+		m := map[string]interface{}{}
+		for {
+			this.skipSpace()
+			if this.pos < len(this.text) && this.text[this.pos] == '}' {
+				this.pos++
+				return m, nil
+			}
+			k, err := this.parseScalar(":,}")
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			this.skipSpace()
+			if this.pos >= len(this.text) || this.text[this.pos] != ':' {
+				return nil, fmt.Errorf("expected : after key %s", key)
+			}
+			this.pos++
+			v, err := this.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := m[key]; dup {
+				return nil, fmt.Errorf("duplicate key %s", key)
+			}
+			m[key] = v
+			if err := this.parseSeparator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return this.parseScalar(",]}")
+}
+
+/* parseSeparator consumes a comma, or leaves the closing bracket */
+func (this *yamlFlow) parseSeparator(closing byte) error {
+	this.skipSpace()
+	if this.pos >= len(this.text) {
+		return fmt.Errorf("unterminated flow collection")
+	}
+	switch this.text[this.pos] {
+	case ',':
+		this.pos++
+		return nil
+	case closing:
+		return nil
+	}
+	return fmt.Errorf("expected , or %c, got %q", closing, this.text[this.pos:])
+}
+
+func (this *yamlFlow) parseScalar(stop string) (interface{}, error) {
+	this.skipSpace()
+	start := this.pos
+	if this.pos < len(this.text) && (this.text[this.pos] == '"' || this.text[this.pos] == '\'') {
+		end := yamlQuoteEnd(this.text, this.pos)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		this.pos = end + 1
+		return parseYamlScalar(this.text[start:this.pos])
+	}
+
+	for this.pos < len(this.text) {
+		c := this.text[this.pos]
+		if strings.IndexByte(stop, c) >= 0 && (c != ':' || this.pos+1 == len(this.text) || this.text[this.pos+1] == ' ') {
+			break
+		}
+		this.pos++
+	}
+	return parseYamlScalar(strings.TrimRight(this.text[start:this.pos], " "))
+}
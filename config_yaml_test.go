@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseYaml(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", `null`},
+		{"comments only", "# nothing\n\n  # here\n", `null`},
+		{"scalars", "s: text\ni: 42\nn: -7\nf: 1.5\ne: 1e3\nt: true\nF: False\nnil: ~\nnull2: null\nempty:\n",
+			`{"F":false,"e":1000,"empty":null,"f":1.5,"i":42,"n":-7,"nil":null,"null2":null,"s":"text","t":true}`},
+		{"strings that look like keys", "url: http://127.0.0.1:8086\naddr: :8100\ntime: 12:30\n",
+			`{"addr":":8100","time":"12:30","url":"http://127.0.0.1:8086"}`},
+		{"quoted", `a: "x\ty \"q\" \u00e9"` + "\nb: 'it''s'\nc: \"42\"\n\"d: e\": 'f # g'\n",
+			`{"a":"x\ty \"q\" é","b":"it's","c":"42","d: e":"f # g"}`},
+		{"comments", "# head\na: 1 # one\nb: x#y\nc: 'z' # quoted\n",
+			`{"a":1,"b":"x#y","c":"z"}`},
+		{"nested mappings", "http_server:\n  listenAddr: :8100\n  patterns:\n    stats: /stats\nlog:\n  level: info\n",
+			`{"http_server":{"listenAddr":":8100","patterns":{"stats":"/stats"}},"log":{"level":"info"}}`},
+		{"sequence at the key indent", "outputs:\n- type: file\n  filePath: a.jsonl\n- type: statsd\n",
+			`{"outputs":[{"filePath":"a.jsonl","type":"file"},{"type":"statsd"}]}`},
+		{"indented sequence", "outputs:\n  - type: file\n    labels:\n      env: prod\n  - type: statsd\nnext: 1\n",
+			`{"next":1,"outputs":[{"labels":{"env":"prod"},"type":"file"},{"type":"statsd"}]}`},
+		{"sequence of scalars", "- a\n- 2\n-\n- - b\n  - c\n",
+			`["a",2,null,["b","c"]]`},
+		{"entry below the dash", "-\n  a: 1\n  b: 2\n- x\n",
+			`[{"a":1,"b":2},"x"]`},
+		{"flow collections", "l: [1, two, 'three', \"four\"]\nm: {env: prod, team: \"a, b\", n: [1, {x: y}]}\ne: []\no: {}\n",
+			`{"e":[],"l":[1,"two","three","four"],"m":{"env":"prod","n":[1,{"x":"y"}],"team":"a, b"},"o":{}}`},
+		{"flow over several lines", "l: [\n  1,\n  2, # two\n]\nm: {a: 1,\n  b: 2}\n",
+			`{"l":[1,2],"m":{"a":1,"b":2}}`},
+		{"flow with urls", "hosts: [http://a:1, http://b:2]\n",
+			`{"hosts":["http://a:1","http://b:2"]}`},
+		{"literal block", "s: |\n  line 1\n    indented\n\n  line 3\nnext: x\n",
+			`{"next":"x","s":"line 1\n  indented\n\nline 3\n"}`},
+		{"folded block", "s: >\n  a\n  b\n\n  c\n",
+			`{"s":"a b\nc\n"}`},
+		{"block chomping", "strip: |-\n  a\n\nkeep: |+\n  b\n\nclip: |\n  c\n\n",
+			`{"clip":"c\n","keep":"b\n\n","strip":"a"}`},
+		{"document markers", "---\na: 1\n...\n",
+			`{"a":1}`},
+		{"document end after a sequence", "--- # start\n- a\n...\n",
+			`["a"]`},
+		{"crlf", "a: 1\r\nb:\r\n  - x\r\n",
+			`{"a":1,"b":["x"]}`},
+		{"env references stay strings", "a: ${HOST:-localhost}\nb: \"${PORT}\"\n",
+			`{"a":"${HOST:-localhost}","b":"${PORT}"}`},
+	} {
+		v, err := parseYaml([]byte(c.in))
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		got, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseYamlErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tabs are not allowed"},
+		{"duplicate key", "a: 1\nb: 2\na: 3\n", "line 3: duplicate key a"},
+		{"duplicate flow key", "m: {a: 1, a: 2}\n", "duplicate key a"},
+		{"anchor", "a: &x 1\n", "anchors, aliases and tags are not supported"},
+		{"alias", "a: *x\n", "anchors, aliases and tags are not supported"},
+		{"tag", "a: !!str 1\n", "anchors, aliases and tags are not supported"},
+		{"multiple documents", "a: 1\n---\nb: 2\n", "line 2: multiple documents are not supported"},
+		{"bad indentation", "a:\n    b: 1\n  c: 2\n", "line 3: bad indentation"},
+		{"unterminated flow", "l: [1, 2\n", "unterminated flow collection"},
+		{"garbage after flow", "l: [1] x\n", "after flow collection"},
+		{"unterminated quote", "a: \"x\n", "bad double-quoted string"},
+		{"not a mapping", "a: 1\njust text\n", "line 2: expected a mapping key"},
+		{"bad block header", "a: |x\n  b\n", "unsupported block scalar header"},
+	} {
+		_, err := parseYaml([]byte(c.in))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error = %v, want %q", c.name, err, c.err)
+		}
+	}
+}
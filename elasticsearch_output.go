@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+func init() {
+	RegisterOutput("elasticsearch", "5s", func() OutputOptions { return &ElasticsearchOutputConfig{} })
+}
+
+type ElasticsearchOutputConfig struct {
+	ElasticsearchHost           string          `json:"elasticsearchHost"`
+	ElasticsearchUser           string          `json:"elasticsearchUser"`
+	ElasticsearchPassword       string          `json:"elasticsearchPassword"`
+	ElasticsearchIndexPattern   string          `json:"elasticsearchIndexPattern"`
+	ElasticsearchDocType        string          `json:"elasticsearchDocType"`
+	ElasticsearchTemplateName   string          `json:"elasticsearchTemplateName"`
+	ElasticsearchTemplate       json.RawMessage `json:"elasticsearchTemplate"`
+	ElasticsearchMaxRetries     int             `json:"elasticsearchMaxRetries"`
+	ElasticsearchRetryBackoff   string          `json:"elasticsearchRetryBackoff"`
+	ElasticsearchTimeout        string          `json:"elasticsearchTimeout"`
+	ElasticsearchBulkActionSize int             `json:"elasticsearchBulkActionSize"`
+}
+
+func (this *ElasticsearchOutputConfig) Validate() error {
+	err := validateUrl("elasticsearchHost", this.ElasticsearchHost)
+	if err != nil {
+		return err
+	}
+	err = validateDuration("elasticsearchRetryBackoff", this.ElasticsearchRetryBackoff)
+	if err != nil {
+		return err
+	}
+	err = validateDuration("elasticsearchTimeout", this.ElasticsearchTimeout)
+	if err != nil {
+		return err
+	}
+	if len(this.ElasticsearchTemplate) > 0 {
+		var tpl map[string]interface{}
+		err = json.Unmarshal(this.ElasticsearchTemplate, &tpl)
+		if err != nil {
+			return fmt.Errorf("elasticsearchTemplate: %s", err.Error())
+		}
+	}
+	if this.ElasticsearchMaxRetries < 0 {
+		return fmt.Errorf("invalid elasticsearchMaxRetries %d", this.ElasticsearchMaxRetries)
+	}
+	if this.ElasticsearchBulkActionSize < 0 {
+		return fmt.Errorf("invalid elasticsearchBulkActionSize %d", this.ElasticsearchBulkActionSize)
+	}
+	return nil
+}
+
+func (this *ElasticsearchOutputConfig) NewOutput() Output {
+	return NewElasticsearchOutput(this)
+}
+
+type ElasticsearchLagDocument struct {
+	Timestamp             time.Time `json:"@timestamp"`
+	Cluster               string    `json:"cluster"`
+	Group                 string    `json:"group"`
+	Topic                 string    `json:"topic"`
+	Partition             int32     `json:"partition"`
+	LatestOffset          int64     `json:"latest_offset"`
+	ConsumerGroupOffset   int64     `json:"consumer_group_offset"`
+	ConsumerGroupDistance int64     `json:"consumer_group_distance"`
+}
+
+type elasticsearchBulkItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]*elasticsearchBulkItem `json:"items"`
+}
+
+type ElasticsearchOutput struct {
+	config  *ElasticsearchOutputConfig
+	client  *http.Client
+	host    string
+	backoff time.Duration
+}
+
+var elasticsearchLog = NewLogger("output").With("syncer", "elasticsearch")
+
+/* the text between braces in the index pattern is a go time layout */
+var elasticsearchIndexLayout = regexp.MustCompile(`\{([^}]*)\}`)
+
+func formatElasticsearchIndex(pattern string, t time.Time) string {
+	return elasticsearchIndexLayout.ReplaceAllStringFunc(pattern, func(m string) string {
+		return t.UTC().Format(m[1 : len(m)-1])
+	})
+}
+
+func NewElasticsearchOutput(config *ElasticsearchOutputConfig) *ElasticsearchOutput {
+	if config.ElasticsearchHost == "" {
+		config.ElasticsearchHost = "http://127.0.0.1:9200"
+	}
+	if config.ElasticsearchIndexPattern == "" {
+		config.ElasticsearchIndexPattern = "kafka-offset-mon-{2006.01.02}"
+	}
+	if config.ElasticsearchTemplateName == "" {
+		config.ElasticsearchTemplateName = "kafka-offset-mon"
+	}
+	if config.ElasticsearchMaxRetries == 0 {
+		config.ElasticsearchMaxRetries = 3
+	}
+	if config.ElasticsearchRetryBackoff == "" {
+		config.ElasticsearchRetryBackoff = "1s"
+	}
+	if config.ElasticsearchTimeout == "" {
+		config.ElasticsearchTimeout = "10s"
+	}
+	if config.ElasticsearchBulkActionSize == 0 {
+		config.ElasticsearchBulkActionSize = 1000
+	}
+
+	s := &ElasticsearchOutput{config: config}
+	return s
+}
+
+func (this *ElasticsearchOutput) Init() error {
+
+	/* init http client */
+	timeout, err := time.ParseDuration(this.config.ElasticsearchTimeout)
+	if err != nil {
+		timeout = time.Second * 10
+	}
+	this.client = &http.Client{Timeout: timeout}
+	this.host = strings.TrimRight(this.config.ElasticsearchHost, "/")
+
+	backoff, err := time.ParseDuration(this.config.ElasticsearchRetryBackoff)
+	if err != nil {
+		backoff = time.Second
+	}
+	this.backoff = backoff
+
+	/* push index template */
+	if len(this.config.ElasticsearchTemplate) > 0 {
+		_, err = this.request("PUT", "/_template/"+this.config.ElasticsearchTemplateName, "application/json", this.config.ElasticsearchTemplate)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *ElasticsearchOutput) Write(snapshot *Snapshot) error {
+	docs, err := this.collect(snapshot)
+	if err != nil {
+		return err
+	}
+
+	deadline := snapshot.WriteDeadline()
+	var lastErr error
+	for i := 0; i < len(docs); i += this.config.ElasticsearchBulkActionSize {
+		end := i + this.config.ElasticsearchBulkActionSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		err = this.bulk(docs[i:end], deadline)
+		if err != nil {
+			elasticsearchLog.Errorf("bulk failed:%s", err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (this *ElasticsearchOutput) collect(snapshot *Snapshot) ([]*ElasticsearchLagDocument, error) {
+	latestOffset := snapshot.LatestOffset
+	groupOffset := snapshot.ConsumerGroupOffset
+	distance := snapshot.ConsumerGroupDistance
+
+	now := snapshot.Time
+	docs := []*ElasticsearchLagDocument{}
+
+	for group, topicItem := range groupOffset {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				if partition == "total" {
+					continue
+				}
+				id, err := strconv.ParseInt(partition, 10, 32)
+				if err != nil {
+					return nil, err
+				}
+				docs = append(docs, &ElasticsearchLagDocument{
+					Timestamp:             now,
+					Cluster:               snapshot.Cluster,
+					Group:                 group,
+					Topic:                 topic,
+					Partition:             int32(id),
+					LatestOffset:          latestOffset[topic][partition],
+					ConsumerGroupOffset:   offset,
+					ConsumerGroupDistance: distance[group][topic][partition],
+				})
+			}
+		}
+	}
+
+	return docs, nil
+}
+
+func (this *ElasticsearchOutput) request(method string, path string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, this.host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if this.config.ElasticsearchUser != "" {
+		req.SetBasicAuth(this.config.ElasticsearchUser, this.config.ElasticsearchPassword)
+	}
+
+	res, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("elasticsearch %s %s failed with status %d:%s", method, path, res.StatusCode, string(content))
+	}
+	return content, nil
+}
+
+func (this *ElasticsearchOutput) encodeBulk(docs []*ElasticsearchLagDocument) ([]byte, error) {
+	var buf bytes.Buffer
+
+	for _, doc := range docs {
+		meta := map[string]string{"_index": formatElasticsearchIndex(this.config.ElasticsearchIndexPattern, doc.Timestamp)}
+		if this.config.ElasticsearchDocType != "" {
+			meta["_type"] = this.config.ElasticsearchDocType
+		}
+		action, err := json.Marshal(map[string]interface{}{"index": meta})
+		if err != nil {
+			return nil, err
+		}
+		source, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(source)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+/*
+bulk indexes docs and resubmits the items elasticsearch rejected with 429 or
+5xx, which are transient, backing off between attempts. Retries stop when the
+backoff would run past the deadline, the scheduler waits on Write. Items
+failing for other reasons, such as mapping conflicts, are logged and dropped.
+*/
+func (this *ElasticsearchOutput) bulk(docs []*ElasticsearchLagDocument, deadline time.Time) error {
+	backoff := this.backoff
+	pending := docs
+	dropped := 0
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > this.config.ElasticsearchMaxRetries {
+				break
+			}
+			if time.Now().Add(backoff).After(deadline) {
+				elasticsearchLog.Warnf("%d documents not retried, the cycle ends before the next attempt", len(pending))
+				break
+			}
+			metrics.IncrCounter([]string{"output", "elasticsearch", "retries"}, 1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		body, err := this.encodeBulk(pending)
+		if err != nil {
+			return err
+		}
+		content, err := this.request("POST", "/_bulk", "application/x-ndjson", body)
+		if err != nil {
+			elasticsearchLog.Errorf("bulk request failed:%s", err.Error())
+			continue
+		}
+
+		var result elasticsearchBulkResponse
+		err = json.Unmarshal(content, &result)
+		if err != nil {
+			return err
+		}
+		if !result.Errors {
+			metrics.IncrCounter([]string{"output", "elasticsearch", "points"}, float32(len(pending)))
+			pending = nil
+			break
+		}
+
+		retry := []*ElasticsearchLagDocument{}
+		for i, item := range result.Items {
+			if i >= len(pending) {
+				break
+			}
+			for _, status := range item {
+				switch {
+				case status.Status/100 == 2:
+					metrics.IncrCounter([]string{"output", "elasticsearch", "points"}, 1)
+				case status.Status == 429 || status.Status/100 == 5:
+					retry = append(retry, pending[i])
+				default:
+					dropped++
+					elasticsearchLog.Warnf("document for %s/%s/%d rejected:%s", pending[i].Group, pending[i].Topic, pending[i].Partition, string(status.Error))
+				}
+			}
+		}
+		pending = retry
+	}
+
+	if len(pending) > 0 || dropped > 0 {
+		return fmt.Errorf("%d of %d documents not indexed", len(pending)+dropped, len(docs))
+	}
+	return nil
+}
+
+func (this *ElasticsearchOutput) Close() error {
+	return nil
+}
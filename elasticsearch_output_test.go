@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchBulkRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(req.Body)
+		/* the first document is rejected by a full queue, the second by its mapping */
+		items := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			switch {
+			case strings.Contains(line, `"group":"busy"`):
+				items = append(items, `{"index":{"status":429,"error":"queue full"}}`)
+			case strings.Contains(line, `"group":"bad"`):
+				items = append(items, `{"index":{"status":400,"error":"mapper_parsing_exception"}}`)
+			case strings.Contains(line, `"group"`):
+				items = append(items, `{"index":{"status":201}}`)
+			}
+		}
+		res.Write([]byte(`{"errors":true,"items":[` + strings.Join(items, ",") + `]}`))
+	}))
+	defer server.Close()
+
+	docs := []*ElasticsearchLagDocument{{Group: "busy"}, {Group: "bad"}, {Group: "ok"}}
+	for _, c := range []struct {
+		name     string
+		deadline time.Duration
+		requests int
+	}{
+		{"retried up to elasticsearchMaxRetries", time.Minute, 3},
+		{"retries stop at the deadline", 15 * time.Millisecond, 2},
+		{"no retry past the deadline", 0, 1},
+	} {
+		requests = 0
+		output := NewElasticsearchOutput(&ElasticsearchOutputConfig{
+			ElasticsearchHost:         server.URL,
+			ElasticsearchMaxRetries:   2,
+			ElasticsearchRetryBackoff: "10ms",
+		})
+		if err := output.Init(); err != nil {
+			t.Fatal(err)
+		}
+		err := output.bulk(docs, time.Now().Add(c.deadline))
+		if err == nil || err.Error() != "2 of 3 documents not indexed" {
+			t.Errorf("%s: error = %v", c.name, err)
+		}
+		if requests != c.requests {
+			t.Errorf("%s: %d requests, want %d", c.name, requests, c.requests)
+		}
+	}
+}
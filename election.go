@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+type ElectionConfig struct {
+	Zookeeper      string `json:"zookeeper"`
+	Path           string `json:"path"`
+	SessionTimeout string `json:"sessionTimeout"`
+	Id             string `json:"id"`
+}
+
+func (this *ElectionConfig) setDefaults() {
+	if this.Path == "" {
+		this.Path = "/kafka-offset-mon/leader"
+	}
+	if this.SessionTimeout == "" {
+		this.SessionTimeout = "10s"
+	}
+	if this.Id == "" {
+		hostname, _ := os.Hostname()
+		this.Id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+}
+
+func (this *ElectionConfig) Validate() error {
+	if this.Zookeeper == "" {
+		return nil
+	}
+	if this.Path != "" && (!strings.HasPrefix(this.Path, "/") || strings.HasSuffix(this.Path, "/")) {
+		return fmt.Errorf("invalid path %q: should start and not end with /", this.Path)
+	}
+	return validateDuration("sessionTimeout", this.SessionTimeout)
+}
+
+/*
+Election elects one leader among the monitor instances sharing a zookeeper
+path: the member registered first is the leader. When the leader dies its
+session expires and its znode goes away, so a standby takes over within
+one session timeout. An instance disconnected from zookeeper gives up
+leadership right away.
+*/
+type Election struct {
+	config     *ElectionConfig
+	membership *zkMembership
+	onChange   func(isLeader bool)
+	logger     *Logger
+
+	lock     sync.RWMutex
+	isLeader bool
+	leader   string
+	members  []string
+}
+
+type ElectionStatus struct {
+	Id       string   `json:"id"`
+	IsLeader bool     `json:"isLeader"`
+	Leader   string   `json:"leader"`
+	Members  []string `json:"members"`
+}
+
+func NewElection(config *ElectionConfig) *Election {
+	config.setDefaults()
+
+	timeout, err := time.ParseDuration(config.SessionTimeout)
+	if err != nil {
+		timeout = time.Second * 10
+	}
+
+	logger := NewLogger("election").With("id", config.Id)
+
+	return &Election{
+		config:     config,
+		logger:     logger,
+		membership: newZkMembership(logger, "election", config.Zookeeper, config.Path, []byte(config.Id), timeout),
+	}
+}
+
+func (this *Election) Init() error {
+	return this.membership.Init()
+}
+
+/* Start campaigns in the background, onChange is called on every gain or loss of leadership */
+func (this *Election) Start(onChange func(isLeader bool)) error {
+	this.onChange = onChange
+
+	err := this.membership.Start(this.membersChanged)
+	if err != nil {
+		return err
+	}
+
+	this.logger.Infof("election for %s started", this.membership.path)
+	return nil
+}
+
+func (this *Election) membersChanged(members []zkMember, self int) {
+	if members == nil {
+		this.setStatus(false, "", nil)
+		return
+	}
+
+	ids := []string{}
+	for _, member := range members {
+		ids = append(ids, string(member.data))
+	}
+	leader := ""
+	if len(ids) > 0 {
+		leader = ids[0]
+	}
+	this.setStatus(self == 0, leader, ids)
+}
+
+func (this *Election) setStatus(isLeader bool, leader string, members []string) {
+	this.lock.Lock()
+	changed := this.isLeader != isLeader
+	this.isLeader = isLeader
+	if members != nil {
+		this.leader = leader
+		this.members = members
+	}
+	this.lock.Unlock()
+
+	if isLeader {
+		metrics.SetGauge([]string{"election", "leader"}, 1)
+	} else {
+		metrics.SetGauge([]string{"election", "leader"}, 0)
+	}
+
+	if changed {
+		if isLeader {
+			this.logger.Infof("now the leader")
+		} else {
+			this.logger.Infof("no longer the leader")
+		}
+		this.onChange(isLeader)
+	}
+}
+
+func (this *Election) IsLeader() bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.isLeader
+}
+
+func (this *Election) Status() *ElectionStatus {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return &ElectionStatus{
+		Id:       this.config.Id,
+		IsLeader: this.isLeader,
+		Leader:   this.leader,
+		Members:  append([]string{}, this.members...),
+	}
+}
+
+/* Health is the state of the connection to zookeeper, as shown on the status page */
+func (this *Election) Health() *ComponentStatus {
+	return this.membership.health.Status()
+}
+
+/* Close resigns by deleting the znode, so a standby takes over at once */
+func (this *Election) Close() error {
+	return this.membership.Close()
+}
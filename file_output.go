@@ -0,0 +1,390 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+func init() {
+	RegisterOutput("file", "5s", func() OutputOptions { return &FileOutputConfig{} })
+}
+
+type FileOutputConfig struct {
+	FilePath           string `json:"filePath"`
+	FileMaxSizeMb      int64  `json:"fileMaxSizeMb"`
+	FileRotateInterval string `json:"fileRotateInterval"`
+	FileCompress       bool   `json:"fileCompress"`
+	FileMaxBackups     int    `json:"fileMaxBackups"`
+	FileMaxAge         string `json:"fileMaxAge"`
+}
+
+func (this *FileOutputConfig) Validate() error {
+	if this.FileMaxSizeMb < 0 {
+		return fmt.Errorf("invalid fileMaxSizeMb %d", this.FileMaxSizeMb)
+	}
+	if this.FileMaxBackups < 0 {
+		return fmt.Errorf("invalid fileMaxBackups %d", this.FileMaxBackups)
+	}
+	err := validateDuration("fileRotateInterval", this.FileRotateInterval)
+	if err != nil {
+		return err
+	}
+	err = validateDuration("fileMaxAge", this.FileMaxAge)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/* effectivePath is the path written to once the default is filled */
+func (this *FileOutputConfig) effectivePath() string {
+	if this.FilePath == "" {
+		return defaultFilePath
+	}
+	return filepath.Clean(this.FilePath)
+}
+
+func (this *FileOutputConfig) NewOutput() Output {
+	return NewFileOutput(this)
+}
+
+type FileSnapshotRecord struct {
+	Timestamp             time.Time                              `json:"timestamp"`
+	Cluster               string                                 `json:"cluster"`
+	LatestOffset          map[string]map[string]int64            `json:"latest_offset"`
+	ConsumerGroupOffset   map[string]map[string]map[string]int64 `json:"consumer_group_offset"`
+	ConsumerGroupDistance map[string]map[string]map[string]int64 `json:"consumer_group_distance"`
+}
+
+const defaultFilePath = "kafka-offset-mon.jsonl"
+
+var fileLog = NewLogger("output").With("syncer", "file")
+
+/* the suffix rotate gives to backups, the -<n> is added when one second sees several rotations */
+var rotatedSuffix = regexp.MustCompile(`^\.([0-9]{8}-[0-9]{6})(?:-([0-9]+))?(?:\.gz)?$`)
+
+const rotatedStampLayout = "20060102-150405"
+
+type FileOutput struct {
+	config *FileOutputConfig
+	file   *rotatingFile
+}
+
+func NewFileOutput(config *FileOutputConfig) *FileOutput {
+	if config.FilePath == "" {
+		config.FilePath = defaultFilePath
+	}
+	if config.FileMaxSizeMb == 0 {
+		config.FileMaxSizeMb = 100
+	}
+
+	s := &FileOutput{config: config}
+	return s
+}
+
+func (this *FileOutput) Init() error {
+
+	/* init output file */
+	file := &rotatingFile{
+		path:     this.config.FilePath,
+		maxSize:  this.config.FileMaxSizeMb * 1024 * 1024,
+		compress: this.config.FileCompress,
+		backups:  this.config.FileMaxBackups,
+	}
+	if this.config.FileRotateInterval != "" {
+		file.rotateInterval, _ = time.ParseDuration(this.config.FileRotateInterval)
+	}
+	if this.config.FileMaxAge != "" {
+		file.maxAge, _ = time.ParseDuration(this.config.FileMaxAge)
+	}
+	err := file.open()
+	if err != nil {
+		return err
+	}
+	this.file = file
+
+	return nil
+}
+
+func (this *FileOutput) Write(snapshot *Snapshot) error {
+	line, err := json.Marshal(&FileSnapshotRecord{
+		Timestamp:             snapshot.Time,
+		Cluster:               snapshot.Cluster,
+		LatestOffset:          snapshot.LatestOffset,
+		ConsumerGroupOffset:   snapshot.ConsumerGroupOffset,
+		ConsumerGroupDistance: snapshot.ConsumerGroupDistance,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = this.file.WriteLine(line)
+	if err != nil {
+		return err
+	}
+	metrics.IncrCounter([]string{"output", "file", "points"}, 1)
+	return nil
+}
+
+func (this *FileOutput) Close() error {
+
+	if this.file != nil {
+		return this.file.Close()
+	}
+
+	return nil
+}
+
+/*
+rotatingFile appends lines to path. When the file grows past maxSize or
+was opened more than rotateInterval ago it is renamed to
+path.<20060102-150405>, with -<n> for more rotations in the same second,
+optionally gzipped, and old backups beyond backups or maxAge are removed.
+Zero values disable the matching limit.
+*/
+type rotatingFile struct {
+	path           string
+	maxSize        int64
+	rotateInterval time.Duration
+	compress       bool
+	backups        int
+	maxAge         time.Duration
+
+	fd        *os.File
+	size      int64
+	openedAt  time.Time
+	lastStamp string
+	seq       int
+}
+
+func (this *rotatingFile) open() error {
+	fd, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	this.fd = fd
+	this.size = fi.Size()
+	this.openedAt = time.Now()
+	return nil
+}
+
+func (this *rotatingFile) WriteLine(line []byte) error {
+	if this.fd == nil {
+		err := this.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if this.size > 0 && ((this.maxSize > 0 && this.size+int64(len(line))+1 > this.maxSize) ||
+		(this.rotateInterval > 0 && time.Since(this.openedAt) >= this.rotateInterval)) {
+		err := this.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := this.fd.Write(append(line, '\n'))
+	this.size += int64(n)
+	return err
+}
+
+func (this *rotatingFile) rotate() error {
+	err := this.fd.Close()
+	this.fd = nil
+	if err != nil {
+		return err
+	}
+
+	rotated := this.backupPath(time.Now())
+	err = os.Rename(this.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	err = this.open()
+	if err != nil {
+		return err
+	}
+
+	if this.compress {
+		err = gzipFile(rotated)
+		if err != nil {
+			fileLog.Errorf("compress %s failed:%s", rotated, err.Error())
+		}
+	}
+
+	this.prune()
+	return nil
+}
+
+/*
+backupPath returns a backup name not taken yet, compressed or not. Backups
+of the same second are numbered in the order they were rotated.
+*/
+func (this *rotatingFile) backupPath(now time.Time) string {
+	stamp := now.Format(rotatedStampLayout)
+	if stamp != this.lastStamp {
+		this.lastStamp = stamp
+		this.seq = 0
+	}
+	taken := func(path string) bool {
+		_, err := os.Lstat(path)
+		if err == nil {
+			return true
+		}
+		_, err = os.Lstat(path + ".gz")
+		return err == nil
+	}
+
+	for {
+		this.seq++
+		rotated := this.path + "." + stamp
+		if this.seq > 1 {
+			rotated += "-" + strconv.Itoa(this.seq)
+		}
+		if !taken(rotated) {
+			return rotated
+		}
+	}
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (this *rotatingFile) prune() {
+	if this.backups <= 0 && this.maxAge <= 0 {
+		return
+	}
+
+	dir, base := filepath.Split(this.path)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fileLog.Warnf("list %s failed:%s", dir, err.Error())
+		return
+	}
+
+	backups := []*rotatedFile{}
+	for _, fi := range infos {
+		/* only what rotate created, not other files sharing the prefix */
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, base) {
+			continue
+		}
+		backup := parseRotatedFile(name[len(base):])
+		if backup == nil {
+			continue
+		}
+		backup.path = filepath.Join(dir, name)
+		backups = append(backups, backup)
+	}
+	sort.Stable(rotatedFilesByName(backups))
+
+	for i, backup := range backups {
+		expired := this.maxAge > 0 && time.Since(backup.rotatedAt) > this.maxAge
+		excess := this.backups > 0 && i < len(backups)-this.backups
+		if expired || excess {
+			err := os.Remove(backup.path)
+			if err != nil {
+				fileLog.Warnf("remove %s failed:%s", backup.path, err.Error())
+			}
+		}
+	}
+}
+
+func (this *rotatingFile) Close() error {
+	if this.fd == nil {
+		return nil
+	}
+	err := this.fd.Close()
+	this.fd = nil
+	return err
+}
+
+/*
+rotatedFile is a backup as named by rotate. Backups are ordered by that
+name rather than their mtime, several rotations share one second.
+*/
+type rotatedFile struct {
+	path      string
+	rotatedAt time.Time
+	seq       int
+}
+
+/* parseRotatedFile reads the time and number from a backup suffix, nil if rotate did not create it */
+func parseRotatedFile(suffix string) *rotatedFile {
+	m := rotatedSuffix.FindStringSubmatch(suffix)
+	if m == nil {
+		return nil
+	}
+	rotatedAt, err := time.ParseInLocation(rotatedStampLayout, m[1], time.Local)
+	if err != nil {
+		return nil
+	}
+	seq := 1
+	if m[2] != "" {
+		seq, err = strconv.Atoi(m[2])
+		if err != nil {
+			return nil
+		}
+	}
+	return &rotatedFile{rotatedAt: rotatedAt, seq: seq}
+}
+
+type rotatedFilesByName []*rotatedFile
+
+func (this rotatedFilesByName) Len() int      { return len(this) }
+func (this rotatedFilesByName) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this rotatedFilesByName) Less(i, j int) bool {
+	if !this[i].rotatedAt.Equal(this[j].rotatedAt) {
+		return this[i].rotatedAt.Before(this[j].rotatedAt)
+	}
+	return this[i].seq < this[j].seq
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listBackups(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range infos {
+		if fi.Name() != "out.jsonl" {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotatingFileRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := &rotatingFile{path: filepath.Join(dir, "out.jsonl"), maxSize: 10, compress: true}
+	for _, line := range []string{"first", "second", "third"} {
+		if err := file.WriteLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	data, err := ioutil.ReadFile(file.path)
+	if err != nil || string(data) != "third\n" {
+		t.Errorf("current file %q, %v", data, err)
+	}
+	backups := listBackups(t, dir)
+	if len(backups) != 2 {
+		t.Fatalf("backups %v", backups)
+	}
+	for _, name := range backups {
+		if backup := parseRotatedFile(strings.TrimPrefix(name, "out.jsonl")); backup == nil || !strings.HasSuffix(name, ".gz") {
+			t.Errorf("unexpected backup %s", name)
+		}
+	}
+}
+
+func TestRotatingFileBackupPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := &rotatingFile{path: filepath.Join(dir, "out.jsonl")}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	later := now.Add(time.Second)
+
+	/* a compressed backup takes its name as well */
+	ioutil.WriteFile(file.path+".20240102-030405-2.gz", nil, 0644)
+
+	got := []string{}
+	for _, at := range []time.Time{now, now, now, later} {
+		path := file.backupPath(at)
+		ioutil.WriteFile(path, nil, 0644)
+		got = append(got, filepath.Base(path))
+	}
+	want := []string{"out.jsonl.20240102-030405", "out.jsonl.20240102-030405-3", "out.jsonl.20240102-030405-4", "out.jsonl.20240102-030406"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backup names %v, want %v", got, want)
+	}
+}
+
+func TestRotatingFilePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stamp := time.Now().Add(-time.Minute).Format(rotatedStampLayout)
+	old := time.Now().Add(-48 * time.Hour).Format(rotatedStampLayout)
+	/* oldest first, mtimes are set the other way round and must not matter */
+	names := []string{
+		"out.jsonl." + old + ".gz",
+		"out.jsonl." + stamp,
+		"out.jsonl." + stamp + "-2.gz",
+		"out.jsonl." + stamp + "-10",
+	}
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, nil, 0644)
+		mtime := time.Now().Add(-time.Duration(i) * time.Hour)
+		os.Chtimes(path, mtime, mtime)
+	}
+	/* other files sharing the prefix are left alone */
+	for _, name := range []string{"out.jsonl.bak", "out.jsonl." + old + ".old"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	for _, c := range []struct {
+		name    string
+		backups int
+		maxAge  time.Duration
+		want    []string
+	}{
+		{"max age", 0, 24 * time.Hour, names[1:]},
+		{"max backups", 2, 0, names[2:]},
+	} {
+		file := &rotatingFile{path: filepath.Join(dir, "out.jsonl"), backups: c.backups, maxAge: c.maxAge}
+		file.prune()
+		want := append([]string{"out.jsonl." + old + ".old", "out.jsonl.bak"}, c.want...)
+		sort.Strings(want)
+		if got := listBackups(t, dir); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: left %v, want %v", c.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+func init() {
+	RegisterOutput("graphite", "5s", func() OutputOptions { return &GraphiteOutputConfig{} })
+}
+
+type GraphiteOutputConfig struct {
+	GraphiteHost     string `json:"graphiteHost"`
+	GraphiteProtocol string `json:"graphiteProtocol"`
+	GraphitePrefix   string `json:"graphitePrefix"`
+	GraphiteTimeout  string `json:"graphiteTimeout"`
+
+	Labels    map[string]string     `json:"labels"`
+	Templates MetricTemplatesConfig `json:"templates"`
+}
+
+func (this *GraphiteOutputConfig) Validate() error {
+	switch this.GraphiteProtocol {
+	case "", "plaintext", "pickle":
+	default:
+		return fmt.Errorf("unknown graphiteProtocol %s, should be plaintext or pickle", this.GraphiteProtocol)
+	}
+	err := validateAddr("graphiteHost", this.GraphiteHost)
+	if err != nil {
+		return err
+	}
+	err = validateDuration("graphiteTimeout", this.GraphiteTimeout)
+	if err != nil {
+		return err
+	}
+	err = this.Templates.checkKeys(false, true, nil)
+	if err != nil {
+		return err
+	}
+	templates, err := newGraphiteTemplates(&this.Templates)
+	if err != nil {
+		return err
+	}
+	return templates.Validate("cluster", this.Labels)
+}
+
+/* the path of the series, tags make it a tagged series of graphite 1.1 */
+func newGraphiteTemplates(config *MetricTemplatesConfig) (*MetricTemplates, error) {
+	return NewMetricTemplatesWithDefaults(config, tagMetricTemplate(), tagMetricTemplate())
+}
+
+func (this *GraphiteOutputConfig) NewOutput() Output {
+	return NewGraphiteOutput(this)
+}
+
+type graphiteDatapoint struct {
+	path  string
+	value float64
+	time  int64
+}
+
+type GraphiteOutput struct {
+	config    *GraphiteOutputConfig
+	conn      net.Conn
+	timeout   time.Duration
+	rates     *RateTracker
+	templates *MetricTemplates
+}
+
+/* datapoints per message, a write failing partway resumes from the first message not written */
+const graphiteBatchSize = 500
+
+var graphiteLog = NewLogger("output").With("syncer", "graphite")
+
+var graphiteInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+/* every topic, group or cluster name becomes a single path node */
+func sanitizeGraphiteNode(name string) string {
+	return graphiteInvalidChars.ReplaceAllString(name, "_")
+}
+
+func NewGraphiteOutput(config *GraphiteOutputConfig) *GraphiteOutput {
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	if config.GraphiteProtocol == "" {
+		config.GraphiteProtocol = "plaintext"
+	}
+	if config.GraphiteHost == "" {
+		if config.GraphiteProtocol == "pickle" {
+			config.GraphiteHost = "127.0.0.1:2004"
+		} else {
+			config.GraphiteHost = "127.0.0.1:2003"
+		}
+	}
+	if config.GraphitePrefix == "" {
+		config.GraphitePrefix = "kafka_monitor"
+	}
+	if config.GraphiteTimeout == "" {
+		config.GraphiteTimeout = "5s"
+	}
+
+	s := &GraphiteOutput{config: config, rates: NewRateTracker()}
+	return s
+}
+
+func (this *GraphiteOutput) Init() error {
+
+	/* init templates */
+	templates, err := newGraphiteTemplates(&this.config.Templates)
+	if err != nil {
+		return err
+	}
+	this.templates = templates
+
+	/* init carbon connection */
+	timeout, err := time.ParseDuration(this.config.GraphiteTimeout)
+	if err != nil {
+		timeout = time.Second * 5
+	}
+	this.timeout = timeout
+
+	err = this.connect()
+	if err != nil {
+		/* not fatal, write reconnects on every cycle */
+		graphiteLog.Errorf("connect to %s failed:%s", this.config.GraphiteHost, err.Error())
+	}
+
+	return nil
+}
+
+func (this *GraphiteOutput) Write(snapshot *Snapshot) error {
+	datapoints, err := this.collect(snapshot)
+	if err != nil {
+		return err
+	}
+	return this.write(datapoints)
+}
+
+func (this *GraphiteOutput) path(cluster string, nodes ...string) string {
+	parts := []string{this.config.GraphitePrefix, sanitizeGraphiteNode(cluster)}
+	for _, node := range nodes {
+		parts = append(parts, sanitizeGraphiteNode(node))
+	}
+	return strings.Join(parts, ".")
+}
+
+/*
+datapoint renders the path of a series from values already made safe as
+path nodes, .Measurement being the default path. Tags are appended as
+;tag=value, sorted.
+*/
+func (this *GraphiteOutput) datapoint(tpl *MetricTemplate, cluster string, name string, group string, topic string, partition string, value float64, ts int64) (graphiteDatapoint, error) {
+	nodes := []string{name}
+	if group != "" {
+		nodes = append(nodes, group)
+	}
+	nodes = append(nodes, topic, partition)
+
+	m, err := tpl.Render(&MetricContext{
+		Cluster:     sanitizeGraphiteNode(cluster),
+		Topic:       sanitizeGraphiteNode(topic),
+		Group:       sanitizeGraphiteNode(group),
+		Partition:   sanitizeGraphiteNode(partition),
+		Measurement: this.path(cluster, nodes...),
+		Labels:      this.config.Labels,
+	})
+	if err != nil {
+		return graphiteDatapoint{}, err
+	}
+
+	path := m.Measurement
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path += ";" + sanitizeGraphiteNode(k) + "=" + sanitizeGraphiteNode(m.Tags[k])
+	}
+	return graphiteDatapoint{path, value, ts}, nil
+}
+
+/* rates are written with the template of the offsets they are derived from */
+func (this *GraphiteOutput) collect(snapshot *Snapshot) ([]graphiteDatapoint, error) {
+	latestOffset := snapshot.LatestOffset
+	groupOffset := snapshot.ConsumerGroupOffset
+	distance := snapshot.ConsumerGroupDistance
+	cluster := snapshot.Cluster
+
+	now := snapshot.Time
+	ts := now.Unix()
+	datapoints := []graphiteDatapoint{}
+
+	add := func(tpl *MetricTemplate, name string, group string, topic string, partition string, value float64) error {
+		dp, err := this.datapoint(tpl, cluster, name, group, topic, partition, value, ts)
+		if err != nil {
+			return err
+		}
+		datapoints = append(datapoints, dp)
+		return nil
+	}
+
+	if !snapshot.SkipTopics {
+		for topic, partitionItem := range latestOffset {
+			for partition, offset := range partitionItem {
+				if err := add(this.templates.LatestOffset, "latest_offset", "", topic, partition, float64(offset)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for topic, partitionItem := range this.rates.LatestOffsetRate(latestOffset, now) {
+			for partition, rate := range partitionItem {
+				if err := add(this.templates.LatestOffset, "latest_offset_rate", "", topic, partition, rate); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for group, topicItem := range groupOffset {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				if err := add(this.templates.ConsumerGroupOffset, "consumer_group_offset", group, topic, partition, float64(offset)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for group, topicItem := range this.rates.ConsumerGroupOffsetRate(groupOffset, now) {
+		for topic, partitionItem := range topicItem {
+			for partition, rate := range partitionItem {
+				if err := add(this.templates.ConsumerGroupOffset, "consumer_group_offset_rate", group, topic, partition, rate); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for group, topicItem := range distance {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				if err := add(this.templates.ConsumerGroupDistance, "consumer_group_distance", group, topic, partition, float64(offset)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return datapoints, nil
+}
+
+func (this *GraphiteOutput) connect() error {
+	if this.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", this.config.GraphiteHost, this.timeout)
+	if err != nil {
+		return err
+	}
+	this.conn = conn
+	return nil
+}
+
+func (this *GraphiteOutput) disconnect() {
+	if this.conn != nil {
+		this.conn.Close()
+		this.conn = nil
+	}
+}
+
+func (this *GraphiteOutput) encode(datapoints []graphiteDatapoint) [][]byte {
+	messages := [][]byte{}
+	for i := 0; i < len(datapoints); i += graphiteBatchSize {
+		end := i + graphiteBatchSize
+		if end > len(datapoints) {
+			end = len(datapoints)
+		}
+		if this.config.GraphiteProtocol == "pickle" {
+			messages = append(messages, encodeGraphitePickle(datapoints[i:end]))
+			continue
+		}
+
+		var buf bytes.Buffer
+		for _, dp := range datapoints[i:end] {
+			fmt.Fprintf(&buf, "%s %s %d\n", dp.path, strconv.FormatFloat(dp.value, 'f', -1, 64), dp.time)
+		}
+		messages = append(messages, buf.Bytes())
+	}
+	return messages
+}
+
+/*
+a broken connection is dropped and redialed once before giving up the
+cycle, the messages written before it broke are not sent again
+*/
+func (this *GraphiteOutput) write(datapoints []graphiteDatapoint) error {
+	if len(datapoints) == 0 {
+		return nil
+	}
+	messages := this.encode(datapoints)
+
+	var err error
+	sent := 0
+	for attempt := 0; attempt < 2; attempt++ {
+		err = this.connect()
+		if err != nil {
+			continue
+		}
+		var n int
+		n, err = this.send(messages[sent:])
+		sent += n
+		if err == nil {
+			metrics.IncrCounter([]string{"output", "graphite", "points"}, float32(len(datapoints)))
+			return nil
+		}
+		graphiteLog.Warnf("write to %s failed, reconnecting:%s", this.config.GraphiteHost, err.Error())
+		this.disconnect()
+	}
+	return err
+}
+
+/* send returns how many messages were written in full */
+func (this *GraphiteOutput) send(messages [][]byte) (int, error) {
+	this.conn.SetWriteDeadline(time.Now().Add(this.timeout))
+	for i, msg := range messages {
+		_, err := this.conn.Write(msg)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(messages), nil
+}
+
+func (this *GraphiteOutput) Close() error {
+
+	this.disconnect()
+
+	return nil
+}
+
+/*
+encodeGraphitePickle builds a carbon pickle message: a 4 byte big-endian
+length header followed by a protocol 2 pickle of
+[(path, (timestamp, value)), ...].
+*/
+func encodeGraphitePickle(datapoints []graphiteDatapoint) []byte {
+	var body bytes.Buffer
+	num := make([]byte, 8)
+
+	body.Write([]byte{0x80, 0x02}) // PROTO 2
+	body.WriteByte(']')            // EMPTY_LIST
+	body.WriteByte('(')            // MARK
+	for _, dp := range datapoints {
+		body.WriteByte('X') // BINUNICODE
+		binary.LittleEndian.PutUint32(num, uint32(len(dp.path)))
+		body.Write(num[:4])
+		body.WriteString(dp.path)
+
+		body.WriteByte('G') // BINFLOAT
+		binary.BigEndian.PutUint64(num, math.Float64bits(float64(dp.time)))
+		body.Write(num)
+		body.WriteByte('G')
+		binary.BigEndian.PutUint64(num, math.Float64bits(dp.value))
+		body.Write(num)
+
+		body.WriteByte(0x86) // TUPLE2 (timestamp, value)
+		body.WriteByte(0x86) // TUPLE2 (path, datapoint)
+	}
+	body.WriteByte('e') // APPENDS
+	body.WriteByte('.') // STOP
+
+	msg := make([]byte, 4, 4+body.Len())
+	binary.BigEndian.PutUint32(msg, uint32(body.Len()))
+	return append(msg, body.Bytes()...)
+}
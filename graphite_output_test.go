@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* decodeGraphitePickle runs the few pickle opcodes carbon messages use */
+func decodeGraphitePickle(data []byte) ([]graphiteDatapoint, error) {
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) != len(data)-4 {
+		return nil, fmt.Errorf("bad length header")
+	}
+	r := bytes.NewReader(data[4:])
+	stack := []interface{}{}
+	marks := []int{}
+	pop := func() interface{} {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("no STOP opcode")
+		}
+		switch op {
+		case 0x80:
+			if proto, _ := r.ReadByte(); proto != 2 {
+				return nil, fmt.Errorf("protocol %d", proto)
+			}
+		case ']':
+			stack = append(stack, []interface{}{})
+		case '(':
+			marks = append(marks, len(stack))
+		case 'X':
+			n := make([]byte, 4)
+			r.Read(n)
+			s := make([]byte, binary.LittleEndian.Uint32(n))
+			if _, err := r.Read(s); err != nil && len(s) > 0 {
+				return nil, err
+			}
+			stack = append(stack, string(s))
+		case 'G':
+			n := make([]byte, 8)
+			if _, err := r.Read(n); err != nil {
+				return nil, err
+			}
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(n)))
+		case 0x86:
+			b := pop()
+			a := pop()
+			stack = append(stack, [2]interface{}{a, b})
+		case 'e':
+			mark := marks[len(marks)-1]
+			marks = marks[:len(marks)-1]
+			items := stack[mark:]
+			stack = stack[:mark]
+			list := pop().([]interface{})
+			stack = append(stack, append(list, items...))
+		case '.':
+			if len(stack) != 1 || r.Len() != 0 {
+				return nil, fmt.Errorf("%d values and %d bytes left at STOP", len(stack), r.Len())
+			}
+			datapoints := []graphiteDatapoint{}
+			for _, item := range stack[0].([]interface{}) {
+				pair := item.([2]interface{})
+				point := pair[1].([2]interface{})
+				datapoints = append(datapoints, graphiteDatapoint{
+					path:  pair[0].(string),
+					time:  int64(point[0].(float64)),
+					value: point[1].(float64),
+				})
+			}
+			return datapoints, nil
+		default:
+			return nil, fmt.Errorf("unexpected opcode %#x", op)
+		}
+	}
+}
+
+func TestEncodeGraphitePickle(t *testing.T) {
+	empty := encodeGraphitePickle(nil)
+	want := []byte{0, 0, 0, 6, 0x80, 0x02, ']', '(', 'e', '.'}
+	if !bytes.Equal(empty, want) {
+		t.Errorf("empty message = %x, want %x", empty, want)
+	}
+
+	one := encodeGraphitePickle([]graphiteDatapoint{{path: "a.b", value: 1.5, time: 2}})
+	want = []byte{0, 0, 0, 0x22, 0x80, 0x02, ']', '(',
+		'X', 3, 0, 0, 0, 'a', '.', 'b',
+		'G', 0x40, 0, 0, 0, 0, 0, 0, 0,
+		'G', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0x86, 0x86, 'e', '.'}
+	if !bytes.Equal(one, want) {
+		t.Errorf("one datapoint = %x, want %x", one, want)
+	}
+
+	datapoints := []graphiteDatapoint{
+		{path: "kafka.cluster.topic.0.latest_offset", value: 123456789, time: 1700000000},
+		{path: "kafka.cluster.group.topic.total.distance", value: -1, time: 1700000000},
+		{path: "kafka.cluster.topic.total.latest_offset_rate", value: 0.25, time: 1700000001},
+		{path: "tagged;cluster=c;topic=t", value: 0, time: 0},
+		{path: "utf8.тема", value: math.MaxInt64, time: 1700000002},
+		{path: "", value: 1, time: 1},
+	}
+	got, err := decodeGraphitePickle(encodeGraphitePickle(datapoints))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, datapoints) {
+		t.Errorf("decoded %v, want %v", got, datapoints)
+	}
+}
+
+/* failingConn accepts writes until it has taken n of them */
+type failingConn struct {
+	net.Conn
+	n      int
+	writes [][]byte
+}
+
+func (this *failingConn) Write(b []byte) (int, error) {
+	if len(this.writes) == this.n {
+		return 0, errors.New("broken pipe")
+	}
+	this.writes = append(this.writes, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (this *failingConn) SetWriteDeadline(t time.Time) error { return nil }
+func (this *failingConn) Close() error                       { return nil }
+
+func TestGraphiteWriteResumes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	output := NewGraphiteOutput(&GraphiteOutputConfig{GraphiteHost: listener.Addr().String()})
+	output.timeout = time.Second
+	broken := &failingConn{n: 2}
+	output.conn = broken
+
+	datapoints := []graphiteDatapoint{}
+	for i := 0; i < graphiteBatchSize*3+1; i++ {
+		datapoints = append(datapoints, graphiteDatapoint{path: fmt.Sprintf("a.b%d", i), value: float64(i), time: 1})
+	}
+	if err := output.write(datapoints); err != nil {
+		t.Fatal(err)
+	}
+	output.Close()
+
+	lines := strings.Split(strings.TrimSuffix(string(bytes.Join(broken.writes, nil))+string(<-received), "\n"), "\n")
+	if len(lines) != len(datapoints) {
+		t.Fatalf("%d lines written, want %d", len(lines), len(datapoints))
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("a.b%d %d 1", i, i); line != want {
+			t.Fatalf("line %d = %q, want %q", i, line, want)
+		}
+	}
+}
@@ -1,9 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
 )
 
 type HttpServerConfig struct {
@@ -11,103 +25,559 @@ type HttpServerConfig struct {
 	PatternLatestOffset          string `json:"patternLatestOffset"`
 	PatternConsumerGroupOffset   string `json:"patternConsumerGroupOffset"`
 	PatternConsumerGroupDistance string `json:"patternConsumerGroupDistance"`
+	PatternStats                 string `json:"patternStats"`
+	PatternZabbixDiscovery       string `json:"patternZabbixDiscovery"`
+	PatternStatus                string `json:"patternStatus"`
+	PatternHealth                string `json:"patternHealth"`
+	PatternLogLevel              string `json:"patternLogLevel"`
+
+	/*
+		changing the log levels needs the admin listener, which only serves
+		patternLogLevel, or the admin token, at least one of them
+	*/
+	AdminListenAddr string `json:"adminListenAddr"`
+	AdminToken      string `json:"adminToken"`
 }
 
 type HttpServer struct {
 	config         *HttpServerConfig
-	workerRegistry map[string]*Worker
+	mux            *http.ServeMux
+	server         *http.Server
+	adminMux       *http.ServeMux
+	adminServer    *http.Server
+	workerLock     sync.Mutex
+	workerRegistry map[string]*httpWorker
+	workersClosed  bool
+
+	discoverersLock sync.RWMutex
+	discoverers     []discoveryOutput
+
+	election   *Election
+	sharding   *Sharding
+	components func() []*ComponentStatus
+	logger     *Logger
 }
 
-func NewHttpServer(config *HttpServerConfig) *HttpServer {
-	if config.ListenAddr == "" {
-		config.ListenAddr = ":8100"
+/* zookeeper of the api requests without one */
+const defaultHttpZookeeper = "localhost:2181"
+
+/*
+requests forwarded by another member carry this header: "owner" for a
+request proxied to the owner of a cluster, "local" for one asking for the
+consumer groups owned by this member only.
+*/
+const shardHeader = "X-Kafka-Offset-Mon-Shard"
+
+/* time of the data in a stale answer */
+const staleHeader = "X-Kafka-Offset-Mon-Stale"
+
+/* timeout of every request to another member */
+const shardRequestTimeout = 30 * time.Second
+
+/* how long Close waits for the requests in flight, a shutdown has its own deadline */
+const httpDrainTimeout = 10 * time.Second
+
+/* outputs serving zabbix low-level discovery */
+type discoveryOutput interface {
+	Discovery(kind string) ([]map[string]string, error)
+}
+
+/* setDefaults fills the listen address and the patterns not configured */
+func (this *HttpServerConfig) setDefaults() {
+	if this.ListenAddr == "" {
+		this.ListenAddr = ":8100"
+	}
+
+	if this.PatternConsumerGroupOffset == "" {
+		this.PatternConsumerGroupOffset = "/consumer_group_offset"
+	}
+
+	if this.PatternConsumerGroupDistance == "" {
+		this.PatternConsumerGroupDistance = "/consumer_group_distance"
+	}
+
+	if this.PatternLatestOffset == "" {
+		this.PatternLatestOffset = "/latest_offset"
+	}
+
+	if this.PatternStats == "" {
+		this.PatternStats = "/stats"
 	}
 
-	if config.PatternConsumerGroupOffset == "" {
-		config.PatternConsumerGroupOffset = "/consumer_group_offset"
+	if this.PatternZabbixDiscovery == "" {
+		this.PatternZabbixDiscovery = "/zabbix_discovery"
 	}
 
-	if config.PatternConsumerGroupDistance == "" {
-		config.PatternConsumerGroupDistance = "/consumer_group_distance"
+	if this.PatternStatus == "" {
+		this.PatternStatus = "/status"
 	}
 
-	if config.PatternLatestOffset == "" {
-		config.PatternLatestOffset = "/latest_offset"
+	if this.PatternHealth == "" {
+		this.PatternHealth = "/health"
 	}
 
+	if this.PatternLogLevel == "" {
+		this.PatternLogLevel = "/admin/log_level"
+	}
+}
+
+func NewHttpServer(config *HttpServerConfig) *HttpServer {
+	config.setDefaults()
+
 	s := &HttpServer{
 		config:         config,
-		workerRegistry: map[string]*Worker{},
+		mux:            http.NewServeMux(),
+		adminMux:       http.NewServeMux(),
+		workerRegistry: map[string]*httpWorker{},
+		logger:         NewLogger("http").With("listen", config.ListenAddr),
 	}
 	return s
 }
 
+func (this *HttpServerConfig) Validate() error {
+	err := validateAddr("listenAddr", this.ListenAddr)
+	if err != nil {
+		return err
+	}
+	err = validateAddr("adminListenAddr", this.AdminListenAddr)
+	if err != nil {
+		return err
+	}
+	if this.AdminListenAddr != "" && this.AdminListenAddr == this.ListenAddr {
+		return fmt.Errorf("adminListenAddr and listenAddr are both %q", this.ListenAddr)
+	}
+
+	/*
+		http.ServeMux panics on a pattern registered twice, the defaults of
+		the patterns left out count as well
+	*/
+	config := *this
+	config.setDefaults()
+	patterns := map[string]string{}
+	for _, p := range []struct{ name, pattern string }{
+		{"patternLatestOffset", config.PatternLatestOffset},
+		{"patternConsumerGroupOffset", config.PatternConsumerGroupOffset},
+		{"patternConsumerGroupDistance", config.PatternConsumerGroupDistance},
+		{"patternStats", config.PatternStats},
+		{"patternZabbixDiscovery", config.PatternZabbixDiscovery},
+		{"patternStatus", config.PatternStatus},
+		{"patternHealth", config.PatternHealth},
+		{"patternLogLevel", config.PatternLogLevel},
+	} {
+		if !strings.HasPrefix(p.pattern, "/") {
+			return fmt.Errorf("invalid %s %q: should start with /", p.name, p.pattern)
+		}
+		if other, ok := patterns[p.pattern]; ok {
+			return fmt.Errorf("%s and %s are both %q", other, p.name, p.pattern)
+		}
+		patterns[p.pattern] = p.name
+	}
+
+	return nil
+}
+
 func (this *HttpServer) Init() error {
-	http.HandleFunc(this.config.PatternLatestOffset, this.LatestOffsetHandler)
-	http.HandleFunc(this.config.PatternConsumerGroupOffset, this.ConsumerGroupOffsetHandler)
-	http.HandleFunc(this.config.PatternConsumerGroupDistance, this.ConsumerGroupDistanceHandler)
+	this.mux.HandleFunc(this.config.PatternLatestOffset, instrumentHandler("latest_offset", this.LatestOffsetHandler))
+	this.mux.HandleFunc(this.config.PatternConsumerGroupOffset, instrumentHandler("consumer_group_offset", this.ConsumerGroupOffsetHandler))
+	this.mux.HandleFunc(this.config.PatternConsumerGroupDistance, instrumentHandler("consumer_group_distance", this.ConsumerGroupDistanceHandler))
+	this.mux.HandleFunc(this.config.PatternStats, instrumentHandler("stats", this.StatsHandler))
+	this.mux.HandleFunc(this.config.PatternZabbixDiscovery, instrumentHandler("zabbix_discovery", this.ZabbixDiscoveryHandler))
+	this.mux.HandleFunc(this.config.PatternStatus, instrumentHandler("status", this.StatusHandler))
+	this.mux.HandleFunc(this.config.PatternHealth, instrumentHandler("health", this.HealthHandler))
+	if this.config.AdminListenAddr != "" {
+		this.adminMux.HandleFunc(this.config.PatternLogLevel, instrumentHandler("log_level", this.LogLevelHandler))
+	} else {
+		this.mux.HandleFunc(this.config.PatternLogLevel, instrumentHandler("log_level", this.LogLevelHandler))
+	}
 
 	return nil
 }
 
+/* SetOutputs replaces the outputs served by the discovery handler */
+func (this *HttpServer) SetOutputs(outputs []Output) {
+	discoverers := []discoveryOutput{}
+	for _, output := range outputs {
+		if d, ok := output.(discoveryOutput); ok {
+			discoverers = append(discoverers, d)
+		}
+	}
+
+	this.discoverersLock.Lock()
+	this.discoverers = discoverers
+	this.discoverersLock.Unlock()
+}
+
+/* SetElection shows the leader on the status page, it is called before Init */
+func (this *HttpServer) SetElection(election *Election) {
+	this.election = election
+}
+
+/* SetSharding makes the api answer for every member, it is called before Init */
+func (this *HttpServer) SetSharding(sharding *Sharding) {
+	this.sharding = sharding
+}
+
+/* SetComponents shows the health of the workers and outputs on the status page, it is called before Init */
+func (this *HttpServer) SetComponents(components func() []*ComponentStatus) {
+	this.components = components
+}
+
 func (this *HttpServer) Start() error {
-	go func() {
-		http.ListenAndServe(this.config.ListenAddr, nil)
-	}()
+	listener, err := net.Listen("tcp", this.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	var adminListener net.Listener
+	if this.config.AdminListenAddr != "" {
+		adminListener, err = net.Listen("tcp", this.config.AdminListenAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	this.server = this.serve(listener, this.mux)
+	if adminListener != nil {
+		this.adminServer = this.serve(adminListener, this.adminMux)
+	}
 
+	this.logger.Infof("started")
 	return nil
 }
 
+func (this *HttpServer) serve(listener net.Listener, handler http.Handler) *http.Server {
+	server := &http.Server{Handler: handler}
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			this.logger.Errorf("stopped serving %s:%s", listener.Addr(), err.Error())
+		}
+	}()
+	return server
+}
+
 func (this *HttpServer) Close() error {
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), httpDrainTimeout)
+	defer cancel()
+	return this.Shutdown(ctx)
+}
+
+/*
+Shutdown stops accepting connections and waits for the requests in flight
+until ctx is done, the connections still busy then are closed. The
+workers of the api are closed last, once no request uses them.
+*/
+func (this *HttpServer) Shutdown(ctx context.Context) error {
+	var err error
+	for _, server := range []*http.Server{this.server, this.adminServer} {
+		if server == nil {
+			continue
+		}
+		if serr := server.Shutdown(ctx); serr != nil {
+			this.logger.Warnf("requests still running, closing their connections:%s", serr.Error())
+			server.Close()
+			err = serr
+		}
+	}
+
+	/* a worker still connecting is closed by getWorker once it is done */
+	this.workerLock.Lock()
+	this.workersClosed = true
+	for zookeeper, entry := range this.workerRegistry {
+		select {
+		case <-entry.done:
+			entry.worker.Close()
+		default:
+		}
+		delete(this.workerRegistry, zookeeper)
+	}
+	this.workerLock.Unlock()
+
+	return err
 }
 
-func (this *HttpServer) getWorker(zookeeper string) (*Worker, error) {
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (this *statusRecorder) WriteHeader(status int) {
+	this.status = status
+	this.ResponseWriter.WriteHeader(status)
+}
 
-	if v, ok := this.workerRegistry[zookeeper]; ok {
-		return v, nil
+func instrumentHandler(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: res, status: 200}
+		handler(rec, req)
+		metrics.MeasureSince([]string{"http", name, "latency"}, start)
+		metrics.IncrCounter([]string{"http", name, "status", strconv.Itoa(rec.status)}, 1)
 	}
+}
 
-	log.Printf("[HttpServer]zookeeper handler for :%s not found , will create", zookeeper)
+/* a worker of the api, worker or err are set once done is closed */
+type httpWorker struct {
+	done   chan struct{}
+	worker *Worker
+	err    error
+}
 
+/*
+getWorker returns the worker of a cluster, connecting it on first use.
+The lock only guards the registry: a cluster being connected makes the
+requests for it wait, not the requests for other clusters.
+*/
+func (this *HttpServer) getWorker(ctx context.Context, zookeeper string) (*Worker, error) {
 	if zookeeper == "" {
-		zookeeper = "localhost:2181"
+		zookeeper = defaultHttpZookeeper
+	}
+
+	this.workerLock.Lock()
+	if this.workersClosed {
+		this.workerLock.Unlock()
+		return nil, errors.New("http server is shutting down")
+	}
+	entry, ok := this.workerRegistry[zookeeper]
+	if !ok {
+		entry = &httpWorker{done: make(chan struct{})}
+		this.workerRegistry[zookeeper] = entry
 	}
+	this.workerLock.Unlock()
+
+	if ok {
+		select {
+		case <-entry.done:
+			return entry.worker, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	this.logger.With("zookeeper", zookeeper).Infof("no worker yet, creating one")
+
 	worker := NewWorker(zookeeper)
 	err := worker.Init()
+
+	this.workerLock.Lock()
+	if err == nil && this.workersClosed {
+		worker.Close()
+		err = errors.New("http server is shutting down")
+	}
 	if err != nil {
-		worker = nil
+		/* the requests waiting get the error, the next one tries again */
+		if this.workerRegistry[zookeeper] == entry {
+			delete(this.workerRegistry, zookeeper)
+		}
+		entry.err = err
 	} else {
-		this.workerRegistry[zookeeper] = worker
+		entry.worker = worker
+	}
+	close(entry.done)
+	this.workerLock.Unlock()
+
+	return entry.worker, entry.err
+}
+
+/*
+forward answers a request for data owned by another member: it is proxied
+to the owner of the cluster, or with consumer groups sharded by group the
+groups of every member are merged. It returns false if this instance
+answers the request itself.
+*/
+func (this *HttpServer) forward(res http.ResponseWriter, req *http.Request, zookeeper string, groups bool) bool {
+	if this.sharding == nil || req.Header.Get(shardHeader) != "" {
+		return false
+	}
+
+	if groups && this.sharding.GroupsSharded() {
+		this.fanOut(res, req)
+		return true
+	}
+
+	owner := this.sharding.Owner(zookeeper)
+	if owner == nil {
+		res.WriteHeader(503)
+		res.Write([]byte("no sharding member available"))
+		return true
+	}
+	if this.sharding.IsSelf(owner) {
+		return false
+	}
+	if owner.Addr == "" {
+		res.WriteHeader(502)
+		res.Write([]byte(fmt.Sprintf("owner %s has no http server", owner.Id)))
+		return true
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = owner.Addr
+			r.Header.Set(shardHeader, "owner")
+		},
+	}
+	metrics.IncrCounter([]string{"http", "proxied"}, 1)
+	proxy.ServeHTTP(res, req)
+	return true
+}
+
+/* fanOut asks every member for its own consumer groups and merges the answers */
+func (this *HttpServer) fanOut(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	query.Del("callback")
+
+	type answer struct {
+		member *ShardMember
+		groups map[string]json.RawMessage
+		err    error
+	}
+	members := this.sharding.Members()
+	answers := make(chan answer, len(members))
+	client := &http.Client{Timeout: shardRequestTimeout}
+
+	for _, member := range members {
+		go func(member *ShardMember) {
+			a := answer{member: member}
+			defer func() { answers <- a }()
+
+			if member.Addr == "" {
+				a.err = errors.New("no http server")
+				return
+			}
+			r, err := http.NewRequest("GET", "http://"+member.Addr+req.URL.Path+"?"+query.Encode(), nil)
+			if err != nil {
+				a.err = err
+				return
+			}
+			r.Header.Set(shardHeader, "local")
+			resp, err := client.Do(r)
+			if err != nil {
+				a.err = err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				a.err = err
+				return
+			}
+			if resp.StatusCode != 200 {
+				a.err = fmt.Errorf("%s: %s", resp.Status, body)
+				return
+			}
+			a.err = json.Unmarshal(body, &a.groups)
+		}(member)
+	}
+
+	merged := map[string]json.RawMessage{}
+	errs := []string{}
+	for range members {
+		a := <-answers
+		if a.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", a.member.Id, a.err.Error()))
+			continue
+		}
+		for group, data := range a.groups {
+			merged[group] = data
+		}
+	}
+	metrics.IncrCounter([]string{"http", "fanned_out"}, 1)
+
+	if len(members) == 0 {
+		errs = append(errs, "no sharding member available")
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		res.WriteHeader(502)
+		res.Write([]byte(strings.Join(errs, "; ")))
+		return
+	}
+
+	reponseStr, err := json.Marshal(merged)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
 	}
 
-	return worker, err
+	if callback := req.Form.Get("callback"); callback != "" {
+		res.Write([]byte(callback))
+	}
+	res.Write(reponseStr)
+}
+
+/* shardFilter limits a fanned out request to the consumer groups of this member */
+func (this *HttpServer) shardFilter(req *http.Request, zookeeper string) func(group string) bool {
+	if this.sharding == nil || req.Header.Get(shardHeader) != "local" {
+		return nil
+	}
+	return func(group string) bool { return this.sharding.OwnsGroup(zookeeper, group) }
+}
+
+/* serveStale answers with the last known data while the breaker of the cluster is open */
+func (this *HttpServer) serveStale(res http.ResponseWriter, callback string, zookeeper string, kind string, err error) bool {
+	if !isClusterUnavailable(err) {
+		return false
+	}
+	cached, ok := getCachedData(zookeeper, kind)
+	if !ok {
+		return false
+	}
+
+	reponseStr, err := json.Marshal(cached.data)
+	if err != nil {
+		return false
+	}
+
+	metrics.IncrCounter([]string{"http", "stale"}, 1)
+	res.Header().Set("Warning", `110 - "Response is Stale"`)
+	res.Header().Set(staleHeader, cached.time.Format(time.RFC3339))
+	if callback != "" {
+		res.Write([]byte(callback))
+	}
+	res.Write(reponseStr)
+	return true
 }
 
 func (this *HttpServer) LatestOffsetHandler(res http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 	zookeeper := req.Form.Get("zookeeper")
+	if zookeeper == "" {
+		zookeeper = defaultHttpZookeeper
+	}
 	callback := req.Form.Get("callback")
 
-	worker, err := this.getWorker(zookeeper)
+	if this.forward(res, req, zookeeper, false) {
+		return
+	}
+
+	worker, err := this.getWorker(req.Context(), zookeeper)
 
 	if err != nil {
-		res.Write([]byte(err.Error()))
+		if this.serveStale(res, callback, zookeeper, kindLatestOffset, err) {
+			return
+		}
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
 
-	latestOffset, err := worker.GetLatestOffset()
+	latestOffset, err := worker.GetLatestOffsetContext(req.Context())
 	if err != nil {
-		res.Write([]byte(err.Error()))
+		if this.serveStale(res, callback, zookeeper, kindLatestOffset, err) {
+			return
+		}
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
+	cacheData(zookeeper, kindLatestOffset, latestOffset, time.Now())
 
 	reponseStr, err := json.Marshal(latestOffset)
 	if err != nil {
-		res.Write([]byte(err.Error()))
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
 
@@ -120,27 +590,44 @@ func (this *HttpServer) LatestOffsetHandler(res http.ResponseWriter, req *http.R
 func (this *HttpServer) ConsumerGroupOffsetHandler(res http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 	zookeeper := req.Form.Get("zookeeper")
+	if zookeeper == "" {
+		zookeeper = defaultHttpZookeeper
+	}
 	callback := req.Form.Get("callback")
 
-	worker, err := this.getWorker(zookeeper)
+	if this.forward(res, req, zookeeper, true) {
+		return
+	}
+
+	worker, err := this.getWorker(req.Context(), zookeeper)
 
 	if err != nil {
-		res.Write([]byte(err.Error()))
+		if this.serveStale(res, callback, zookeeper, kindConsumerGroupOffset, err) {
+			return
+		}
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
 
-	latestOffset, err := worker.GetConsumerGroupsOffset()
+	filter := this.shardFilter(req, zookeeper)
+	latestOffset, err := worker.GetConsumerGroupsOffsetContext(req.Context(), filter)
 	if err != nil {
-		res.Write([]byte(err.Error()))
+		if this.serveStale(res, callback, zookeeper, kindConsumerGroupOffset, err) {
+			return
+		}
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
+	if filter == nil {
+		cacheData(zookeeper, kindConsumerGroupOffset, latestOffset, time.Now())
+	}
 
 	reponseStr, err := json.Marshal(latestOffset)
 	if err != nil {
-		res.Write([]byte(err.Error()))
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
 
@@ -153,27 +640,139 @@ func (this *HttpServer) ConsumerGroupOffsetHandler(res http.ResponseWriter, req
 func (this *HttpServer) ConsumerGroupDistanceHandler(res http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 	zookeeper := req.Form.Get("zookeeper")
+	if zookeeper == "" {
+		zookeeper = defaultHttpZookeeper
+	}
 	callback := req.Form.Get("callback")
 
-	worker, err := this.getWorker(zookeeper)
+	if this.forward(res, req, zookeeper, true) {
+		return
+	}
+
+	worker, err := this.getWorker(req.Context(), zookeeper)
 
 	if err != nil {
+		if this.serveStale(res, callback, zookeeper, kindConsumerGroupDistance, err) {
+			return
+		}
+		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
+		return
+	}
+
+	filter := this.shardFilter(req, zookeeper)
+	latestOffset, err := worker.GetConsumerGroupsOffsetDistanceContext(req.Context(), filter)
+	if err != nil {
+		if this.serveStale(res, callback, zookeeper, kindConsumerGroupDistance, err) {
+			return
+		}
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
+	if filter == nil {
+		cacheData(zookeeper, kindConsumerGroupDistance, latestOffset, time.Now())
+	}
 
-	latestOffset, err := worker.GetConsumerGroupsOffsetDistance()
+	reponseStr, err := json.Marshal(latestOffset)
 	if err != nil {
+		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
+		return
+	}
+
+	if callback != "" {
+		res.Write([]byte(callback))
+	}
+	res.Write(reponseStr)
+}
+
+func (this *HttpServer) StatsHandler(res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	callback := req.Form.Get("callback")
+
+	reponseStr, err := json.Marshal(GetInternalMetrics())
+	if err != nil {
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
 
-	reponseStr, err := json.Marshal(latestOffset)
+	if callback != "" {
+		res.Write([]byte(callback))
+	}
+	res.Write(reponseStr)
+}
+
+func (this *HttpServer) ZabbixDiscoveryHandler(res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	kind := req.Form.Get("type")
+	cluster := req.Form.Get("cluster")
+	callback := req.Form.Get("callback")
+
+	this.discoverersLock.RLock()
+	discoverers := this.discoverers
+	this.discoverersLock.RUnlock()
+
+	rows := []map[string]string{}
+	for _, d := range discoverers {
+		outputRows, err := d.Discovery(kind)
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		for _, row := range outputRows {
+			if cluster != "" && cluster != row["{#CLUSTER}"] {
+				continue
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	reponseStr, err := json.Marshal(map[string]interface{}{"data": rows})
 	if err != nil {
+		res.WriteHeader(500)
 		res.Write([]byte(err.Error()))
+		return
+	}
+
+	if callback != "" {
+		res.Write([]byte(callback))
+	}
+	res.Write(reponseStr)
+}
+
+/* without an election every instance runs its outputs, so it reports itself as the leader */
+func (this *HttpServer) StatusHandler(res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	callback := req.Form.Get("callback")
+
+	status := struct {
+		*ElectionStatus
+		Sharding   *ShardingStatus    `json:"sharding,omitempty"`
+		State      string             `json:"state"`
+		Components []*ComponentStatus `json:"components"`
+	}{}
+	if this.election != nil {
+		status.ElectionStatus = this.election.Status()
+	} else {
+		hostname, _ := os.Hostname()
+		id := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		if this.sharding != nil {
+			id = this.sharding.config.Id
+		}
+		status.ElectionStatus = &ElectionStatus{Id: id, IsLeader: true, Leader: id, Members: []string{id}}
+	}
+	if this.sharding != nil {
+		status.Sharding = this.sharding.Status()
+	}
+	status.State, status.Components = this.health()
+
+	reponseStr, err := json.Marshal(status)
+	if err != nil {
 		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
 		return
 	}
 
@@ -182,3 +781,101 @@ func (this *HttpServer) ConsumerGroupDistanceHandler(res http.ResponseWriter, re
 	}
 	res.Write(reponseStr)
 }
+
+/* health returns ok or degraded and the components it is derived from */
+func (this *HttpServer) health() (string, []*ComponentStatus) {
+	components := []*ComponentStatus{}
+	if this.components != nil {
+		components = this.components()
+	}
+
+	state := "ok"
+	for _, component := range components {
+		if component.State != "ok" {
+			state = "degraded"
+		}
+	}
+	return state, components
+}
+
+/* answers 503 while a component is degraded, for load balancers and supervisors */
+func (this *HttpServer) HealthHandler(res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	callback := req.Form.Get("callback")
+
+	state, components := this.health()
+	reponseStr, err := json.Marshal(map[string]interface{}{"state": state, "components": components})
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	if state != "ok" {
+		res.WriteHeader(503)
+	}
+	if callback != "" {
+		res.Write([]byte(callback))
+	}
+	res.Write(reponseStr)
+}
+
+/*
+LogLevelHandler shows the log levels, a POST or PUT sets the level of a
+component, or the default level without one. An empty level removes the
+level of the component, which then logs at the default level again.
+Changing a level needs the admin listener or the admin token, and is
+never done for a jsonp callback.
+*/
+func (this *HttpServer) LogLevelHandler(res http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	callback := req.Form.Get("callback")
+
+	if req.Method == "POST" || req.Method == "PUT" {
+		if status, err := this.authorizeAdmin(req); err != nil {
+			res.WriteHeader(status)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		component := req.Form.Get("component")
+		level := req.Form.Get("level")
+		err := setLogLevel(component, level)
+		if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		this.logger.Infof("log level of %q set to %q from %s", component, level, req.RemoteAddr)
+	}
+
+	reponseStr, err := json.Marshal(getLogLevels())
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	if callback != "" {
+		res.Write([]byte(callback))
+	}
+	res.Write(reponseStr)
+}
+
+/* authorizeAdmin checks a request changing the state of the server, it returns the status to refuse it with */
+func (this *HttpServer) authorizeAdmin(req *http.Request) (int, error) {
+	if req.Form.Get("callback") != "" {
+		return 400, errors.New("jsonp callbacks are read only")
+	}
+	if this.config.AdminToken != "" {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(this.config.AdminToken)) != 1 {
+			return 401, errors.New("invalid admin token")
+		}
+		return 0, nil
+	}
+	if this.config.AdminListenAddr == "" {
+		return 403, errors.New("changes need adminListenAddr or adminToken")
+	}
+	return 0, nil
+}
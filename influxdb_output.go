@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/influxdb/influxdb/client"
+)
+
+func init() {
+	RegisterOutput("influxdb", "5s", func() OutputOptions { return &InfluxdbOutputConfig{} })
+}
+
+type InfluxdbOutputConfig struct {
+	InfluxdbMode                             string `json:"influxdbMode"`
+	InfluxdbHost                             string `json:"influxdbHost"`
+	InfluxdbUdpAddr                          string `json:"influxdbUdpAddr"`
+	InfluxdbUdpMtu                           int    `json:"influxdbUdpMtu"`
+	InfluxdbPrecision                        string `json:"influxdbPrecision"`
+	InfluxdbConsistency                      string `json:"influxdbConsistency"`
+	InfluxdbGzip                             bool   `json:"influxdbGzip"`
+	InfluxdbTimeout                          string `json:"influxdbTimeout"`
+	InfluxdbUser                             string `json:"influxdbUser"`
+	InfluxdbPassword                         string `json:"influxdbPassword"`
+	InfluxdbDb                               string `json:"influxdbDb"`
+	InfluxdbRetentionPolicy                  string `json:"influxdbRetentionPolicy"`
+	InfluxdbMeasurementLatestOffset          string `json:"influxdbMeasurementLatestOffset"`
+	InfluxdbMeasurementConsumerGroupOffset   string `json:"influxdbMeasurementConsumerGroupOffset"`
+	InfluxdbMeasurementConsumerGroupDistance string `json:"influxdbMeasurementConsumerGroupDistance"`
+	InfluxdbMeasurementInternal              string `json:"influxdbMeasurementInternal"`
+	InfluxdbInternalMetrics                  bool   `json:"influxdbInternalMetrics"`
+
+	Labels    map[string]string     `json:"labels"`
+	Templates MetricTemplatesConfig `json:"templates"`
+}
+
+func (this *InfluxdbOutputConfig) Validate() error {
+	switch this.InfluxdbMode {
+	case "", "client", "udp", "http":
+	default:
+		return fmt.Errorf("unknown influxdbMode %s, should be client, udp or http", this.InfluxdbMode)
+	}
+	if _, ok := influxdbPrecisions[this.InfluxdbPrecision]; this.InfluxdbPrecision != "" && !ok {
+		return fmt.Errorf("unknown influxdbPrecision %s", this.InfluxdbPrecision)
+	}
+	switch this.InfluxdbConsistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		return fmt.Errorf("unknown influxdbConsistency %s, should be any, one, quorum or all", this.InfluxdbConsistency)
+	}
+	if this.InfluxdbUdpMtu < 0 {
+		return fmt.Errorf("invalid influxdbUdpMtu %d", this.InfluxdbUdpMtu)
+	}
+	err := validateUrl("influxdbHost", this.InfluxdbHost)
+	if err != nil {
+		return err
+	}
+	err = validateAddr("influxdbUdpAddr", this.InfluxdbUdpAddr)
+	if err != nil {
+		return err
+	}
+	err = validateDuration("influxdbTimeout", this.InfluxdbTimeout)
+	if err != nil {
+		return err
+	}
+	templates, err := NewMetricTemplates(&this.Templates)
+	if err != nil {
+		return err
+	}
+	return templates.Validate("cluster", this.Labels)
+}
+
+func (this *InfluxdbOutputConfig) NewOutput() Output {
+	return NewInfluxdbOutput(this)
+}
+
+type InfluxdbOutput struct {
+	config    *InfluxdbOutputConfig
+	writer    influxdbWriter
+	templates *MetricTemplates
+
+	lastInternalInterval time.Time
+}
+
+func NewInfluxdbOutput(config *InfluxdbOutputConfig) *InfluxdbOutput {
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	if config.InfluxdbMode == "" {
+		config.InfluxdbMode = "client"
+	}
+	if config.InfluxdbHost == "" {
+		config.InfluxdbHost = "http://127.0.0.1:8086"
+	}
+	if config.InfluxdbUdpAddr == "" {
+		config.InfluxdbUdpAddr = "127.0.0.1:8089"
+	}
+	if config.InfluxdbUdpMtu == 0 {
+		config.InfluxdbUdpMtu = 1432
+	}
+	if config.InfluxdbPrecision == "" {
+		config.InfluxdbPrecision = "s"
+	}
+	if config.InfluxdbTimeout == "" {
+		config.InfluxdbTimeout = "10s"
+	}
+	if config.InfluxdbUser == "" {
+		config.InfluxdbUser = "root"
+	}
+	if config.InfluxdbPassword == "" {
+		config.InfluxdbPassword = "root"
+	}
+	if config.InfluxdbDb == "" {
+		config.InfluxdbDb = "kafka_monitor"
+	}
+	/* the 0.9 client names the policy, http leaves rp out for the database default */
+	if config.InfluxdbRetentionPolicy == "" && config.InfluxdbMode == "client" {
+		config.InfluxdbRetentionPolicy = "default"
+	}
+	if config.InfluxdbMeasurementConsumerGroupOffset == "" {
+		config.InfluxdbMeasurementConsumerGroupOffset = "consumer_group_offset"
+	}
+	if config.InfluxdbMeasurementConsumerGroupDistance == "" {
+		config.InfluxdbMeasurementConsumerGroupDistance = "consumer_group_distance"
+	}
+	if config.InfluxdbMeasurementLatestOffset == "" {
+		config.InfluxdbMeasurementLatestOffset = "latest_offset"
+	}
+	if config.InfluxdbMeasurementInternal == "" {
+		config.InfluxdbMeasurementInternal = "kafka_offset_mon_internal"
+	}
+
+	s := &InfluxdbOutput{config: config}
+	return s
+}
+
+func (this *InfluxdbOutput) Init() error {
+
+	/* init templates */
+	templates, err := NewMetricTemplates(&this.config.Templates)
+	if err != nil {
+		return err
+	}
+	this.templates = templates
+
+	/* init influxdb */
+	writer, err := newInfluxdbWriter(this.config)
+	if err != nil {
+		return err
+	}
+
+	this.writer = writer
+
+	return nil
+}
+
+func (this *InfluxdbOutput) Write(snapshot *Snapshot) error {
+	if this.writer == nil {
+		return errors.New("not init")
+	}
+
+	var lastErr error
+	for _, write := range []func(*Snapshot) error{
+		this.writeLatestOffset,
+		this.writeConsumerGroupOffset,
+		this.writeConsumerGroupDistance,
+	} {
+		err := write(snapshot)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if this.config.InfluxdbInternalMetrics {
+		err := this.writeInternalMetrics()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (this *InfluxdbOutput) write(pts []client.Point, retentionPolicy string) error {
+	err := this.writer.Write(pts, retentionPolicy)
+	if err == nil {
+		metrics.IncrCounter([]string{"output", "influxdb", "points"}, float32(len(pts)))
+	}
+	return err
+}
+
+func (this *InfluxdbOutput) newMetricContext(snapshot *Snapshot, measurement string) *MetricContext {
+	return &MetricContext{
+		Cluster:     snapshot.Cluster,
+		Measurement: measurement,
+		Labels:      this.config.Labels,
+	}
+}
+
+func (this *InfluxdbOutput) newPoint(tpl *MetricTemplate, ctx *MetricContext, value int64, ts time.Time) (client.Point, error) {
+	m, err := tpl.Render(ctx)
+	if err != nil {
+		return client.Point{}, err
+	}
+
+	fields := map[string]interface{}{}
+	for k, v := range m.Fields {
+		fields[k] = v
+	}
+	fields[m.ValueField] = value
+
+	return client.Point{
+		Measurement: m.Measurement,
+		Tags:        m.Tags,
+		Fields:      fields,
+		Time:        ts,
+		Precision:   "s",
+	}, nil
+}
+
+func (this *InfluxdbOutput) writeLatestOffset(snapshot *Snapshot) error {
+	if snapshot.SkipTopics {
+		return nil
+	}
+	offsets := snapshot.LatestOffset
+	pts := []client.Point{}
+
+	for topic, partitionItem := range offsets {
+		for partition, offset := range partitionItem {
+			ctx := this.newMetricContext(snapshot, this.config.InfluxdbMeasurementLatestOffset)
+			ctx.Topic = topic
+			ctx.Partition = partition
+			point, err := this.newPoint(this.templates.LatestOffset, ctx, offset, snapshot.Time)
+			if err != nil {
+				return err
+			}
+			pts = append(pts, point)
+		}
+	}
+	return this.write(pts, this.config.InfluxdbRetentionPolicy)
+}
+
+func (this *InfluxdbOutput) writeConsumerGroupOffset(snapshot *Snapshot) error {
+	offsets := snapshot.ConsumerGroupOffset
+	pts := []client.Point{}
+
+	for group, topicItem := range offsets {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				ctx := this.newMetricContext(snapshot, this.config.InfluxdbMeasurementConsumerGroupOffset)
+				ctx.Group = group
+				ctx.Topic = topic
+				ctx.Partition = partition
+				point, err := this.newPoint(this.templates.ConsumerGroupOffset, ctx, offset, snapshot.Time)
+				if err != nil {
+					return err
+				}
+				pts = append(pts, point)
+			}
+		}
+
+	}
+	return this.write(pts, this.config.InfluxdbRetentionPolicy)
+}
+
+func (this *InfluxdbOutput) writeConsumerGroupDistance(snapshot *Snapshot) error {
+	offsets := snapshot.ConsumerGroupDistance
+	pts := []client.Point{}
+
+	for group, topicItem := range offsets {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				ctx := this.newMetricContext(snapshot, this.config.InfluxdbMeasurementConsumerGroupDistance)
+				ctx.Group = group
+				ctx.Topic = topic
+				ctx.Partition = partition
+				point, err := this.newPoint(this.templates.ConsumerGroupDistance, ctx, offset, snapshot.Time)
+				if err != nil {
+					return err
+				}
+				pts = append(pts, point)
+			}
+		}
+
+	}
+	return this.write(pts, this.config.InfluxdbRetentionPolicy)
+}
+
+/* publishes each completed go-metrics interval once */
+func (this *InfluxdbOutput) writeInternalMetrics() error {
+	intv := GetLastCompletedInternalMetrics()
+	if intv == nil || !intv.Interval.After(this.lastInternalInterval) {
+		return nil
+	}
+
+	pts := []client.Point{}
+	for _, m := range intv.Metrics {
+		fields := map[string]interface{}{}
+		switch m.Type {
+		case "gauge":
+			fields["value"] = m.Value
+		case "counter":
+			fields["count"] = m.Count
+			fields["sum"] = m.Sum
+		case "sample":
+			fields["count"] = m.Count
+			fields["sum"] = m.Sum
+			fields["min"] = m.Min
+			fields["max"] = m.Max
+			fields["mean"] = m.Mean
+			fields["stddev"] = m.Stddev
+		}
+		pts = append(pts, client.Point{
+			Measurement: this.config.InfluxdbMeasurementInternal,
+			Tags: map[string]string{
+				"metric": m.Name,
+				"type":   m.Type,
+			},
+			Fields:    fields,
+			Time:      intv.Interval,
+			Precision: "s",
+		})
+	}
+
+	err := this.write(pts, this.config.InfluxdbRetentionPolicy)
+	if err != nil {
+		return err
+	}
+	this.lastInternalInterval = intv.Interval
+	return nil
+}
+
+func (this *InfluxdbOutput) Close() error {
+
+	if this.writer != nil {
+		return this.writer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdb/influxdb/client"
+)
+
+/*
+influxdbWriter is the transport used by InfluxdbOutput: the legacy 0.9
+client, raw line protocol over udp, or line protocol to the http /write
+endpoint of influxdb 1.x.
+*/
+type influxdbWriter interface {
+	Write(pts []client.Point, retentionPolicy string) error
+	Close() error
+}
+
+func newInfluxdbWriter(config *InfluxdbOutputConfig) (influxdbWriter, error) {
+	switch config.InfluxdbMode {
+	case "udp":
+		conn, err := net.Dial("udp", config.InfluxdbUdpAddr)
+		if err != nil {
+			return nil, err
+		}
+		return &influxdbUdpWriter{conn: conn, mtu: config.InfluxdbUdpMtu, precision: config.InfluxdbPrecision}, nil
+
+	case "http":
+		_, err := url.Parse(config.InfluxdbHost)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := time.ParseDuration(config.InfluxdbTimeout)
+		if err != nil {
+			timeout = time.Second * 10
+		}
+		return &influxdbHttpWriter{
+			config: config,
+			client: &http.Client{Timeout: timeout},
+		}, nil
+
+	default:
+		influxdbUrl, err := url.Parse(config.InfluxdbHost)
+		if err != nil {
+			return nil, err
+		}
+		con, err := client.NewClient(client.Config{
+			URL:       *influxdbUrl,
+			Username:  config.InfluxdbUser,
+			Password:  config.InfluxdbPassword,
+			UserAgent: "kafka-offset-mon",
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &influxdbClientWriter{client: con, db: config.InfluxdbDb}, nil
+	}
+}
+
+type influxdbClientWriter struct {
+	client *client.Client
+	db     string
+}
+
+func (this *influxdbClientWriter) Write(pts []client.Point, retentionPolicy string) error {
+	_, err := this.client.Write(client.BatchPoints{
+		Points:          pts,
+		Database:        this.db,
+		RetentionPolicy: retentionPolicy,
+	})
+	return err
+}
+
+func (this *influxdbClientWriter) Close() error {
+	return nil
+}
+
+/*
+fire-and-forget, lines are packed into datagrams of at most mtu bytes.
+database and retention policy are set by the udp listener on the server.
+*/
+type influxdbUdpWriter struct {
+	conn      net.Conn
+	mtu       int
+	precision string
+}
+
+func (this *influxdbUdpWriter) Write(pts []client.Point, retentionPolicy string) error {
+	var buf bytes.Buffer
+	var lastErr error
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		_, err := this.conn.Write(buf.Bytes())
+		if err != nil {
+			lastErr = err
+		}
+		buf.Reset()
+	}
+
+	for i := range pts {
+		line := encodeInfluxdbLine(&pts[i], this.precision)
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > this.mtu {
+			flush()
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	flush()
+
+	return lastErr
+}
+
+func (this *influxdbUdpWriter) Close() error {
+	return this.conn.Close()
+}
+
+type influxdbHttpWriter struct {
+	config *InfluxdbOutputConfig
+	client *http.Client
+}
+
+func (this *influxdbHttpWriter) Write(pts []client.Point, retentionPolicy string) error {
+	var body bytes.Buffer
+	var err error
+
+	if this.config.InfluxdbGzip {
+		zw := gzip.NewWriter(&body)
+		for i := range pts {
+			_, err = zw.Write([]byte(encodeInfluxdbLine(&pts[i], this.config.InfluxdbPrecision) + "\n"))
+			if err != nil {
+				return err
+			}
+		}
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+	} else {
+		for i := range pts {
+			body.WriteString(encodeInfluxdbLine(&pts[i], this.config.InfluxdbPrecision))
+			body.WriteByte('\n')
+		}
+	}
+
+	params := url.Values{}
+	params.Set("db", this.config.InfluxdbDb)
+	if retentionPolicy != "" {
+		params.Set("rp", retentionPolicy)
+	}
+	params.Set("precision", this.config.InfluxdbPrecision)
+	if this.config.InfluxdbConsistency != "" {
+		params.Set("consistency", this.config.InfluxdbConsistency)
+	}
+	u := strings.TrimRight(this.config.InfluxdbHost, "/") + "/write?" + params.Encode()
+
+	req, err := http.NewRequest("POST", u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "kafka-offset-mon")
+	if this.config.InfluxdbGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if this.config.InfluxdbUser != "" {
+		req.SetBasicAuth(this.config.InfluxdbUser, this.config.InfluxdbPassword)
+	}
+
+	res, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		content, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("influxdb write failed with status %d:%s", res.StatusCode, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+func (this *influxdbHttpWriter) Close() error {
+	return nil
+}
+
+var (
+	influxdbMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxdbKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxdbStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+var influxdbPrecisions = map[string]time.Duration{
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+/* measurement,tag=v field=1i,field="s" timestamp, tags and fields sorted by key */
+func encodeInfluxdbLine(p *client.Point, precision string) string {
+	var buf bytes.Buffer
+	buf.WriteString(influxdbMeasurementEscaper.Replace(p.Measurement))
+
+	tags := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+	for _, k := range tags {
+		if p.Tags[k] == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(influxdbKeyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(influxdbKeyEscaper.Replace(p.Tags[k]))
+	}
+
+	fields := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for i, k := range fields {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(influxdbKeyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(encodeInfluxdbFieldValue(p.Fields[k]))
+	}
+
+	if !p.Time.IsZero() {
+		unit, ok := influxdbPrecisions[precision]
+		if !ok {
+			unit = time.Nanosecond
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(p.Time.UnixNano()/int64(unit), 10))
+	}
+
+	return buf.String()
+}
+
+func encodeInfluxdbFieldValue(v interface{}) string {
+	switch value := v.(type) {
+	case int:
+		return strconv.FormatInt(int64(value), 10) + "i"
+	case int32:
+		return strconv.FormatInt(int64(value), 10) + "i"
+	case int64:
+		return strconv.FormatInt(value, 10) + "i"
+	case float32:
+		return strconv.FormatFloat(float64(value), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case string:
+		return `"` + influxdbStringEscaper.Replace(value) + `"`
+	default:
+		return `"` + influxdbStringEscaper.Replace(fmt.Sprint(value)) + `"`
+	}
+}
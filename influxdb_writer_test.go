@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/client"
+)
+
+func TestEncodeInfluxdbLine(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+	for _, c := range []struct {
+		name      string
+		point     client.Point
+		precision string
+		want      string
+	}{
+		{"integer and float fields", client.Point{
+			Measurement: "latest_offset",
+			Tags:        map[string]string{"topic": "orders", "partition": "0"},
+			Fields:      map[string]interface{}{"value": int64(12), "rate": 0.5},
+			Time:        at,
+		}, "s", "latest_offset,partition=0,topic=orders rate=0.5,value=12i 1700000000"},
+		{"escaping", client.Point{
+			Measurement: "lag, total",
+			Tags:        map[string]string{"group name": "a=b,c"},
+			Fields:      map[string]interface{}{"note": `say "hi" \o/`, "ok": true},
+			Time:        at,
+		}, "s", `lag\,\ total,group\ name=a\=b\,c note="say \"hi\" \\o/",ok=true 1700000000`},
+		{"empty tags are left out", client.Point{
+			Measurement: "m",
+			Tags:        map[string]string{"group": "", "topic": "t"},
+			Fields:      map[string]interface{}{"value": 1},
+		}, "s", "m,topic=t value=1i"},
+		{"milliseconds", client.Point{Measurement: "m", Fields: map[string]interface{}{"value": int32(1)}, Time: at}, "ms", "m value=1i 1700000000123"},
+		{"microseconds", client.Point{Measurement: "m", Fields: map[string]interface{}{"value": 1}, Time: at}, "u", "m value=1i 1700000000123456"},
+		{"minutes", client.Point{Measurement: "m", Fields: map[string]interface{}{"value": 1}, Time: at}, "m", "m value=1i 28333333"},
+		{"unknown precision is nanoseconds", client.Point{Measurement: "m", Fields: map[string]interface{}{"value": 1}, Time: at}, "", "m value=1i 1700000000123456789"},
+	} {
+		if got := encodeInfluxdbLine(&c.point, c.precision); got != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestInfluxdbHttpRetentionPolicy(t *testing.T) {
+	var query, body string
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+		res.WriteHeader(204)
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		name  string
+		rp    string
+		query string
+	}{
+		{"database default", "", "db=kafka_monitor&precision=s"},
+		{"configured", "week", "db=kafka_monitor&precision=s&rp=week"},
+	} {
+		output := NewInfluxdbOutput(&InfluxdbOutputConfig{InfluxdbMode: "http", InfluxdbHost: server.URL, InfluxdbRetentionPolicy: c.rp})
+		if err := output.Init(); err != nil {
+			t.Fatal(err)
+		}
+		err := output.writer.Write([]client.Point{{Measurement: "m", Fields: map[string]interface{}{"value": 1}}}, output.config.InfluxdbRetentionPolicy)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if query != c.query || body != "m value=1i\n" {
+			t.Errorf("%s: query %q body %q, want %q", c.name, query, body, c.query)
+		}
+	}
+
+	/* the 0.9 client keeps naming the policy it always used */
+	output := NewInfluxdbOutput(&InfluxdbOutputConfig{})
+	if output.config.InfluxdbRetentionPolicy != "default" {
+		t.Errorf("client retention policy %q", output.config.InfluxdbRetentionPolicy)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	internalMetricsService  = "kafka_offset_mon"
+	internalMetricsInterval = 10 * time.Second
+	internalMetricsRetain   = time.Minute
+)
+
+var internalMetricsSink = metrics.NewInmemSink(internalMetricsInterval, internalMetricsRetain)
+
+type InternalMetric struct {
+	Name   string  `json:"name"`
+	Type   string  `json:"type"`
+	Value  float64 `json:"value,omitempty"`
+	Count  int     `json:"count,omitempty"`
+	Sum    float64 `json:"sum,omitempty"`
+	Min    float64 `json:"min,omitempty"`
+	Max    float64 `json:"max,omitempty"`
+	Mean   float64 `json:"mean,omitempty"`
+	Stddev float64 `json:"stddev,omitempty"`
+}
+
+type InternalMetricsInterval struct {
+	Interval time.Time         `json:"interval"`
+	Metrics  []*InternalMetric `json:"metrics"`
+}
+
+func InitInternalMetrics() error {
+	conf := metrics.DefaultConfig(internalMetricsService)
+	conf.EnableHostname = false
+	_, err := metrics.NewGlobal(conf, internalMetricsSink)
+	return err
+}
+
+func measureCall(key []string, start time.Time, err error) {
+	metrics.MeasureSince(key, start)
+	if err != nil {
+		metrics.IncrCounter(append(key, "errors"), 1)
+	}
+}
+
+func newInternalMetricsInterval(intv *metrics.IntervalMetrics) *InternalMetricsInterval {
+	intv.RLock()
+	defer intv.RUnlock()
+
+	rtn := &InternalMetricsInterval{Interval: intv.Interval, Metrics: []*InternalMetric{}}
+
+	for k, v := range intv.Gauges {
+		rtn.Metrics = append(rtn.Metrics, &InternalMetric{Name: k, Type: "gauge", Value: float64(v)})
+	}
+	for k, v := range intv.Counters {
+		rtn.Metrics = append(rtn.Metrics, &InternalMetric{Name: k, Type: "counter", Count: v.Count, Sum: v.Sum})
+	}
+	for k, v := range intv.Samples {
+		rtn.Metrics = append(rtn.Metrics, &InternalMetric{
+			Name:   k,
+			Type:   "sample",
+			Count:  v.Count,
+			Sum:    v.Sum,
+			Min:    v.Min,
+			Max:    v.Max,
+			Mean:   v.Mean(),
+			Stddev: v.Stddev(),
+		})
+	}
+	sort.Sort(internalMetricsByName(rtn.Metrics))
+
+	return rtn
+}
+
+func GetInternalMetrics() []*InternalMetricsInterval {
+	rtn := []*InternalMetricsInterval{}
+	for _, intv := range internalMetricsSink.Data() {
+		rtn = append(rtn, newInternalMetricsInterval(intv))
+	}
+	return rtn
+}
+
+/*
+GetLastCompletedInternalMetrics returns the newest interval that is no
+longer being written to, or nil if there is none yet.
+*/
+func GetLastCompletedInternalMetrics() *InternalMetricsInterval {
+	data := internalMetricsSink.Data()
+	if len(data) < 2 {
+		return nil
+	}
+	return newInternalMetricsInterval(data[len(data)-2])
+}
+
+type internalMetricsByName []*InternalMetric
+
+func (this internalMetricsByName) Len() int           { return len(this) }
+func (this internalMetricsByName) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this internalMetricsByName) Less(i, j int) bool { return this[i].Name < this[j].Name }
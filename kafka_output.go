@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+func init() {
+	RegisterOutput("kafka", "5s", func() OutputOptions { return &KafkaOutputConfig{} })
+}
+
+type KafkaOutputConfig struct {
+	KafkaBrokers      []string `json:"kafkaBrokers"`
+	KafkaTopic        string   `json:"kafkaTopic"`
+	KafkaFormat       string   `json:"kafkaFormat"`
+	KafkaProducerMode string   `json:"kafkaProducerMode"`
+	KafkaRequiredAcks string   `json:"kafkaRequiredAcks"`
+}
+
+func (this *KafkaOutputConfig) Validate() error {
+	switch this.KafkaFormat {
+	case "", "json", "binary":
+	default:
+		return fmt.Errorf("unknown kafkaFormat %s, should be json or binary", this.KafkaFormat)
+	}
+	switch this.KafkaProducerMode {
+	case "", "sync", "async":
+	default:
+		return fmt.Errorf("unknown kafkaProducerMode %s, should be sync or async", this.KafkaProducerMode)
+	}
+	if _, ok := kafkaRequiredAcks[this.KafkaRequiredAcks]; !ok && this.KafkaRequiredAcks != "" {
+		return fmt.Errorf("unknown kafkaRequiredAcks %s, should be none, local or all", this.KafkaRequiredAcks)
+	}
+	for _, broker := range this.KafkaBrokers {
+		err := validateAddr("kafkaBrokers", broker)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *KafkaOutputConfig) NewOutput() Output {
+	return NewKafkaOutput(this)
+}
+
+var kafkaLog = NewLogger("output").With("syncer", "kafka")
+
+var kafkaRequiredAcks = map[string]sarama.RequiredAcks{
+	"none":  sarama.NoResponse,
+	"local": sarama.WaitForLocal,
+	"all":   sarama.WaitForAll,
+}
+
+type KafkaSnapshotPartition struct {
+	Partition             int32 `json:"partition"`
+	LatestOffset          int64 `json:"latest_offset"`
+	ConsumerGroupOffset   int64 `json:"consumer_group_offset"`
+	ConsumerGroupDistance int64 `json:"consumer_group_distance"`
+}
+
+/*
+KafkaSnapshotRecord is the state of one group on one topic at the end of a
+sync cycle. Totals are the sums over all partitions.
+*/
+type KafkaSnapshotRecord struct {
+	Cluster               string                    `json:"cluster"`
+	Group                 string                    `json:"group"`
+	Topic                 string                    `json:"topic"`
+	Timestamp             int64                     `json:"timestamp"`
+	LatestOffset          int64                     `json:"latest_offset"`
+	ConsumerGroupOffset   int64                     `json:"consumer_group_offset"`
+	ConsumerGroupDistance int64                     `json:"consumer_group_distance"`
+	Partitions            []*KafkaSnapshotPartition `json:"partitions"`
+}
+
+type KafkaOutput struct {
+	config        *KafkaOutputConfig
+	syncProducer  sarama.SyncProducer
+	asyncProducer sarama.AsyncProducer
+}
+
+func NewKafkaOutput(config *KafkaOutputConfig) *KafkaOutput {
+	if config.KafkaTopic == "" {
+		config.KafkaTopic = "kafka_offset_mon"
+	}
+	if config.KafkaFormat == "" {
+		config.KafkaFormat = "json"
+	}
+	if config.KafkaProducerMode == "" {
+		config.KafkaProducerMode = "sync"
+	}
+	if config.KafkaRequiredAcks == "" {
+		config.KafkaRequiredAcks = "local"
+	}
+
+	s := &KafkaOutput{config: config}
+	return s
+}
+
+func (this *KafkaOutput) Init() error {
+
+	/* without kafkaBrokers the producer is created on the monitored cluster by the first Write */
+	if len(this.config.KafkaBrokers) == 0 {
+		return nil
+	}
+	return this.initProducer(this.config.KafkaBrokers)
+}
+
+func (this *KafkaOutput) initProducer(brokerList []string) error {
+	producerConfig := sarama.NewConfig()
+	producerConfig.ClientID = "kafka-offset-mon"
+	producerConfig.Producer.RequiredAcks = kafkaRequiredAcks[this.config.KafkaRequiredAcks]
+	producerConfig.Producer.Partitioner = sarama.NewHashPartitioner
+
+	if this.config.KafkaProducerMode == "async" {
+		producer, err := sarama.NewAsyncProducer(brokerList, producerConfig)
+		if err != nil {
+			return err
+		}
+		this.asyncProducer = producer
+		go this.handleAsyncErrors(producer)
+	} else {
+		producer, err := sarama.NewSyncProducer(brokerList, producerConfig)
+		if err != nil {
+			return err
+		}
+		this.syncProducer = producer
+	}
+
+	return nil
+}
+
+func (this *KafkaOutput) Write(snapshot *Snapshot) error {
+	if this.syncProducer == nil && this.asyncProducer == nil {
+		err := this.initProducer(snapshot.Brokers)
+		if err != nil {
+			return err
+		}
+	}
+
+	records, err := this.collect(snapshot)
+	if err != nil {
+		return err
+	}
+	return this.write(records, snapshot.WriteDeadline())
+}
+
+func (this *KafkaOutput) handleAsyncErrors(producer sarama.AsyncProducer) {
+	for perr := range producer.Errors() {
+		metrics.IncrCounter([]string{"output", "kafka", "delivery_errors"}, 1)
+		kafkaLog.Errorf("delivery to %s failed:%s", perr.Msg.Topic, perr.Err.Error())
+	}
+}
+
+func (this *KafkaOutput) collect(snapshot *Snapshot) ([]*KafkaSnapshotRecord, error) {
+	latestOffset := snapshot.LatestOffset
+	groupOffset := snapshot.ConsumerGroupOffset
+	distance := snapshot.ConsumerGroupDistance
+
+	timestamp := snapshot.Time.UnixNano() / int64(time.Millisecond)
+	records := []*KafkaSnapshotRecord{}
+
+	for group, topicItem := range groupOffset {
+		for topic, partitionItem := range topicItem {
+			record := &KafkaSnapshotRecord{
+				Cluster:               snapshot.Cluster,
+				Group:                 group,
+				Topic:                 topic,
+				Timestamp:             timestamp,
+				LatestOffset:          latestOffset[topic]["total"],
+				ConsumerGroupOffset:   partitionItem["total"],
+				ConsumerGroupDistance: distance[group][topic]["total"],
+				Partitions:            []*KafkaSnapshotPartition{},
+			}
+			for partition, offset := range partitionItem {
+				if partition == "total" {
+					continue
+				}
+				id, err := strconv.ParseInt(partition, 10, 32)
+				if err != nil {
+					return nil, err
+				}
+				record.Partitions = append(record.Partitions, &KafkaSnapshotPartition{
+					Partition:             int32(id),
+					LatestOffset:          latestOffset[topic][partition],
+					ConsumerGroupOffset:   offset,
+					ConsumerGroupDistance: distance[group][topic][partition],
+				})
+			}
+			sort.Sort(kafkaSnapshotPartitionsById(record.Partitions))
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func (this *KafkaOutput) encode(record *KafkaSnapshotRecord) ([]byte, error) {
+	if this.config.KafkaFormat == "binary" {
+		return encodeKafkaSnapshotBinary(record), nil
+	}
+	return json.Marshal(record)
+}
+
+/*
+write hands the records to the producer, in async mode it gives up at
+deadline when the producer buffer stays full, with the brokers down, and
+drops the records left
+*/
+func (this *KafkaOutput) write(records []*KafkaSnapshotRecord, deadline time.Time) error {
+	var lastErr error
+	sent := 0
+	var timeout <-chan time.Time
+	if this.asyncProducer != nil {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for _, record := range records {
+		value, err := this.encode(record)
+		if err != nil {
+			return err
+		}
+		msg := &sarama.ProducerMessage{
+			Topic: this.config.KafkaTopic,
+			/* one key per group and topic, so log compaction keeps the latest state */
+			Key:   sarama.StringEncoder(record.Cluster + "/" + record.Group + "/" + record.Topic),
+			Value: sarama.ByteEncoder(value),
+		}
+
+		if this.asyncProducer != nil {
+			select {
+			case this.asyncProducer.Input() <- msg:
+				sent++
+				continue
+			case <-timeout:
+			}
+			dropped := len(records) - sent
+			metrics.IncrCounter([]string{"output", "kafka", "dropped"}, float32(dropped))
+			metrics.IncrCounter([]string{"output", "kafka", "points"}, float32(sent))
+			return fmt.Errorf("%d of %d records dropped, the producer is still full at the deadline", dropped, len(records))
+		}
+
+		_, _, err = this.syncProducer.SendMessage(msg)
+		if err != nil {
+			metrics.IncrCounter([]string{"output", "kafka", "delivery_errors"}, 1)
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	metrics.IncrCounter([]string{"output", "kafka", "points"}, float32(sent))
+	if lastErr != nil {
+		return fmt.Errorf("%d of %d records not delivered, last error:%s", len(records)-sent, len(records), lastErr.Error())
+	}
+	return nil
+}
+
+func (this *KafkaOutput) Close() error {
+
+	if this.syncProducer != nil {
+		this.syncProducer.Close()
+	}
+	if this.asyncProducer != nil {
+		this.asyncProducer.Close()
+	}
+
+	return nil
+}
+
+/*
+encodeKafkaSnapshotBinary writes the compact big-endian layout:
+
+	uint8  version (1)
+	int64  timestamp in milliseconds
+	uint16 length + bytes, for cluster, group and topic
+	int64  latest_offset, consumer_group_offset, consumer_group_distance totals
+	uint32 partition count, then per partition:
+	       int32 partition, int64 latest_offset, consumer_group_offset, consumer_group_distance
+*/
+func encodeKafkaSnapshotBinary(record *KafkaSnapshotRecord) []byte {
+	var buf bytes.Buffer
+
+	writeString := func(s string) {
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	buf.WriteByte(1)
+	binary.Write(&buf, binary.BigEndian, record.Timestamp)
+	writeString(record.Cluster)
+	writeString(record.Group)
+	writeString(record.Topic)
+	binary.Write(&buf, binary.BigEndian, record.LatestOffset)
+	binary.Write(&buf, binary.BigEndian, record.ConsumerGroupOffset)
+	binary.Write(&buf, binary.BigEndian, record.ConsumerGroupDistance)
+	binary.Write(&buf, binary.BigEndian, uint32(len(record.Partitions)))
+	for _, p := range record.Partitions {
+		binary.Write(&buf, binary.BigEndian, p.Partition)
+		binary.Write(&buf, binary.BigEndian, p.LatestOffset)
+		binary.Write(&buf, binary.BigEndian, p.ConsumerGroupOffset)
+		binary.Write(&buf, binary.BigEndian, p.ConsumerGroupDistance)
+	}
+
+	return buf.Bytes()
+}
+
+type kafkaSnapshotPartitionsById []*KafkaSnapshotPartition
+
+func (this kafkaSnapshotPartitionsById) Len() int      { return len(this) }
+func (this kafkaSnapshotPartitionsById) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this kafkaSnapshotPartitionsById) Less(i, j int) bool {
+	return this[i].Partition < this[j].Partition
+}
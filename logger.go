@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (this LogLevel) String() string {
+	if this < LogDebug || this > LogError {
+		return strconv.Itoa(int(this))
+	}
+	return logLevelNames[this]
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LogInfo, fmt.Errorf("unknown level %q, should be debug, info, warn or error", s)
+}
+
+/*
+LogConfig sets the format of the log, text or json, and its level. Levels
+overrides the level per component, one of logComponents.
+*/
+type LogConfig struct {
+	Format string            `json:"format"`
+	Level  string            `json:"level"`
+	Levels map[string]string `json:"levels"`
+}
+
+func (this *LogConfig) Validate() error {
+	switch this.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown format %s, should be text or json", this.Format)
+	}
+	if this.Level != "" {
+		if _, err := parseLogLevel(this.Level); err != nil {
+			return err
+		}
+	}
+	components := make([]string, 0, len(this.Levels))
+	for component := range this.Levels {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	for _, component := range components {
+		if !isLogComponent(component) {
+			return fmt.Errorf("levels: unknown component %q", component)
+		}
+		if _, err := parseLogLevel(this.Levels[component]); err != nil {
+			return fmt.Errorf("levels.%s: %s", component, err.Error())
+		}
+	}
+	return nil
+}
+
+/* log is for the third party libraries logging through the standard logger */
+var logComponents = []string{"scheduler", "output", "http", "server_manager", "election", "sharding", "systemd", "main", "sarama", "log"}
+
+func isLogComponent(component string) bool {
+	for _, c := range logComponents {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+/* the state shared by every Logger */
+var logging = struct {
+	sync.RWMutex
+	out        io.Writer
+	json       bool
+	level      LogLevel
+	levels     map[string]LogLevel
+	components map[string]bool
+}{
+	out:        os.Stderr,
+	level:      LogInfo,
+	levels:     map[string]LogLevel{},
+	components: map[string]bool{},
+}
+
+/* setLogConfig replaces the format and every level, config must be valid */
+func setLogConfig(config *LogConfig) {
+	level := LogInfo
+	if config.Level != "" {
+		level, _ = parseLogLevel(config.Level)
+	}
+	levels := map[string]LogLevel{}
+	for component, name := range config.Levels {
+		levels[component], _ = parseLogLevel(name)
+	}
+
+	logging.Lock()
+	logging.json = config.Format == "json"
+	logging.level = level
+	logging.levels = levels
+	logging.Unlock()
+}
+
+/* setLogLevel changes the level of a component at runtime, of the default level without one */
+func setLogLevel(component string, name string) error {
+	logging.Lock()
+	defer logging.Unlock()
+
+	if component != "" && !isLogComponent(component) && !logging.components[component] {
+		return fmt.Errorf("unknown component %q", component)
+	}
+	if component != "" && name == "" {
+		delete(logging.levels, component)
+		return nil
+	}
+	level, err := parseLogLevel(name)
+	if err != nil {
+		return err
+	}
+	if component == "" {
+		logging.level = level
+	} else {
+		logging.levels[component] = level
+	}
+	return nil
+}
+
+type LogLevels struct {
+	Level      string            `json:"level"`
+	Levels     map[string]string `json:"levels"`
+	Components []string          `json:"components"`
+}
+
+func getLogLevels() *LogLevels {
+	logging.RLock()
+	defer logging.RUnlock()
+
+	levels := &LogLevels{Level: logging.level.String(), Levels: map[string]string{}, Components: []string{}}
+	for component, level := range logging.levels {
+		levels.Levels[component] = level.String()
+	}
+	levels.Components = append(levels.Components, logComponents...)
+	for component := range logging.components {
+		if !isLogComponent(component) {
+			levels.Components = append(levels.Components, component)
+		}
+	}
+	sort.Strings(levels.Components)
+	return levels
+}
+
+/*
+Logger writes leveled messages of a component with fields, like the
+cluster or the output ("syncer") they are about. Loggers are cheap and
+safe for concurrent use, With returns a copy with one more field.
+*/
+type Logger struct {
+	component string
+	fields    []string
+}
+
+func NewLogger(component string) *Logger {
+	logging.Lock()
+	logging.components[component] = true
+	logging.Unlock()
+
+	return &Logger{component: component}
+}
+
+func (this *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]string, len(this.fields), len(this.fields)+2)
+	copy(fields, this.fields)
+	return &Logger{component: this.component, fields: append(fields, key, fmt.Sprint(value))}
+}
+
+func (this *Logger) Enabled(level LogLevel) bool {
+	logging.RLock()
+	defer logging.RUnlock()
+
+	min, ok := logging.levels[this.component]
+	if !ok {
+		min = logging.level
+	}
+	return level >= min
+}
+
+func (this *Logger) Debugf(format string, args ...interface{}) { this.logf(LogDebug, format, args...) }
+func (this *Logger) Infof(format string, args ...interface{})  { this.logf(LogInfo, format, args...) }
+func (this *Logger) Warnf(format string, args ...interface{})  { this.logf(LogWarn, format, args...) }
+func (this *Logger) Errorf(format string, args ...interface{}) { this.logf(LogError, format, args...) }
+
+/* Fatalf logs regardless of the level and exits */
+func (this *Logger) Fatalf(format string, args ...interface{}) {
+	this.write(LogError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (this *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if !this.Enabled(level) {
+		return
+	}
+	this.write(level, fmt.Sprintf(format, args...))
+}
+
+func (this *Logger) write(level LogLevel, msg string) {
+	now := time.Now()
+
+	logging.RLock()
+	asJson := logging.json
+	logging.RUnlock()
+
+	var buf bytes.Buffer
+	if asJson {
+		buf.WriteString(`{"time":`)
+		writeJsonString(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJsonString(&buf, level.String())
+		buf.WriteString(`,"component":`)
+		writeJsonString(&buf, this.component)
+		buf.WriteString(`,"msg":`)
+		writeJsonString(&buf, msg)
+		for i := 0; i+1 < len(this.fields); i += 2 {
+			buf.WriteByte(',')
+			writeJsonString(&buf, this.fields[i])
+			buf.WriteByte(':')
+			writeJsonString(&buf, this.fields[i+1])
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s [%s] %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), this.component, msg)
+		for i := 0; i+1 < len(this.fields); i += 2 {
+			value := this.fields[i+1]
+			if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&buf, " %s=%s", this.fields[i], value)
+		}
+		buf.WriteByte('\n')
+	}
+
+	logging.Lock()
+	logging.out.Write(buf.Bytes())
+	logging.Unlock()
+}
+
+func writeJsonString(buf *bytes.Buffer, s string) {
+	data, _ := json.Marshal(s)
+	buf.Write(data)
+}
+
+/* stdLogger adapts a Logger to the Print functions of sarama.StdLogger */
+type stdLogger struct {
+	logger *Logger
+	level  LogLevel
+}
+
+func (this *stdLogger) Print(v ...interface{}) {
+	this.logger.logf(this.level, "%s", strings.TrimRight(fmt.Sprint(v...), "\n"))
+}
+
+func (this *stdLogger) Printf(format string, v ...interface{}) {
+	this.logger.logf(this.level, "%s", strings.TrimRight(fmt.Sprintf(format, v...), "\n"))
+}
+
+func (this *stdLogger) Println(v ...interface{}) {
+	this.logger.logf(this.level, "%s", strings.TrimRight(fmt.Sprintln(v...), "\n"))
+}
+
+/* logWriter takes the lines of the standard logger, set up with no flags */
+type logWriter struct {
+	logger *Logger
+}
+
+func (this *logWriter) Write(p []byte) (int, error) {
+	this.logger.Infof("%s", strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
@@ -1,30 +1,48 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"gopkg.in/Shopify/sarama.v1"
 )
 
+var mainLog = NewLogger("main")
+
 var (
 	configFile string
 	version    bool
 	testMode   bool
+	testDial   bool
 )
 
 func init() {
 	flag.StringVar(&configFile, "c", "config.json", "the config file")
 	flag.BoolVar(&version, "V", false, "show version")
 	flag.BoolVar(&testMode, "t", false, "test config")
+	flag.BoolVar(&testDial, "dial", false, "with -t, also connect to the configured zookeeper, kafka and influxdb")
 }
 
 func main() {
 
+	if len(os.Args) > 1 {
+		if command := findCliCommand(os.Args[1]); command != nil {
+			os.Exit(command.run(command.name, os.Args[2:], os.Stdout))
+		}
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		cliUsage(os.Stderr)
+	}
 	flag.Parse()
 
 	if version {
@@ -33,56 +51,142 @@ func main() {
 	}
 
 	if testMode {
+		if !checkConfig(configFile, testDial, os.Stdout) {
+			fmt.Println("config test failed")
+			os.Exit(1)
+		}
 		fmt.Println("config test ok")
 		return
 	}
 
 	config, err := loadConfig(configFile)
 	if err != nil {
-		log.Fatalf("Config load error:%s", err.Error())
-		os.Exit(-1)
+		mainLog.Fatalf("Config load error:%s", err.Error())
+	}
+
+	setLogConfig(&config.Log)
+	sarama.Logger = &stdLogger{logger: NewLogger("sarama"), level: LogInfo}
+	/* zookeeper and the other libraries log through the standard logger */
+	log.SetFlags(0)
+	log.SetOutput(&logWriter{logger: NewLogger("log")})
+	mainLog.Infof("config loaded:%s", config.Redacted())
+
+	err = InitInternalMetrics()
+	if err != nil {
+		mainLog.Fatalf("Init internal metrics failed:%s", err.Error())
 	}
 
-	sarama.Logger = log.New(os.Stdout, "[Sarama] ", log.LstdFlags)
+	setBreakerConfig(&config.Breaker)
 
 	sm := &ServerManager{}
 
 	if config.HttpServer.ListenAddr != "" {
 		sm.AddHttpServer(NewHttpServer(&config.HttpServer))
 	} else {
-		log.Printf("No httpserver config found")
+		mainLog.Warnf("No httpserver config found")
 	}
 
-	if len(config.InfluxdbSyncers) > 0 {
-		for _, c := range config.InfluxdbSyncers {
-			sm.AddInfluxdbSyncer(NewInfluxdbSyncer(&c))
+	if config.Election.Zookeeper != "" {
+		/* outputs start once this instance is elected */
+		sm.SetElection(NewElection(&config.Election), config.AllOutputs())
+	} else if config.Sharding.Zookeeper != "" {
+		/* outputs start for the clusters this instance owns */
+		if config.Sharding.AdvertiseAddr == "" {
+			mainLog.Warnf("No httpserver for sharding, other members can not proxy to this one")
 		}
+		sm.SetSharding(NewSharding(&config.Sharding), config.AllOutputs())
 	} else {
-		log.Printf("No influxdbsyncer config found")
+		schedulers, err := NewSchedulers(config.AllOutputs())
+		if err != nil {
+			mainLog.Fatalf("Init outputs failed:%s", err.Error())
+		}
+		if len(schedulers) > 0 {
+			for _, scheduler := range schedulers {
+				sm.AddScheduler(scheduler)
+			}
+		} else {
+			mainLog.Warnf("No output config found")
+		}
 	}
 
 	err = sm.Init()
 
 	if err != nil {
-		log.Fatalf("Init servers failed:%s", err.Error())
-		os.Exit(-1)
+		mainLog.Fatalf("Init servers failed:%s", err.Error())
 	}
 
 	err = sm.Start()
 	if err != nil {
-		log.Fatalf("Start servers failed:%s", err.Error())
-		os.Exit(-1)
+		mainLog.Fatalf("Start servers failed:%s", err.Error())
 	}
 
-	log.Printf("sm started:%#v,%#v", sm.HttpServers, sm.InfluxdbSyncers)
+	mainLog.Infof("started %d http servers and %d schedulers", len(sm.HttpServers), len(sm.Schedulers))
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGKILL)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGKILL)
+
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			if reloaded := reload(sm); reloaded != nil {
+				config = reloaded
+			}
+			continue
+		}
+
+		mainLog.Infof("catch exit signal %s, shutting down within %s", sig, config.shutdownTimeout())
+		if !shutdown(sm, config.shutdownTimeout(), c) {
+			os.Exit(1)
+		}
+		return
+	}
+}
+
+/* shutdown stops sm gracefully, a second signal or the timeout cut it short and return false */
+func shutdown(sm *ServerManager, timeout time.Duration, signals chan os.Signal) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sm.Shutdown(ctx)
+	}()
 
 	select {
-	case <-c:
-		log.Printf("catch exit signal")
-		sm.Close()
-		log.Printf("exit done")
+	case err := <-done:
+		if err != nil {
+			mainLog.Errorf("shutdown incomplete:%s", err.Error())
+			return false
+		}
+		mainLog.Infof("exit done")
+		return true
+	case sig := <-signals:
+		mainLog.Errorf("catch %s again, exit at once", sig)
+	case <-time.After(timeout + time.Second):
+		mainLog.Errorf("shutdown did not finish within %s, exit at once", timeout)
+	}
+	return false
+}
+
+/* re-reads the config file, an invalid file leaves the running config alone */
+func reload(sm *ServerManager) *Config {
+	mainLog.Infof("catch reload signal, reloading %s", configFile)
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		mainLog.Errorf("Config reload error, keep running with the old config:%s", err.Error())
+		return nil
+	}
+
+	setLogConfig(&config.Log)
+	mainLog.Infof("config loaded:%s", config.Redacted())
+	setBreakerConfig(&config.Breaker)
+
+	err = sm.Reload(config)
+	if err != nil {
+		mainLog.Errorf("Config reloaded with errors:%s", err.Error())
+		return config
 	}
+
+	mainLog.Infof("Config reloaded")
+	return config
 }
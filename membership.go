@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/wvanbergen/kazoo-go"
+)
+
+var errNoZkSession = errors.New("no zookeeper session")
+
+/* zkMember is one registered instance, data is what it registered with */
+type zkMember struct {
+	node string
+	data []byte
+}
+
+/*
+zkMembership registers this instance as an ephemeral sequential znode
+under a zookeeper path and reports the registered instances ordered by
+sequence number whenever they change. The znode goes away with the
+session, so a dead instance drops out within one session timeout. An
+instance disconnected from zookeeper is reported as no member at all,
+since its znode may expire at any time. A failed Init does not stop the
+instance, Start keeps connecting with backoff.
+*/
+type zkMembership struct {
+	logger    *Logger
+	zookeeper string
+	data      []byte
+	timeout   time.Duration
+	path      string
+	health    *componentHealth
+
+	conn    *zk.Conn
+	events  <-chan zk.Event
+	node    string
+	started bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newZkMembership(logger *Logger, component string, zookeeper string, path string, data []byte, timeout time.Duration) *zkMembership {
+	return &zkMembership{
+		logger:    logger,
+		zookeeper: zookeeper,
+		data:      data,
+		timeout:   timeout,
+		path:      path,
+		health:    newComponentHealth(component, zookeeper+path),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+func (this *zkMembership) Init() error {
+	servers, chroot := kazoo.ParseConnectionString(this.zookeeper)
+	conn, events, err := zk.Connect(servers, this.timeout)
+	if err != nil {
+		delay := this.health.fail(err)
+		this.logger.Errorf("connect %s failed, retry in %s:%s", this.zookeeper, delay, err.Error())
+		return err
+	}
+
+	this.conn = conn
+	this.events = events
+	this.path = chroot + this.path
+	this.health.succeed()
+
+	return nil
+}
+
+/*
+Start registers in the background. onChange gets the members and the
+index of this instance among them, -1 while it is not registered.
+*/
+func (this *zkMembership) Start(onChange func(members []zkMember, self int)) error {
+	this.started = true
+	go func() {
+		defer close(this.stopped)
+
+		/* Init failed, this instance is no member until it connects */
+		for this.conn == nil {
+			retryAt, _ := this.health.nextRetry()
+			select {
+			case <-time.After(time.Until(retryAt)):
+				if this.Init() == nil {
+					this.logger.Infof("connected to %s", this.zookeeper)
+				}
+			case <-this.done:
+				return
+			}
+		}
+
+		for {
+			var retry <-chan time.Time
+			watch, err := this.join(onChange)
+			switch {
+			case err != nil:
+				this.logger.Warnf("join %s failed:%s", this.path, err.Error())
+				this.health.degrade(err)
+				retry = time.After(time.Second)
+			case watch == nil:
+				this.health.degrade(errNoZkSession)
+			default:
+				this.health.succeed()
+			}
+
+			select {
+			case <-watch:
+			case <-retry:
+			case event := <-this.events:
+				if event.Type == zk.EventSession && event.State != zk.StateHasSession {
+					onChange(nil, -1)
+				}
+			case <-this.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+/*
+join makes sure this instance has a znode and re-reads the members,
+the returned channel fires when the members change.
+*/
+func (this *zkMembership) join(onChange func(members []zkMember, self int)) (<-chan zk.Event, error) {
+	if this.conn.State() != zk.StateHasSession {
+		onChange(nil, -1)
+		return nil, nil
+	}
+
+	if this.node == "" {
+		err := this.createParents()
+		if err != nil {
+			return nil, err
+		}
+		node, err := this.conn.CreateProtectedEphemeralSequential(this.path+"/member-", this.data, zk.WorldACL(zk.PermAll))
+		if err != nil {
+			return nil, err
+		}
+		this.node = node[strings.LastIndex(node, "/")+1:]
+	}
+
+	/* every member watches the whole list, there are only a few of them */
+	children, _, watch, err := this.conn.ChildrenW(this.path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(bySequence(children))
+
+	self := -1
+	members := []zkMember{}
+	for _, child := range children {
+		data, _, err := this.conn.Get(this.path + "/" + child)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if child == this.node {
+			self = len(members)
+		}
+		members = append(members, zkMember{node: child, data: data})
+	}
+
+	/* the session expired and took the znode with it */
+	if self < 0 {
+		this.logger.Warnf("znode %s is gone, joining again", this.node)
+		this.node = ""
+		onChange(members, -1)
+		return nil, fmt.Errorf("znode lost")
+	}
+
+	onChange(members, self)
+
+	return watch, nil
+}
+
+func (this *zkMembership) createParents() error {
+	parts := strings.Split(strings.Trim(this.path, "/"), "/")
+	for i := range parts {
+		_, err := this.conn.Create("/"+strings.Join(parts[:i+1], "/"), nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Close leaves by deleting the znode, so the others notice at once */
+func (this *zkMembership) Close() error {
+	select {
+	case <-this.done:
+		return nil
+	default:
+	}
+	close(this.done)
+
+	if this.started {
+		select {
+		case <-this.stopped:
+		case <-time.After(this.timeout):
+		}
+	}
+	if this.conn == nil {
+		return nil
+	}
+
+	if this.node != "" {
+		err := this.conn.Delete(this.path+"/"+this.node, -1)
+		if err != nil && err != zk.ErrNoNode {
+			this.logger.Warnf("delete %s failed:%s", this.node, err.Error())
+		}
+	}
+	this.conn.Close()
+
+	return nil
+}
+
+/* sorts znodes by their sequence number, the protected prefix varies */
+type bySequence []string
+
+func (this bySequence) Len() int      { return len(this) }
+func (this bySequence) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this bySequence) Less(i, j int) bool {
+	return sequenceOf(this[i]) < sequenceOf(this[j])
+}
+
+func sequenceOf(node string) string {
+	if i := strings.LastIndex(node, "-"); i >= 0 {
+		return node[i+1:]
+	}
+	return node
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+/* MetricContext is the data a metric template is executed against */
+type MetricContext struct {
+	Cluster     string
+	Topic       string
+	Group       string
+	Partition   string
+	Measurement string
+	Labels      map[string]string
+}
+
+type MetricTemplateConfig struct {
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags"`
+	Fields      map[string]string `json:"fields"`
+	ValueField  string            `json:"valueField"`
+}
+
+type MetricTemplatesConfig struct {
+	LatestOffset          *MetricTemplateConfig `json:"latestOffset"`
+	ConsumerGroupOffset   *MetricTemplateConfig `json:"consumerGroupOffset"`
+	ConsumerGroupDistance *MetricTemplateConfig `json:"consumerGroupDistance"`
+}
+
+type MetricTemplate struct {
+	measurement *template.Template
+	tags        map[string]*template.Template
+	fields      map[string]*template.Template
+	valueField  *template.Template
+}
+
+type MetricTemplates struct {
+	LatestOffset          *MetricTemplate
+	ConsumerGroupOffset   *MetricTemplate
+	ConsumerGroupDistance *MetricTemplate
+}
+
+type RenderedMetric struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]string
+	ValueField  string
+}
+
+var metricTemplateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"default": func(def, s string) string {
+		if s == "" {
+			return def
+		}
+		return s
+	},
+}
+
+/* the defaults reproduce the original hard-coded point layout */
+func defaultLatestOffsetTemplate() *MetricTemplateConfig {
+	return &MetricTemplateConfig{
+		Measurement: "{{.Measurement}}",
+		Tags:        map[string]string{},
+		Fields: map[string]string{
+			"topic":     "{{.Topic}}",
+			"partition": "{{.Partition}}",
+		},
+		ValueField: "value",
+	}
+}
+
+func defaultConsumerGroupTemplate() *MetricTemplateConfig {
+	return &MetricTemplateConfig{
+		Measurement: "{{.Measurement}}",
+		Tags:        map[string]string{},
+		Fields: map[string]string{
+			"group":     "{{.Group}}",
+			"topic":     "{{.Topic}}",
+			"partition": "{{.Partition}}",
+		},
+		ValueField: "value",
+	}
+}
+
+/*
+tagMetricTemplate is the default of the outputs writing a single value per
+series under a name and tags: the name of the output and one tag per key
+among cluster, topic, group and partition.
+*/
+func tagMetricTemplate(keys ...string) *MetricTemplateConfig {
+	config := &MetricTemplateConfig{
+		Measurement: "{{.Measurement}}",
+		Tags:        map[string]string{},
+	}
+	for _, k := range keys {
+		config.Tags[k] = "{{." + strings.Title(k) + "}}"
+	}
+	return config
+}
+
+func mergeMetricTemplateConfig(config *MetricTemplateConfig, def *MetricTemplateConfig) *MetricTemplateConfig {
+	if config == nil {
+		return def
+	}
+	merged := *config
+	if merged.Measurement == "" {
+		merged.Measurement = def.Measurement
+	}
+	if merged.Tags == nil {
+		merged.Tags = def.Tags
+	}
+	if merged.Fields == nil {
+		merged.Fields = def.Fields
+	}
+	if merged.ValueField == "" {
+		merged.ValueField = def.ValueField
+	}
+	return &merged
+}
+
+func parseMetricTemplate(name string, text string) (*template.Template, error) {
+	tpl, err := template.New(name).Funcs(metricTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %s", name, err.Error())
+	}
+	return tpl, nil
+}
+
+func NewMetricTemplate(name string, config *MetricTemplateConfig) (*MetricTemplate, error) {
+	var err error
+	t := &MetricTemplate{
+		tags:   map[string]*template.Template{},
+		fields: map[string]*template.Template{},
+	}
+
+	t.measurement, err = parseMetricTemplate(name+".measurement", config.Measurement)
+	if err != nil {
+		return nil, err
+	}
+	if config.ValueField != "" {
+		t.valueField, err = parseMetricTemplate(name+".valueField", config.ValueField)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range config.Tags {
+		t.tags[k], err = parseMetricTemplate(name+".tags."+k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range config.Fields {
+		t.fields[k], err = parseMetricTemplate(name+".fields."+k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+/* NewMetricTemplates returns the templates of influxdb, the defaults of the other outputs differ */
+func NewMetricTemplates(config *MetricTemplatesConfig) (*MetricTemplates, error) {
+	return NewMetricTemplatesWithDefaults(config, defaultLatestOffsetTemplate(), defaultConsumerGroupTemplate())
+}
+
+func NewMetricTemplatesWithDefaults(config *MetricTemplatesConfig, latestOffset *MetricTemplateConfig, consumerGroup *MetricTemplateConfig) (*MetricTemplates, error) {
+	var err error
+	t := &MetricTemplates{}
+
+	t.LatestOffset, err = NewMetricTemplate("latestOffset",
+		mergeMetricTemplateConfig(config.LatestOffset, latestOffset))
+	if err != nil {
+		return nil, err
+	}
+	t.ConsumerGroupOffset, err = NewMetricTemplate("consumerGroupOffset",
+		mergeMetricTemplateConfig(config.ConsumerGroupOffset, consumerGroup))
+	if err != nil {
+		return nil, err
+	}
+	t.ConsumerGroupDistance, err = NewMetricTemplate("consumerGroupDistance",
+		mergeMetricTemplateConfig(config.ConsumerGroupDistance, consumerGroup))
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+/*
+Validate executes every template once against a sample context so that
+typos like {{.Topik}} or missing labels are reported at config load.
+*/
+func (this *MetricTemplates) Validate(cluster string, labels map[string]string) error {
+	ctx := &MetricContext{
+		Cluster:     cluster,
+		Topic:       "topic",
+		Group:       "group",
+		Partition:   "0",
+		Measurement: "measurement",
+		Labels:      labels,
+	}
+	for _, t := range []*MetricTemplate{this.LatestOffset, this.ConsumerGroupOffset, this.ConsumerGroupDistance} {
+		m, err := t.Render(ctx)
+		if err != nil {
+			return err
+		}
+		if m.Measurement == "" || (t.valueField != nil && m.ValueField == "") {
+			return fmt.Errorf("template %s renders an empty measurement or value field", t.measurement.Name())
+		}
+	}
+	return nil
+}
+
+/*
+checkKeys rejects the keys an output can not write: fields and valueField
+unless it writes several fields per point, tags unless it has tags, and tag
+names validTag refuses.
+*/
+func (this *MetricTemplatesConfig) checkKeys(fields bool, tags bool, validTag func(string) bool) error {
+	names := []string{"latestOffset", "consumerGroupOffset", "consumerGroupDistance"}
+	for i, t := range []*MetricTemplateConfig{this.LatestOffset, this.ConsumerGroupOffset, this.ConsumerGroupDistance} {
+		if t == nil {
+			continue
+		}
+		if !fields && (len(t.Fields) > 0 || t.ValueField != "") {
+			return fmt.Errorf("templates.%s: fields and valueField are only written by influxdb", names[i])
+		}
+		if !tags && len(t.Tags) > 0 {
+			return fmt.Errorf("templates.%s: tags are not supported by this output", names[i])
+		}
+		for k := range t.Tags {
+			if validTag != nil && !validTag(k) {
+				return fmt.Errorf("templates.%s: invalid tag name %s", names[i], k)
+			}
+		}
+	}
+	return nil
+}
+
+func executeMetricTemplate(tpl *template.Template, ctx *MetricContext) (string, error) {
+	var buf bytes.Buffer
+	err := tpl.Execute(&buf, ctx)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (this *MetricTemplate) Render(ctx *MetricContext) (*RenderedMetric, error) {
+	var err error
+	m := &RenderedMetric{
+		Tags:   map[string]string{},
+		Fields: map[string]string{},
+	}
+
+	m.Measurement, err = executeMetricTemplate(this.measurement, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if this.valueField != nil {
+		m.ValueField, err = executeMetricTemplate(this.valueField, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, tpl := range this.tags {
+		v, err := executeMetricTemplate(tpl, ctx)
+		if err != nil {
+			return nil, err
+		}
+		/* empty tag values are not allowed by most backends */
+		if v != "" {
+			m.Tags[k] = v
+		}
+	}
+	for k, tpl := range this.fields {
+		v, err := executeMetricTemplate(tpl, ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.Fields[k] = v
+	}
+
+	return m, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMetricTemplateRender(t *testing.T) {
+	ctx := &MetricContext{
+		Cluster:     "main",
+		Topic:       "Orders",
+		Group:       "billing",
+		Partition:   "3",
+		Measurement: "consumer_group_distance",
+		Labels:      map[string]string{"env": "prod"},
+	}
+	for _, c := range []struct {
+		name   string
+		config *MetricTemplateConfig
+		want   string
+	}{
+		{"influxdb latest offset default", defaultLatestOffsetTemplate(),
+			`{"Measurement":"consumer_group_distance","Tags":{},"Fields":{"partition":"3","topic":"Orders"},"ValueField":"value"}`},
+		{"influxdb consumer group default", defaultConsumerGroupTemplate(),
+			`{"Measurement":"consumer_group_distance","Tags":{},"Fields":{"group":"billing","partition":"3","topic":"Orders"},"ValueField":"value"}`},
+		{"tag default", tagMetricTemplate("group", "topic", "partition"),
+			`{"Measurement":"consumer_group_distance","Tags":{"group":"billing","partition":"3","topic":"Orders"},"Fields":{},"ValueField":""}`},
+		{"tag default without keys", tagMetricTemplate(),
+			`{"Measurement":"consumer_group_distance","Tags":{},"Fields":{},"ValueField":""}`},
+		{"functions and labels", &MetricTemplateConfig{
+			Measurement: `kafka.{{.Labels.env}}.{{lower .Topic}}.{{replace "_" "." .Measurement}}`,
+			Tags:        map[string]string{"cluster": "{{upper .Cluster}}", "env": `{{default "none" .Labels.env}}`, "dc": `{{default "none" ""}}`},
+		}, `{"Measurement":"kafka.prod.orders.consumer.group.distance","Tags":{"cluster":"MAIN","dc":"none","env":"prod"},"Fields":{},"ValueField":""}`},
+		{"empty tag values are left out", &MetricTemplateConfig{
+			Measurement: "m",
+			Tags:        map[string]string{"group": "{{.Group}}", "empty": "{{if false}}x{{end}}"},
+		}, `{"Measurement":"m","Tags":{"group":"billing"},"Fields":{},"ValueField":""}`},
+	} {
+		tpl, err := NewMetricTemplate("test", c.config)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		m, err := tpl.Render(ctx)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		got, _ := json.Marshal(m)
+		if string(got) != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMetricTemplatesDefaults(t *testing.T) {
+	/* a configured template only replaces the parts it sets */
+	config := &MetricTemplatesConfig{
+		ConsumerGroupDistance: &MetricTemplateConfig{Measurement: "lag"},
+	}
+	templates, err := NewMetricTemplatesWithDefaults(config, tagMetricTemplate("topic"), tagMetricTemplate("group", "topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &MetricContext{Topic: "t", Group: "g", Measurement: "m"}
+	for _, c := range []struct {
+		name string
+		tpl  *MetricTemplate
+		want string
+	}{
+		{"latestOffset", templates.LatestOffset, `{"Measurement":"m","Tags":{"topic":"t"},"Fields":{},"ValueField":""}`},
+		{"consumerGroupOffset", templates.ConsumerGroupOffset, `{"Measurement":"m","Tags":{"group":"g","topic":"t"},"Fields":{},"ValueField":""}`},
+		{"consumerGroupDistance", templates.ConsumerGroupDistance, `{"Measurement":"lag","Tags":{"group":"g","topic":"t"},"Fields":{},"ValueField":""}`},
+	} {
+		m, err := c.tpl.Render(ctx)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		got, _ := json.Marshal(m)
+		if string(got) != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestOutputMetricTemplates(t *testing.T) {
+	ctx := &MetricContext{Cluster: "c", Topic: "t", Group: "g", Partition: "0", Measurement: "m"}
+	for _, c := range []struct {
+		name      string
+		templates func(*MetricTemplatesConfig) (*MetricTemplates, error)
+		latest    string
+		group     string
+	}{
+		{"influxdb", NewMetricTemplates,
+			`{"Measurement":"m","Tags":{},"Fields":{"partition":"0","topic":"t"},"ValueField":"value"}`,
+			`{"Measurement":"m","Tags":{},"Fields":{"group":"g","partition":"0","topic":"t"},"ValueField":"value"}`},
+		{"graphite", newGraphiteTemplates,
+			`{"Measurement":"m","Tags":{},"Fields":{},"ValueField":""}`,
+			`{"Measurement":"m","Tags":{},"Fields":{},"ValueField":""}`},
+		{"statsd", func(c *MetricTemplatesConfig) (*MetricTemplates, error) { return newStatsdTemplates(c, "") },
+			`{"Measurement":"m","Tags":{},"Fields":{},"ValueField":""}`,
+			`{"Measurement":"m","Tags":{},"Fields":{},"ValueField":""}`},
+		{"dogstatsd", func(c *MetricTemplatesConfig) (*MetricTemplates, error) { return newStatsdTemplates(c, "dogstatsd") },
+			`{"Measurement":"m","Tags":{"topic":"t"},"Fields":{},"ValueField":""}`,
+			`{"Measurement":"m","Tags":{"group":"g","partition":"0","topic":"t"},"Fields":{},"ValueField":""}`},
+		{"opentsdb", newOpentsdbTemplates,
+			`{"Measurement":"m","Tags":{"partition":"0","topic":"t"},"Fields":{},"ValueField":""}`,
+			`{"Measurement":"m","Tags":{"group":"g","partition":"0","topic":"t"},"Fields":{},"ValueField":""}`},
+		{"prometheus", newPrometheusTemplates,
+			`{"Measurement":"m","Tags":{"partition":"0","topic":"t"},"Fields":{},"ValueField":""}`,
+			`{"Measurement":"m","Tags":{"group":"g","partition":"0","topic":"t"},"Fields":{},"ValueField":""}`},
+	} {
+		templates, err := c.templates(&MetricTemplatesConfig{})
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if err := templates.Validate("c", nil); err != nil {
+			t.Errorf("%s: defaults do not validate: %s", c.name, err)
+		}
+		for _, r := range []struct {
+			tpl  *MetricTemplate
+			want string
+		}{
+			{templates.LatestOffset, c.latest},
+			{templates.ConsumerGroupOffset, c.group},
+			{templates.ConsumerGroupDistance, c.group},
+		} {
+			m, err := r.tpl.Render(ctx)
+			if err != nil {
+				t.Errorf("%s: %s", c.name, err)
+				continue
+			}
+			got, _ := json.Marshal(m)
+			if string(got) != r.want {
+				t.Errorf("%s %s:\n got %s\nwant %s", c.name, r.tpl.measurement.Name(), got, r.want)
+			}
+		}
+	}
+}
+
+func TestMetricTemplatesErrors(t *testing.T) {
+	labels := map[string]string{"env": "prod"}
+	for _, c := range []struct {
+		name   string
+		config *MetricTemplateConfig
+		err    string
+	}{
+		{"parse error", &MetricTemplateConfig{Measurement: "{{.Topic"}, "template consumerGroupDistance.measurement:"},
+		{"unknown function", &MetricTemplateConfig{Measurement: "{{title .Topic}}"}, `function "title" not defined`},
+		{"unknown field", &MetricTemplateConfig{Measurement: "{{.Topik}}"}, "can't evaluate field Topik"},
+		{"missing label", &MetricTemplateConfig{Measurement: "{{.Labels.dc}}"}, `map has no entry for key "dc"`},
+		{"bad tag", &MetricTemplateConfig{Tags: map[string]string{"t": "{{.Nope}}"}}, "can't evaluate field Nope"},
+		{"bad field", &MetricTemplateConfig{Fields: map[string]string{"f": "{{"}}, "template consumerGroupDistance.fields.f:"},
+		{"measurement renders empty", &MetricTemplateConfig{Measurement: "{{if false}}x{{end}}"}, "renders an empty measurement or value field"},
+		{"value field renders empty", &MetricTemplateConfig{ValueField: `{{default "" ""}}`}, "renders an empty measurement or value field"},
+	} {
+		templates, err := NewMetricTemplates(&MetricTemplatesConfig{ConsumerGroupDistance: c.config})
+		if err == nil {
+			err = templates.Validate("cluster", labels)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error = %v, want %q", c.name, err, c.err)
+		}
+	}
+
+	templates, err := NewMetricTemplates(&MetricTemplatesConfig{
+		LatestOffset: &MetricTemplateConfig{Measurement: "{{.Labels.env}}_{{.Cluster}}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := templates.Validate("cluster", labels); err != nil {
+		t.Errorf("labels set: %s", err)
+	}
+	if err := templates.Validate("cluster", nil); err == nil {
+		t.Errorf("labels missing: no error")
+	}
+}
+
+func TestMetricTemplatesCheckKeys(t *testing.T) {
+	tags := &MetricTemplatesConfig{LatestOffset: &MetricTemplateConfig{Tags: map[string]string{"topic": "{{.Topic}}"}}}
+	badTag := &MetricTemplatesConfig{ConsumerGroupOffset: &MetricTemplateConfig{Tags: map[string]string{"my-tag": "x"}}}
+	fields := &MetricTemplatesConfig{ConsumerGroupDistance: &MetricTemplateConfig{Fields: map[string]string{"f": "x"}}}
+	valueField := &MetricTemplatesConfig{LatestOffset: &MetricTemplateConfig{ValueField: "v"}}
+
+	for _, c := range []struct {
+		name     string
+		config   *MetricTemplatesConfig
+		fields   bool
+		tags     bool
+		validTag func(string) bool
+		err      string
+	}{
+		{"nothing set", &MetricTemplatesConfig{}, false, false, nil, ""},
+		{"tags allowed", tags, false, true, nil, ""},
+		{"tags refused", tags, false, false, nil, "templates.latestOffset: tags are not supported by this output"},
+		{"tag name checked", badTag, false, true, prometheusNameRegexp.MatchString, "templates.consumerGroupOffset: invalid tag name my-tag"},
+		{"tag name accepted", tags, false, true, prometheusNameRegexp.MatchString, ""},
+		{"fields allowed", fields, true, true, nil, ""},
+		{"fields refused", fields, false, true, nil, "templates.consumerGroupDistance: fields and valueField are only written by influxdb"},
+		{"value field refused", valueField, false, true, nil, "templates.latestOffset: fields and valueField are only written by influxdb"},
+	} {
+		err := c.config.checkKeys(c.fields, c.tags, c.validTag)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", c.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: error = %v, want %q", c.name, err, c.err)
+		}
+	}
+}
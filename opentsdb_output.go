@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+func init() {
+	RegisterOutput("opentsdb", "5s", func() OutputOptions { return &OpentsdbOutputConfig{} })
+}
+
+type OpentsdbOutputConfig struct {
+	OpentsdbHost           string            `json:"opentsdbHost"`
+	OpentsdbPrefix         string            `json:"opentsdbPrefix"`
+	OpentsdbTags           map[string]string `json:"opentsdbTags"`
+	OpentsdbBatchSize      int               `json:"opentsdbBatchSize"`
+	OpentsdbErrorReporting string            `json:"opentsdbErrorReporting"`
+	OpentsdbTimeout        string            `json:"opentsdbTimeout"`
+
+	Labels    map[string]string     `json:"labels"`
+	Templates MetricTemplatesConfig `json:"templates"`
+}
+
+func (this *OpentsdbOutputConfig) Validate() error {
+	switch this.OpentsdbErrorReporting {
+	case "", "none", "summary", "details":
+	default:
+		return fmt.Errorf("unknown opentsdbErrorReporting %s, should be none, summary or details", this.OpentsdbErrorReporting)
+	}
+	if this.OpentsdbBatchSize < 0 {
+		return fmt.Errorf("invalid opentsdbBatchSize %d", this.OpentsdbBatchSize)
+	}
+	err := validateUrl("opentsdbHost", this.OpentsdbHost)
+	if err != nil {
+		return err
+	}
+	err = validateDuration("opentsdbTimeout", this.OpentsdbTimeout)
+	if err != nil {
+		return err
+	}
+	err = this.Templates.checkKeys(false, true, nil)
+	if err != nil {
+		return err
+	}
+	templates, err := newOpentsdbTemplates(&this.Templates)
+	if err != nil {
+		return err
+	}
+	return templates.Validate("cluster", this.Labels)
+}
+
+/* the metric is <prefix>.<name> with the topic, group and partition tags */
+func newOpentsdbTemplates(config *MetricTemplatesConfig) (*MetricTemplates, error) {
+	return NewMetricTemplatesWithDefaults(config,
+		tagMetricTemplate("topic", "partition"),
+		tagMetricTemplate("group", "topic", "partition"))
+}
+
+func (this *OpentsdbOutputConfig) NewOutput() Output {
+	return NewOpentsdbOutput(this)
+}
+
+type opentsdbDatapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type opentsdbPutError struct {
+	Datapoint *opentsdbDatapoint `json:"datapoint"`
+	Error     string             `json:"error"`
+}
+
+/* body of /api/put when ?summary or ?details is requested */
+type opentsdbPutResponse struct {
+	Success int                 `json:"success"`
+	Failed  int                 `json:"failed"`
+	Errors  []*opentsdbPutError `json:"errors"`
+}
+
+type OpentsdbOutput struct {
+	config    *OpentsdbOutputConfig
+	client    *http.Client
+	putUrl    string
+	rates     *RateTracker
+	templates *MetricTemplates
+}
+
+var opentsdbLog = NewLogger("output").With("syncer", "opentsdb")
+
+/* opentsdb only accepts a-z, A-Z, 0-9, -, _, . and / in metrics and tags */
+var opentsdbInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9\-_./]`)
+
+func sanitizeOpentsdbName(name string) string {
+	name = opentsdbInvalidChars.ReplaceAllString(name, "_")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+func NewOpentsdbOutput(config *OpentsdbOutputConfig) *OpentsdbOutput {
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	if config.OpentsdbHost == "" {
+		config.OpentsdbHost = "http://127.0.0.1:4242"
+	}
+	if config.OpentsdbPrefix == "" {
+		config.OpentsdbPrefix = "kafka"
+	}
+	if config.OpentsdbBatchSize == 0 {
+		config.OpentsdbBatchSize = 50
+	}
+	if config.OpentsdbErrorReporting == "" {
+		config.OpentsdbErrorReporting = "summary"
+	}
+	if config.OpentsdbTimeout == "" {
+		config.OpentsdbTimeout = "10s"
+	}
+
+	s := &OpentsdbOutput{config: config, rates: NewRateTracker()}
+	return s
+}
+
+func (this *OpentsdbOutput) Init() error {
+
+	/* init templates */
+	templates, err := newOpentsdbTemplates(&this.config.Templates)
+	if err != nil {
+		return err
+	}
+	this.templates = templates
+
+	/* init http client */
+	timeout, err := time.ParseDuration(this.config.OpentsdbTimeout)
+	if err != nil {
+		timeout = time.Second * 10
+	}
+	this.client = &http.Client{Timeout: timeout}
+
+	this.putUrl = strings.TrimRight(this.config.OpentsdbHost, "/") + "/api/put"
+	if this.config.OpentsdbErrorReporting != "none" {
+		this.putUrl += "?" + this.config.OpentsdbErrorReporting
+	}
+
+	return nil
+}
+
+func (this *OpentsdbOutput) Write(snapshot *Snapshot) error {
+	datapoints, err := this.collect(snapshot)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for i := 0; i < len(datapoints); i += this.config.OpentsdbBatchSize {
+		end := i + this.config.OpentsdbBatchSize
+		if end > len(datapoints) {
+			end = len(datapoints)
+		}
+		err := this.put(datapoints[i:end])
+		if err != nil {
+			opentsdbLog.Errorf("put failed:%s", err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (this *OpentsdbOutput) datapoint(tpl *MetricTemplate, ctx *MetricContext, ts int64, value interface{}) (*opentsdbDatapoint, error) {
+	m, err := tpl.Render(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for k, v := range this.config.OpentsdbTags {
+		tags[sanitizeOpentsdbName(k)] = sanitizeOpentsdbName(v)
+	}
+	tags["cluster"] = sanitizeOpentsdbName(ctx.Cluster)
+	for k, v := range m.Tags {
+		tags[sanitizeOpentsdbName(k)] = sanitizeOpentsdbName(v)
+	}
+	return &opentsdbDatapoint{
+		Metric:    sanitizeOpentsdbName(m.Measurement),
+		Timestamp: ts,
+		Value:     value,
+		Tags:      tags,
+	}, nil
+}
+
+/* rates are written with the template of the offsets they are derived from */
+func (this *OpentsdbOutput) collect(snapshot *Snapshot) ([]*opentsdbDatapoint, error) {
+	latestOffset := snapshot.LatestOffset
+	groupOffset := snapshot.ConsumerGroupOffset
+	distance := snapshot.ConsumerGroupDistance
+
+	now := snapshot.Time
+	ts := now.Unix()
+	datapoints := []*opentsdbDatapoint{}
+
+	add := func(tpl *MetricTemplate, name string, group string, topic string, partition string, value interface{}) error {
+		ctx := &MetricContext{
+			Cluster:     snapshot.Cluster,
+			Topic:       topic,
+			Group:       group,
+			Partition:   partition,
+			Measurement: this.config.OpentsdbPrefix + "." + name,
+			Labels:      this.config.Labels,
+		}
+		dp, err := this.datapoint(tpl, ctx, ts, value)
+		if err != nil {
+			return err
+		}
+		datapoints = append(datapoints, dp)
+		return nil
+	}
+
+	if !snapshot.SkipTopics {
+		for topic, partitionItem := range latestOffset {
+			for partition, offset := range partitionItem {
+				if err := add(this.templates.LatestOffset, "latest_offset", "", topic, partition, offset); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for topic, partitionItem := range this.rates.LatestOffsetRate(latestOffset, now) {
+			for partition, rate := range partitionItem {
+				if err := add(this.templates.LatestOffset, "latest_offset_rate", "", topic, partition, rate); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for group, topicItem := range groupOffset {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				if err := add(this.templates.ConsumerGroupOffset, "consumer_group_offset", group, topic, partition, offset); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for group, topicItem := range this.rates.ConsumerGroupOffsetRate(groupOffset, now) {
+		for topic, partitionItem := range topicItem {
+			for partition, rate := range partitionItem {
+				if err := add(this.templates.ConsumerGroupOffset, "consumer_group_offset_rate", group, topic, partition, rate); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for group, topicItem := range distance {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				if err := add(this.templates.ConsumerGroupDistance, "consumer_group_distance", group, topic, partition, offset); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return datapoints, nil
+}
+
+func (this *OpentsdbOutput) put(datapoints []*opentsdbDatapoint) error {
+	body, err := json.Marshal(datapoints)
+	if err != nil {
+		return err
+	}
+
+	res, err := this.client.Post(this.putUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	/*
+		204 without error reporting, 200 with a summary or details body, 400
+		with the same body when some points failed. Anything else is a
+		whole-request failure.
+	*/
+	var result opentsdbPutResponse
+	reported := len(content) > 0 && json.Unmarshal(content, &result) == nil && result.Success+result.Failed > 0
+	if !reported {
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("opentsdb put failed with status %d:%s", res.StatusCode, string(content))
+		}
+		metrics.IncrCounter([]string{"output", "opentsdb", "points"}, float32(len(datapoints)))
+		return nil
+	}
+
+	metrics.IncrCounter([]string{"output", "opentsdb", "points"}, float32(result.Success))
+	if result.Failed == 0 {
+		return nil
+	}
+	for _, e := range result.Errors {
+		if e.Datapoint != nil {
+			opentsdbLog.Warnf("datapoint %s %v rejected:%s", e.Datapoint.Metric, e.Datapoint.Tags, e.Error)
+		}
+	}
+	return fmt.Errorf("opentsdb rejected %d of %d datapoints", result.Failed, len(datapoints))
+}
+
+func (this *OpentsdbOutput) Close() error {
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeOpentsdbName(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want string
+	}{
+		{"kafka.consumer_group_distance", "kafka.consumer_group_distance"},
+		{"a-Z_0.9/x", "a-Z_0.9/x"},
+		{"zk1:2181,zk2:2181/kafka", "zk1_2181_zk2_2181/kafka"},
+		{"group with spaces", "group_with_spaces"},
+		{"тема", "____"},
+		{"", "_"},
+	} {
+		if got := sanitizeOpentsdbName(c.name); got != c.want {
+			t.Errorf("sanitizeOpentsdbName(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestOpentsdbCollect(t *testing.T) {
+	output := NewOpentsdbOutput(&OpentsdbOutputConfig{OpentsdbTags: map[string]string{"data center": "dc 1"}})
+	if err := output.Init(); err != nil {
+		t.Fatal(err)
+	}
+	datapoints, err := output.collect(&Snapshot{
+		Cluster: "zk1:2181/kafka",
+		Time:    time.Unix(1700000000, 0),
+		ConsumerGroupDistance: map[string]map[string]map[string]int64{
+			"my group": {"orders": {"0": 7}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(datapoints)
+	want := `[{"metric":"kafka.consumer_group_distance","timestamp":1700000000,"value":7,` +
+		`"tags":{"cluster":"zk1_2181/kafka","data_center":"dc_1","group":"my_group","partition":"0","topic":"orders"}}]`
+	if string(got) != want {
+		t.Errorf("datapoints:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestOpentsdbPut(t *testing.T) {
+	var status int
+	var response, query, body string
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+		res.WriteHeader(status)
+		res.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	datapoints := []*opentsdbDatapoint{
+		{Metric: "kafka.latest_offset", Timestamp: 1, Value: int64(10), Tags: map[string]string{"topic": "a"}},
+		{Metric: "kafka.latest_offset", Timestamp: 1, Value: 0.5, Tags: map[string]string{"topic": "b"}},
+	}
+
+	for _, c := range []struct {
+		name      string
+		reporting string
+		status    int
+		response  string
+		err       string
+	}{
+		{"no reporting", "none", 204, "", ""},
+		{"summary", "summary", 200, `{"success":2,"failed":0}`, ""},
+		{"summary with failures", "summary", 400, `{"success":1,"failed":1}`, "opentsdb rejected 1 of 2 datapoints"},
+		{"details", "details", 400,
+			`{"success":1,"failed":1,"errors":[{"datapoint":{"metric":"kafka.latest_offset","timestamp":1,"value":0.5,"tags":{"topic":"b"}},"error":"Unknown metric"}]}`,
+			"opentsdb rejected 1 of 2 datapoints"},
+		{"whole request failed", "summary", 500, "internal error", "opentsdb put failed with status 500:internal error"},
+		{"bad request without summary", "none", 400, `{"error":{"code":400,"message":"bad"}}`, "opentsdb put failed with status 400"},
+	} {
+		status, response = c.status, c.response
+		output := NewOpentsdbOutput(&OpentsdbOutputConfig{OpentsdbHost: server.URL + "/", OpentsdbErrorReporting: c.reporting})
+		if err := output.Init(); err != nil {
+			t.Fatal(err)
+		}
+		err := output.put(datapoints)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: error = %v, want %q", c.name, err, c.err)
+		}
+
+		wantQuery := c.reporting
+		if c.reporting == "none" {
+			wantQuery = ""
+		}
+		if query != wantQuery {
+			t.Errorf("%s: query %q, want %q", c.name, query, wantQuery)
+		}
+		wantBody := `[{"metric":"kafka.latest_offset","timestamp":1,"value":10,"tags":{"topic":"a"}},` +
+			`{"metric":"kafka.latest_offset","timestamp":1,"value":0.5,"tags":{"topic":"b"}}]`
+		if body != wantBody {
+			t.Errorf("%s: body\n got %s\nwant %s", c.name, body, wantBody)
+		}
+	}
+}
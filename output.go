@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+Snapshot is the state of one cluster collected once per scheduler cycle and
+handed to every output of that scheduler. Outputs must not modify it.
+*/
+type Snapshot struct {
+	Cluster               string
+	Zookeeper             string
+	Brokers               []string
+	Time                  time.Time
+	LatestOffset          map[string]map[string]int64
+	ConsumerGroupOffset   map[string]map[string]map[string]int64
+	ConsumerGroupDistance map[string]map[string]map[string]int64
+
+	/*
+		set when another member of the sharding group writes the topic series
+		(latest offsets and their rates) of this cluster, LatestOffset is
+		complete regardless since the group series need it
+	*/
+	SkipTopics bool
+
+	/* the sharding member id when the consumer groups are sharded, empty otherwise */
+	ShardMember string
+
+	/* the end of the cycle, outputs give up waiting on their sink by then */
+	Deadline time.Time
+}
+
+/* the time left to write snapshots handed over without a deadline */
+const defaultWriteTimeout = 5 * time.Second
+
+/* WriteDeadline is the Deadline of the cycle, or defaultWriteTimeout from now without one */
+func (this *Snapshot) WriteDeadline() time.Time {
+	if this.Deadline.IsZero() {
+		return time.Now().Add(defaultWriteTimeout)
+	}
+	return this.Deadline
+}
+
+/*
+Output is a sink for snapshots. Init is called before the first Write and
+again after a backoff as long as it fails, Close once after the last
+Write. Write is never called concurrently on the same output.
+*/
+type Output interface {
+	Init() error
+	Write(snapshot *Snapshot) error
+	Close() error
+}
+
+/* OutputOptions is the type specific part of an outputs entry */
+type OutputOptions interface {
+	Validate() error
+	NewOutput() Output
+}
+
+type outputType struct {
+	interval   string
+	newOptions func() OutputOptions
+}
+
+var outputTypes = map[string]*outputType{}
+
+/*
+RegisterOutput makes an output type available to the outputs config list,
+it is meant to be called from init() of the file implementing the output.
+interval is the default collection interval for entries of this type.
+*/
+func RegisterOutput(name string, interval string, newOptions func() OutputOptions) {
+	if _, ok := outputTypes[name]; ok {
+		panic("output type " + name + " registered twice")
+	}
+	outputTypes[name] = &outputType{interval: interval, newOptions: newOptions}
+}
+
+func OutputTypes() []string {
+	names := make([]string, 0, len(outputTypes))
+	for name := range outputTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+OutputConfig is one entry of the outputs list. type, zookeeper, cluster
+and interval are shared by all types, every other key of the entry is
+decoded into the options of the type.
+*/
+type OutputConfig struct {
+	Type      string `json:"type"`
+	Zookeeper string `json:"zookeeper"`
+	Cluster   string `json:"cluster"`
+	Interval  string `json:"interval"`
+
+	options []byte
+}
+
+func (this *OutputConfig) UnmarshalJSON(data []byte) error {
+	type outputConfigFields OutputConfig
+	err := json.Unmarshal(data, (*outputConfigFields)(this))
+	if err != nil {
+		return err
+	}
+	this.options = append([]byte(nil), data...)
+	return nil
+}
+
+func (this *OutputConfig) MarshalJSON() ([]byte, error) {
+	if this.options != nil {
+		return this.options, nil
+	}
+	type outputConfigFields OutputConfig
+	return json.Marshal((*outputConfigFields)(this))
+}
+
+/* fills zookeeper, cluster and interval defaults */
+func (this *OutputConfig) setDefaults() {
+	if this.Zookeeper == "" {
+		this.Zookeeper = "127.0.0.1:2181"
+	}
+	if this.Cluster == "" {
+		this.Cluster = this.Zookeeper
+	}
+	if this.Interval == "" {
+		if t, ok := outputTypes[this.Type]; ok {
+			this.Interval = t.interval
+		}
+	}
+}
+
+/* outputs with equal keys are configured identically */
+func (this *OutputConfig) key() string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, this.options) != nil {
+		buf.Reset()
+		buf.Write(this.options)
+	}
+	return this.Type + "|" + buf.String()
+}
+
+/* outputs with equal scheduler keys share a scheduler, call after setDefaults */
+func (this *OutputConfig) schedulerKey() string {
+	return this.Zookeeper + "|" + this.Cluster + "|" + this.Interval
+}
+
+func (this *OutputConfig) Options() (OutputOptions, error) {
+	t, ok := outputTypes[this.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown output type %q, should be one of %v", this.Type, OutputTypes())
+	}
+	options := t.newOptions()
+	if this.options != nil {
+		err := json.Unmarshal(this.options, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+func (this *OutputConfig) Validate() error {
+	if this.Interval != "" {
+		d, err := time.ParseDuration(this.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval %q: %s", this.Interval, err.Error())
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid interval %q: should be positive", this.Interval)
+		}
+	}
+	options, err := this.Options()
+	if err != nil {
+		return err
+	}
+	return options.Validate()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+func init() {
+	RegisterOutput("prometheus", "15s", func() OutputOptions { return &PrometheusOutputConfig{} })
+}
+
+type PrometheusOutputConfig struct {
+	PrometheusMode     string            `json:"prometheusMode"`
+	PrometheusUrl      string            `json:"prometheusUrl"`
+	PrometheusUser     string            `json:"prometheusUser"`
+	PrometheusPassword string            `json:"prometheusPassword"`
+	PrometheusJob      string            `json:"prometheusJob"`
+	PrometheusPrefix   string            `json:"prometheusPrefix"`
+	PrometheusLabels   map[string]string `json:"prometheusLabels"`
+	PrometheusTimeout  string            `json:"prometheusTimeout"`
+
+	Labels    map[string]string     `json:"labels"`
+	Templates MetricTemplatesConfig `json:"templates"`
+}
+
+func (this *PrometheusOutputConfig) Validate() error {
+	switch this.PrometheusMode {
+	case "", "remote_write", "pushgateway":
+	default:
+		return fmt.Errorf("unknown prometheusMode %s, should be remote_write or pushgateway", this.PrometheusMode)
+	}
+	err := validateUrl("prometheusUrl", this.PrometheusUrl)
+	if err != nil {
+		return err
+	}
+	err = validateDuration("prometheusTimeout", this.PrometheusTimeout)
+	if err != nil {
+		return err
+	}
+	for k := range this.PrometheusLabels {
+		if !prometheusNameRegexp.MatchString(k) {
+			return fmt.Errorf("invalid prometheus label name %s", k)
+		}
+	}
+	err = this.Templates.checkKeys(false, true, prometheusNameRegexp.MatchString)
+	if err != nil {
+		return err
+	}
+	templates, err := newPrometheusTemplates(&this.Templates)
+	if err != nil {
+		return err
+	}
+	return templates.Validate("cluster", this.Labels)
+}
+
+/* the name is <prefix>_<name> with the topic, group and partition labels */
+func newPrometheusTemplates(config *MetricTemplatesConfig) (*MetricTemplates, error) {
+	return NewMetricTemplatesWithDefaults(config,
+		tagMetricTemplate("topic", "partition"),
+		tagMetricTemplate("group", "topic", "partition"))
+}
+
+func (this *PrometheusOutputConfig) NewOutput() Output {
+	return NewPrometheusOutput(this)
+}
+
+/*
+hand written equivalents of the prometheus remote write protobuf messages
+(prompb.WriteRequest and friends), encoded through gogo/protobuf's reflection
+*/
+type prompbLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *prompbLabel) Reset()         { *m = prompbLabel{} }
+func (m *prompbLabel) String() string { return proto.CompactTextString(m) }
+func (*prompbLabel) ProtoMessage()    {}
+
+type prompbSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *prompbSample) Reset()         { *m = prompbSample{} }
+func (m *prompbSample) String() string { return proto.CompactTextString(m) }
+func (*prompbSample) ProtoMessage()    {}
+
+type prompbTimeSeries struct {
+	Labels  []*prompbLabel  `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Samples []*prompbSample `protobuf:"bytes,2,rep,name=samples" json:"samples,omitempty"`
+}
+
+func (m *prompbTimeSeries) Reset()         { *m = prompbTimeSeries{} }
+func (m *prompbTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*prompbTimeSeries) ProtoMessage()    {}
+
+type prompbWriteRequest struct {
+	Timeseries []*prompbTimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+}
+
+func (m *prompbWriteRequest) Reset()         { *m = prompbWriteRequest{} }
+func (m *prompbWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*prompbWriteRequest) ProtoMessage()    {}
+
+type prometheusSeries struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+type PrometheusOutput struct {
+	config    *PrometheusOutputConfig
+	client    *http.Client
+	templates *MetricTemplates
+}
+
+var (
+	prometheusNameRegexp       = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	prometheusInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	prometheusLabelEscaper     = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func NewPrometheusOutput(config *PrometheusOutputConfig) *PrometheusOutput {
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	if config.PrometheusMode == "" {
+		config.PrometheusMode = "remote_write"
+	}
+	if config.PrometheusUrl == "" {
+		if config.PrometheusMode == "pushgateway" {
+			config.PrometheusUrl = "http://127.0.0.1:9091"
+		} else {
+			config.PrometheusUrl = "http://127.0.0.1:9090/api/v1/write"
+		}
+	}
+	if config.PrometheusJob == "" {
+		config.PrometheusJob = "kafka_offset_mon"
+	}
+	if config.PrometheusPrefix == "" {
+		config.PrometheusPrefix = "kafka"
+	}
+	if config.PrometheusTimeout == "" {
+		config.PrometheusTimeout = "10s"
+	}
+
+	s := &PrometheusOutput{config: config}
+	return s
+}
+
+func (this *PrometheusOutput) Init() error {
+
+	/* init templates */
+	templates, err := newPrometheusTemplates(&this.config.Templates)
+	if err != nil {
+		return err
+	}
+	this.templates = templates
+
+	/* init http client */
+	timeout, err := time.ParseDuration(this.config.PrometheusTimeout)
+	if err != nil {
+		timeout = time.Second * 10
+	}
+	this.client = &http.Client{Timeout: timeout}
+
+	return nil
+}
+
+func (this *PrometheusOutput) Write(snapshot *Snapshot) error {
+	series, err := this.collect(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if this.config.PrometheusMode == "pushgateway" {
+		err = this.push(series, snapshot.Cluster, snapshot.ShardMember)
+	} else {
+		err = this.remoteWrite(series, snapshot.Cluster, snapshot.Time)
+	}
+	if err != nil {
+		return err
+	}
+	metrics.IncrCounter([]string{"output", "prometheus", "points"}, float32(len(series)))
+	return nil
+}
+
+/* per partition series only, totals are left to sum() */
+func (this *PrometheusOutput) collect(snapshot *Snapshot) ([]*prometheusSeries, error) {
+	latestOffset := snapshot.LatestOffset
+	groupOffset := snapshot.ConsumerGroupOffset
+	distance := snapshot.ConsumerGroupDistance
+
+	series := []*prometheusSeries{}
+	add := func(tpl *MetricTemplate, name string, group string, topic string, partition string, value int64) error {
+		m, err := tpl.Render(&MetricContext{
+			Cluster:     snapshot.Cluster,
+			Topic:       topic,
+			Group:       group,
+			Partition:   partition,
+			Measurement: this.config.PrometheusPrefix + "_" + name,
+			Labels:      this.config.Labels,
+		})
+		if err != nil {
+			return err
+		}
+		series = append(series, &prometheusSeries{
+			name:   prometheusInvalidNameChars.ReplaceAllString(m.Measurement, "_"),
+			labels: m.Tags,
+			value:  float64(value),
+		})
+		return nil
+	}
+
+	if !snapshot.SkipTopics {
+		for topic, partitionItem := range latestOffset {
+			for partition, offset := range partitionItem {
+				if partition == "total" {
+					continue
+				}
+				if err := add(this.templates.LatestOffset, "latest_offset", "", topic, partition, offset); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for group, topicItem := range groupOffset {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				if partition == "total" {
+					continue
+				}
+				if err := add(this.templates.ConsumerGroupOffset, "consumer_group_offset", group, topic, partition, offset); err != nil {
+					return nil, err
+				}
+				if err := add(this.templates.ConsumerGroupDistance, "consumer_group_distance", group, topic, partition, distance[group][topic][partition]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return series, nil
+}
+
+func (this *PrometheusOutput) request(method string, u string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if this.config.PrometheusUser != "" {
+		req.SetBasicAuth(this.config.PrometheusUser, this.config.PrometheusPassword)
+	}
+
+	res, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		content, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("prometheus %s %s failed with status %d:%s", method, u, res.StatusCode, string(content))
+	}
+	return nil
+}
+
+func (this *PrometheusOutput) remoteWrite(series []*prometheusSeries, cluster string, now time.Time) error {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	req := &prompbWriteRequest{}
+
+	for _, s := range series {
+		labels := map[string]string{}
+		for k, v := range this.config.PrometheusLabels {
+			labels[k] = v
+		}
+		for k, v := range s.labels {
+			labels[k] = v
+		}
+		labels["cluster"] = cluster
+		labels["job"] = this.config.PrometheusJob
+		labels["__name__"] = s.name
+
+		/* remote write requires labels sorted by name */
+		names := make([]string, 0, len(labels))
+		for k := range labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		timeseries := &prompbTimeSeries{
+			Samples: []*prompbSample{{Value: s.value, Timestamp: ts}},
+		}
+		for _, k := range names {
+			timeseries.Labels = append(timeseries.Labels, &prompbLabel{Name: k, Value: labels[k]})
+		}
+		req.Timeseries = append(req.Timeseries, timeseries)
+	}
+
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return this.request("POST", this.config.PrometheusUrl, snappy.Encode(nil, data), map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	})
+}
+
+/*
+PUT replaces every series of the job/cluster group on the pushgateway, the
+members sharding the consumer groups of a cluster each push to their own
+job/cluster/member group so they do not erase each other's series
+*/
+func (this *PrometheusOutput) push(series []*prometheusSeries, cluster string, member string) error {
+	var buf bytes.Buffer
+	lastName := ""
+
+	sort.Sort(prometheusSeriesByName(series))
+	for _, s := range series {
+		if s.name != lastName {
+			fmt.Fprintf(&buf, "# TYPE %s gauge\n", s.name)
+			lastName = s.name
+		}
+
+		labels := map[string]string{}
+		for k, v := range this.config.PrometheusLabels {
+			labels[k] = v
+		}
+		for k, v := range s.labels {
+			labels[k] = v
+		}
+		pairs := make([]string, 0, len(labels))
+		for k, v := range labels {
+			pairs = append(pairs, k+"=\""+prometheusLabelEscaper.Replace(v)+"\"")
+		}
+		sort.Strings(pairs)
+
+		fmt.Fprintf(&buf, "%s{%s} %s\n", s.name, strings.Join(pairs, ","), strconv.FormatFloat(s.value, 'f', -1, 64))
+	}
+
+	u := strings.TrimRight(this.config.PrometheusUrl, "/") + "/metrics" +
+		pushgatewayGroupingKey("job", this.config.PrometheusJob) +
+		pushgatewayGroupingKey("cluster", cluster)
+	if member != "" {
+		u += pushgatewayGroupingKey("member", member)
+	}
+
+	return this.request("PUT", u, buf.Bytes(), map[string]string{
+		"Content-Type": "text/plain; version=0.0.4",
+	})
+}
+
+/*
+pushgatewayGroupingKey is the /<label>/<value> path of one grouping label.
+Values with a slash, such as a zookeeper chroot, or empty ones can't be a
+path segment and go as /<label>@base64/<base64url value>.
+*/
+func pushgatewayGroupingKey(label string, value string) string {
+	if value == "" {
+		return "/" + label + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return "/" + label + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + label + "/" + url.PathEscape(value)
+}
+
+func (this *PrometheusOutput) Close() error {
+	return nil
+}
+
+type prometheusSeriesByName []*prometheusSeries
+
+func (this prometheusSeriesByName) Len() int           { return len(this) }
+func (this prometheusSeriesByName) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this prometheusSeriesByName) Less(i, j int) bool { return this[i].name < this[j].name }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPushgatewayGroupingKey(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		value string
+		want  string
+	}{
+		{"job", "kafka_offset_mon", "/job/kafka_offset_mon"},
+		{"cluster", "zk1:2181,zk2:2181/kafka", "/cluster@base64/emsxOjIxODEsemsyOjIxODEva2Fma2E"},
+		{"cluster", "", "/cluster@base64/="},
+		{"member", "host 1?x=%", "/member/host%201%3Fx=%25"},
+		{"member", "a/b?", "/member@base64/YS9iPw"},
+	} {
+		if got := pushgatewayGroupingKey(c.label, c.value); got != c.want {
+			t.Errorf("pushgatewayGroupingKey(%q, %q) = %s, want %s", c.label, c.value, got, c.want)
+		}
+	}
+}
+
+func TestPrometheusPush(t *testing.T) {
+	var method, uri, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		method, uri, contentType = req.Method, req.RequestURI, req.Header.Get("Content-Type")
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	output := NewPrometheusOutput(&PrometheusOutputConfig{
+		PrometheusMode:   "pushgateway",
+		PrometheusUrl:    server.URL + "/",
+		PrometheusLabels: map[string]string{"env": "prod"},
+	})
+	if err := output.Init(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{
+		Cluster:      "zk1:2181/kafka",
+		Time:         time.Unix(1700000000, 0),
+		LatestOffset: map[string]map[string]int64{"orders": {"0": 12, "total": 12}},
+		ConsumerGroupOffset: map[string]map[string]map[string]int64{
+			"billing": {"orders": {"0": 10, "total": 10}},
+		},
+		ConsumerGroupDistance: map[string]map[string]map[string]int64{
+			"billing": {"orders": {"0": 2, "total": 2}},
+		},
+	}
+
+	for _, c := range []struct {
+		name   string
+		member string
+		uri    string
+	}{
+		{"whole cluster", "", "/metrics/job/kafka_offset_mon/cluster@base64/emsxOjIxODEva2Fma2E"},
+		{"shard member", "host-1", "/metrics/job/kafka_offset_mon/cluster@base64/emsxOjIxODEva2Fma2E/member/host-1"},
+	} {
+		snapshot.ShardMember = c.member
+		if err := output.Write(snapshot); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if method != "PUT" || uri != c.uri {
+			t.Errorf("%s: %s %s, want PUT %s", c.name, method, uri, c.uri)
+		}
+		if contentType != "text/plain; version=0.0.4" {
+			t.Errorf("%s: content type %s", c.name, contentType)
+		}
+		want := "# TYPE kafka_consumer_group_distance gauge\n" +
+			`kafka_consumer_group_distance{env="prod",group="billing",partition="0",topic="orders"} 2` + "\n" +
+			"# TYPE kafka_consumer_group_offset gauge\n" +
+			`kafka_consumer_group_offset{env="prod",group="billing",partition="0",topic="orders"} 10` + "\n" +
+			"# TYPE kafka_latest_offset gauge\n" +
+			`kafka_latest_offset{env="prod",partition="0",topic="orders"} 12` + "\n"
+		if body != want {
+			t.Errorf("%s: body\n got %s\nwant %s", c.name, body, want)
+		}
+	}
+}
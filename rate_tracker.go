@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+RateTracker derives per-second rates from the offsets seen in two
+consecutive sync cycles. The first cycle, and any partition whose offset
+went backwards (topic recreated, group reset), yields no rate.
+*/
+type RateTracker struct {
+	latestOffset     map[string]map[string]int64
+	latestOffsetTime time.Time
+
+	groupOffset     map[string]map[string]map[string]int64
+	groupOffsetTime time.Time
+}
+
+func NewRateTracker() *RateTracker {
+	return &RateTracker{}
+}
+
+func offsetRate(prev int64, cur int64, elapsed time.Duration) (float64, bool) {
+	if cur < prev || elapsed <= 0 {
+		return 0, false
+	}
+	return float64(cur-prev) / elapsed.Seconds(), true
+}
+
+/* LatestOffsetRate returns the produce rate per topic and partition */
+func (this *RateTracker) LatestOffsetRate(offsets map[string]map[string]int64, now time.Time) map[string]map[string]float64 {
+	rtn := map[string]map[string]float64{}
+	elapsed := now.Sub(this.latestOffsetTime)
+
+	if this.latestOffset != nil {
+		for topic, partitionItem := range offsets {
+			prevItem, ok := this.latestOffset[topic]
+			if !ok {
+				continue
+			}
+			topicItem := map[string]float64{}
+			for partition, offset := range partitionItem {
+				prev, ok := prevItem[partition]
+				if !ok {
+					continue
+				}
+				if rate, ok := offsetRate(prev, offset, elapsed); ok {
+					topicItem[partition] = rate
+				}
+			}
+			rtn[topic] = topicItem
+		}
+	}
+
+	this.latestOffset = offsets
+	this.latestOffsetTime = now
+	return rtn
+}
+
+/* ConsumerGroupOffsetRate returns the consume rate per group, topic and partition */
+func (this *RateTracker) ConsumerGroupOffsetRate(offsets map[string]map[string]map[string]int64, now time.Time) map[string]map[string]map[string]float64 {
+	rtn := map[string]map[string]map[string]float64{}
+	elapsed := now.Sub(this.groupOffsetTime)
+
+	if this.groupOffset != nil {
+		for group, topicItem := range offsets {
+			prevGroup, ok := this.groupOffset[group]
+			if !ok {
+				continue
+			}
+			groupItem := map[string]map[string]float64{}
+			for topic, partitionItem := range topicItem {
+				prevItem, ok := prevGroup[topic]
+				if !ok {
+					continue
+				}
+				rateItem := map[string]float64{}
+				for partition, offset := range partitionItem {
+					prev, ok := prevItem[partition]
+					if !ok {
+						continue
+					}
+					if rate, ok := offsetRate(prev, offset, elapsed); ok {
+						rateItem[partition] = rate
+					}
+				}
+				groupItem[topic] = rateItem
+			}
+			rtn[group] = groupItem
+		}
+	}
+
+	this.groupOffset = offsets
+	this.groupOffsetTime = now
+	return rtn
+}
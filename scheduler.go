@@ -0,0 +1,738 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Scheduler owns the worker of one cluster. Every interval it collects a
+Snapshot and hands it to all of its outputs, so outputs sharing a cluster
+and an interval cost a single round of zookeeper and kafka requests.
+*/
+type Scheduler struct {
+	zookeeper string
+	cluster   string
+	interval  time.Duration
+
+	worker   *Worker
+	health   *componentHealth
+	failures int
+	misses   int
+	inflight chan struct{}
+	ticker   *time.Ticker
+	started  bool
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+	sharding *Sharding
+	logger   *Logger
+
+	/* held for a whole cycle, so outputs are never swapped mid write */
+	lock    sync.Mutex
+	outputs []*scheduledOutput
+
+	/* also held to change outputs, so the status is read without waiting for a cycle */
+	outputsLock sync.RWMutex
+
+	statsLock sync.Mutex
+	stats     CycleStats
+	progress  time.Time
+}
+
+/* CycleStats counts the cycles of a scheduler since it started */
+type CycleStats struct {
+	Cycles           int64     `json:"cycles"`
+	Errors           int64     `json:"errors"`
+	DeadlineMisses   int64     `json:"deadlineMisses"`
+	OverrunTicks     int64     `json:"overrunTicks"`
+	SkippedTicks     int64     `json:"skippedTicks"`
+	WatchdogRestarts int64     `json:"watchdogRestarts"`
+	LastDuration     string    `json:"lastDuration"`
+	LastSuccess      time.Time `json:"lastSuccess"`
+}
+
+type scheduledOutput struct {
+	name   string
+	key    string
+	output Output
+	ready  bool
+	health *componentHealth
+}
+
+/* consecutive failed cycles after which the worker is rebuilt */
+const schedulerMaxFailures = 3
+
+/* consecutive missed deadlines after which the watchdog rebuilds the worker */
+const schedulerMaxMisses = 3
+
+func NewScheduler(zookeeper string, cluster string, interval time.Duration) *Scheduler {
+	logger := NewLogger("scheduler").With("zookeeper", zookeeper)
+	if cluster != "" {
+		logger = logger.With("cluster", cluster)
+	}
+
+	return &Scheduler{
+		logger:    logger,
+		zookeeper: zookeeper,
+		cluster:   cluster,
+		interval:  interval,
+		health:    newComponentHealth("worker", zookeeper),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+/*
+groupOutputConfigs fills the defaults of configs and groups them by
+scheduler key, keys are returned in the order they first appear.
+*/
+func groupOutputConfigs(configs []*OutputConfig) ([]string, map[string][]*OutputConfig) {
+	keys := []string{}
+	groups := map[string][]*OutputConfig{}
+
+	for _, config := range configs {
+		config.setDefaults()
+		key := config.schedulerKey()
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], config)
+	}
+
+	return keys, groups
+}
+
+func newSchedulerFromConfigs(configs []*OutputConfig) (*Scheduler, error) {
+	interval, err := time.ParseDuration(configs[0].Interval)
+	if err != nil {
+		return nil, err
+	}
+	scheduler := NewScheduler(configs[0].Zookeeper, configs[0].Cluster, interval)
+
+	for _, config := range configs {
+		options, err := config.Options()
+		if err != nil {
+			return nil, err
+		}
+		scheduler.addOutput(config.Type, config.key(), options.NewOutput())
+	}
+
+	return scheduler, nil
+}
+
+/*
+NewSchedulers builds the outputs of configs and groups them by zookeeper,
+cluster and interval, in the order they first appear.
+*/
+func NewSchedulers(configs []*OutputConfig) ([]*Scheduler, error) {
+	schedulers := []*Scheduler{}
+
+	keys, groups := groupOutputConfigs(configs)
+	for _, key := range keys {
+		scheduler, err := newSchedulerFromConfigs(groups[key])
+		if err != nil {
+			return nil, err
+		}
+		schedulers = append(schedulers, scheduler)
+	}
+
+	return schedulers, nil
+}
+
+func (this *Scheduler) Key() string {
+	return this.zookeeper + "|" + this.cluster + "|" + this.interval.String()
+}
+
+/* SetSharding limits the snapshots to what this instance owns, it is called before Start */
+func (this *Scheduler) SetSharding(sharding *Sharding) {
+	this.sharding = sharding
+}
+
+func (this *Scheduler) AddOutput(name string, output Output) {
+	this.addOutput(name, "", output)
+}
+
+func (this *Scheduler) addOutput(name string, key string, output Output) {
+	this.lock.Lock()
+	this.outputsLock.Lock()
+	this.outputs = append(this.outputs, newScheduledOutput(name, key, output))
+	this.outputsLock.Unlock()
+	this.lock.Unlock()
+}
+
+func newScheduledOutput(name string, key string, output Output) *scheduledOutput {
+	return &scheduledOutput{name: name, key: key, output: output, health: newComponentHealth("output", name)}
+}
+
+func (this *Scheduler) Outputs() []Output {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	outputs := make([]Output, len(this.outputs))
+	for i, o := range this.outputs {
+		outputs[i] = o.output
+	}
+	return outputs
+}
+
+/*
+ReplaceOutputs makes the outputs of a running scheduler match configs:
+outputs configured identically are kept with their state, the others are
+closed and the new ones initialized. Outputs failing to initialize are
+retried in the background and reported in the returned error.
+*/
+func (this *Scheduler) ReplaceOutputs(configs []*OutputConfig) error {
+	this.lock.Lock()
+	unused := make([]*scheduledOutput, len(this.outputs))
+	copy(unused, this.outputs)
+	this.lock.Unlock()
+
+	next := []*scheduledOutput{}
+	errs := []string{}
+	added := 0
+
+	for _, config := range configs {
+		key := config.key()
+		kept := false
+		for i, o := range unused {
+			if o.key == key {
+				next = append(next, o)
+				unused = append(unused[:i], unused[i+1:]...)
+				kept = true
+				break
+			}
+		}
+		if kept {
+			continue
+		}
+
+		options, err := config.Options()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", config.Type, err.Error()))
+			continue
+		}
+		o := newScheduledOutput(config.Type, key, options.NewOutput())
+		err = this.initOutput(o)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", config.Type, err.Error()))
+		}
+		next = append(next, o)
+		added++
+	}
+
+	/* waits for a running cycle */
+	this.lock.Lock()
+	this.outputsLock.Lock()
+	this.outputs = next
+	this.outputsLock.Unlock()
+	this.lock.Unlock()
+
+	for _, o := range unused {
+		err := o.output.Close()
+		if err != nil {
+			this.logger.With("syncer", o.name).Warnf("close output failed:%s", err.Error())
+		}
+	}
+
+	if added > 0 || len(unused) > 0 {
+		this.logger.Infof("outputs: %d kept, %d added, %d removed", len(next)-added, added, len(unused))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+/*
+Init sets up the worker and the outputs. The parts failing are retried
+with backoff once the scheduler is started, the returned error only
+reports them, so a scheduler is always started.
+*/
+func (this *Scheduler) Init() error {
+	this.ticker = time.NewTicker(this.interval)
+
+	errs := []string{}
+	err := this.initWorker()
+	if err != nil {
+		errs = append(errs, "worker: "+err.Error())
+	}
+	for _, o := range this.outputs {
+		err := this.initOutput(o)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", o.name, err.Error()))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+/*
+initWorker gives the worker one interval to connect, like a cycle to
+collect. A worker missing the deadline is closed whenever its Init
+returns and never used.
+*/
+func (this *Scheduler) initWorker() error {
+	worker := NewWorker(this.zookeeper)
+	result := make(chan error, 1)
+	go func() {
+		result <- worker.Init()
+	}()
+
+	timer := time.NewTimer(this.interval)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-result:
+	case <-timer.C:
+		err = fmt.Errorf("connecting missed the deadline of %s", this.interval)
+		go func() {
+			if <-result == nil {
+				worker.Close()
+			}
+		}()
+	}
+	if err != nil {
+		delay := this.health.fail(err)
+		metrics.IncrCounter([]string{"scheduler", "worker", "errors"}, 1)
+		this.logger.Errorf("worker failed, retry in %s:%s", delay, err.Error())
+		return err
+	}
+
+	this.worker = worker
+	this.failures = 0
+	this.health.succeed()
+	return nil
+}
+
+func (this *Scheduler) initOutput(o *scheduledOutput) error {
+	err := o.output.Init()
+	if err != nil {
+		delay := o.health.fail(err)
+		metrics.IncrCounter([]string{"output", o.name, "init_errors"}, 1)
+		this.logger.With("syncer", o.name).Errorf("output failed, retry in %s:%s", delay, err.Error())
+		return err
+	}
+
+	o.ready = true
+	o.health.succeed()
+	return nil
+}
+
+func (this *Scheduler) Start() error {
+
+	if this.ticker == nil {
+		return errors.New("not init")
+	}
+
+	this.logger.Infof("started with %d outputs every %s", len(this.outputs), this.interval)
+	this.markProgress()
+	this.started = true
+
+	go func() {
+		defer close(this.stopped)
+
+		var lastTick time.Time
+		for {
+			var retry <-chan time.Time
+			var timer *time.Timer
+			if wait, ok := this.nextRetry(); ok {
+				timer = time.NewTimer(wait)
+				retry = timer.C
+			}
+
+			select {
+
+			case t := <-this.ticker.C:
+				/* time.Ticker drops ticks while a slow cycle is running */
+				if !lastTick.IsZero() {
+					skipped := int(t.Sub(lastTick)/this.interval) - 1
+					if skipped > 0 {
+						metrics.IncrCounter([]string{"scheduler", "skipped_ticks"}, float32(skipped))
+						this.updateStats(func(stats *CycleStats) { stats.SkippedTicks += int64(skipped) })
+					}
+				}
+				lastTick = t
+				this.sync()
+
+			case <-retry:
+				this.retry()
+
+			case <-this.done:
+				return
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+
+	return nil
+}
+
+/* nextRetry returns the time until the next part is due for a retry */
+func (this *Scheduler) nextRetry() (time.Duration, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var next time.Time
+	if this.worker == nil {
+		next, _ = this.health.nextRetry()
+	}
+	for _, o := range this.outputs {
+		if o.ready {
+			continue
+		}
+		if retryAt, ok := o.health.nextRetry(); ok && (next.IsZero() || retryAt.Before(next)) {
+			next = retryAt
+		}
+	}
+
+	if next.IsZero() {
+		return 0, false
+	}
+	return next.Sub(time.Now()), true
+}
+
+/* retry sets up the worker and the outputs that are due */
+func (this *Scheduler) retry() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	if this.worker == nil && this.health.due(now) {
+		if this.collecting() {
+			/* the cycle abandoned by the watchdog still holds the old worker */
+			delay := this.health.fail(errors.New("the abandoned cycle is still running"))
+			this.logger.Warnf("the abandoned cycle is still running, new worker in %s", delay)
+		} else if this.initWorker() == nil {
+			this.logger.Infof("worker is back")
+		}
+	}
+	for _, o := range this.outputs {
+		if !o.ready && o.health.due(now) {
+			if this.initOutput(o) == nil {
+				this.logger.With("syncer", o.name).Infof("output is back")
+			}
+		}
+	}
+}
+
+/* Status returns the health of the worker and of every output */
+func (this *Scheduler) Status() []*ComponentStatus {
+	this.outputsLock.RLock()
+	defer this.outputsLock.RUnlock()
+
+	worker := this.health.Status()
+	this.statsLock.Lock()
+	stats := this.stats
+	this.statsLock.Unlock()
+	worker.Cycles = &stats
+
+	status := []*ComponentStatus{worker}
+	for _, o := range this.outputs {
+		s := o.health.Status()
+		s.Name = o.name + " " + this.cluster
+		status = append(status, s)
+	}
+	return status
+}
+
+/*
+markProgress records that the scheduler finished handling a tick, with a
+completed cycle or waiting for its worker, rather than hanging in one.
+*/
+func (this *Scheduler) markProgress() {
+	this.statsLock.Lock()
+	this.progress = time.Now()
+	this.statsLock.Unlock()
+}
+
+/*
+Stalled tells whether the scheduler stopped making progress: the ticks of
+the last three intervals were missed or overrun, or a cycle hangs on an
+output that never returns.
+*/
+func (this *Scheduler) Stalled(now time.Time) bool {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+
+	return !this.progress.IsZero() && now.Sub(this.progress) > 3*this.interval
+}
+
+func (this *Scheduler) updateStats(update func(stats *CycleStats)) {
+	this.statsLock.Lock()
+	update(&this.stats)
+	this.statsLock.Unlock()
+}
+
+/*
+sync runs one cycle. Collecting has to finish within one interval: on a
+hanging zookeeper or kafka request the cycle gives up at the deadline and
+the ticks arriving while the request still hangs are skipped as overrun.
+After schedulerMaxMisses missed deadlines in a row the watchdog closes
+the worker, which fails the hanging request, and rebuilds it.
+*/
+func (this *Scheduler) sync() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.worker == nil {
+		metrics.IncrCounter([]string{"scheduler", "skipped"}, 1)
+		this.logger.Debugf("skip sync, worker not ready")
+		this.markProgress()
+		return
+	}
+
+	if this.collecting() {
+		metrics.IncrCounter([]string{"scheduler", "overrun_ticks"}, 1)
+		this.updateStats(func(stats *CycleStats) { stats.OverrunTicks++ })
+		this.logger.Warnf("skip sync, the last cycle is still running")
+		this.missDeadline(errors.New("the last cycle is still running"))
+		return
+	}
+
+	start := time.Now()
+	defer metrics.MeasureSince([]string{"scheduler", "cycle"}, start)
+
+	this.logger.Debugf("start sync")
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.interval)
+	defer cancel()
+
+	type collected struct {
+		snapshot *Snapshot
+		err      error
+	}
+	result := make(chan collected, 1)
+	inflight := make(chan struct{})
+	worker := this.worker
+	go func() {
+		defer close(inflight)
+		snapshot, err := this.collect(ctx, worker)
+		result <- collected{snapshot, err}
+	}()
+
+	var snapshot *Snapshot
+	var err error
+	select {
+	case r := <-result:
+		snapshot, err = r.snapshot, r.err
+	case <-ctx.Done():
+		this.inflight = inflight
+		metrics.IncrCounter([]string{"scheduler", "deadline_misses"}, 1)
+		this.updateStats(func(stats *CycleStats) {
+			stats.Cycles++
+			stats.DeadlineMisses++
+			stats.LastDuration = time.Since(start).String()
+		})
+		this.logger.Errorf("collecting missed the deadline of %s", this.interval)
+		this.missDeadline(fmt.Errorf("collecting missed the deadline of %s", this.interval))
+		return
+	}
+	this.misses = 0
+
+	if err != nil {
+		metrics.IncrCounter([]string{"scheduler", "errors"}, 1)
+		this.updateStats(func(stats *CycleStats) {
+			stats.Cycles++
+			stats.Errors++
+			stats.LastDuration = time.Since(start).String()
+		})
+		this.logger.Errorf("sync failed:%s", err.Error())
+		this.markProgress()
+
+		/* the clients do not recover from every lost connection, start over with new ones */
+		this.failures++
+		if this.failures < schedulerMaxFailures {
+			this.health.degrade(err)
+			return
+		}
+		this.logger.Warnf("%d cycles failed, rebuilding worker", this.failures)
+		this.rebuildWorker(err)
+		return
+	}
+	this.failures = 0
+	this.health.succeed()
+	snapshot.Deadline = start.Add(this.interval)
+	if this.sharding == nil {
+		cacheSnapshot(snapshot)
+	}
+
+	/* outputs run side by side so a slow sink does not delay the others */
+	var wg sync.WaitGroup
+	for _, o := range this.outputs {
+		if !o.ready {
+			continue
+		}
+		wg.Add(1)
+		go func(o *scheduledOutput) {
+			defer wg.Done()
+			start := time.Now()
+			err := o.output.Write(snapshot)
+			metrics.MeasureSince([]string{"output", o.name, "write"}, start)
+			if err != nil {
+				metrics.IncrCounter([]string{"output", o.name, "errors"}, 1)
+				this.logger.With("syncer", o.name).Errorf("write failed:%s", err.Error())
+				o.health.degrade(err)
+			} else {
+				o.health.succeed()
+			}
+		}(o)
+	}
+	wg.Wait()
+
+	this.updateStats(func(stats *CycleStats) {
+		stats.Cycles++
+		stats.LastDuration = time.Since(start).String()
+		stats.LastSuccess = start
+	})
+	this.markProgress()
+	this.logger.Debugf("end sync")
+}
+
+func (this *Scheduler) missDeadline(err error) {
+	this.misses++
+	if this.misses < schedulerMaxMisses {
+		this.health.degrade(err)
+		return
+	}
+
+	metrics.IncrCounter([]string{"scheduler", "watchdog_restarts"}, 1)
+	this.updateStats(func(stats *CycleStats) { stats.WatchdogRestarts++ })
+	this.logger.Warnf("watchdog: %d deadlines missed, rebuilding worker", this.misses)
+	this.rebuildWorker(err)
+}
+
+/* collecting tells whether the collect goroutine of an abandoned cycle is still running */
+func (this *Scheduler) collecting() bool {
+	if this.inflight == nil {
+		return false
+	}
+	select {
+	case <-this.inflight:
+		this.inflight = nil
+		return false
+	default:
+		return true
+	}
+}
+
+/*
+rebuildWorker closes the worker, which fails a hanging request, a new one
+is set up by retry after the backoff once the abandoned cycle returned
+*/
+func (this *Scheduler) rebuildWorker(err error) {
+	if this.worker != nil {
+		this.worker.Close()
+	}
+	this.worker = nil
+	this.failures = 0
+	this.misses = 0
+	this.health.fail(err)
+}
+
+func (this *Scheduler) collect(ctx context.Context, worker *Worker) (*Snapshot, error) {
+	now := time.Now()
+
+	latestOffset, err := worker.GetLatestOffsetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var filter func(group string) bool
+	if this.sharding != nil {
+		filter = func(group string) bool { return this.sharding.OwnsGroup(this.zookeeper, group) }
+	}
+	groupOffset, err := worker.GetConsumerGroupsOffsetContext(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	brokers, err := worker.BrokerList()
+	if err != nil {
+		return nil, err
+	}
+
+	distance := ComputeConsumerGroupsOffsetDistance(latestOffset, groupOffset)
+
+	skipTopics, member := false, ""
+	if this.sharding != nil {
+		skipTopics = !this.sharding.OwnsLatestOffset(this.zookeeper)
+		if this.sharding.GroupsSharded() {
+			member = this.sharding.Id()
+		}
+	}
+
+	return &Snapshot{
+		Cluster:               this.cluster,
+		Zookeeper:             this.zookeeper,
+		Brokers:               brokers,
+		Time:                  now,
+		LatestOffset:          latestOffset,
+		ConsumerGroupOffset:   groupOffset,
+		ConsumerGroupDistance: distance,
+		SkipTopics:            skipTopics,
+		ShardMember:           member,
+	}, nil
+}
+
+func (this *Scheduler) Close() error {
+	return this.Shutdown(context.Background())
+}
+
+/*
+Shutdown stops the ticker and lets a running cycle finish its writes
+until ctx is done, then closes the outputs, which flush what they buffer,
+and the worker last. A cycle still running at the deadline is left
+alone: its outputs and worker are not closed under it. Only the first
+call does anything, a scheduler never started is closed at once.
+*/
+func (this *Scheduler) Shutdown(ctx context.Context) error {
+	first := false
+	this.stopOnce.Do(func() {
+		first = true
+		close(this.done)
+	})
+	if !first {
+		return nil
+	}
+
+	if this.ticker != nil {
+		this.ticker.Stop()
+	}
+	if this.started {
+		select {
+		case <-this.stopped:
+		case <-ctx.Done():
+			this.logger.Warnf("the running cycle did not finish in time, leaving it")
+			return ctx.Err()
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, o := range this.outputs {
+		err := o.output.Close()
+		if err != nil {
+			this.logger.With("syncer", o.name).Warnf("close output failed:%s", err.Error())
+		}
+	}
+	if this.worker != nil {
+		err := this.worker.Close()
+		if err != nil {
+			this.logger.Warnf("close worker failed:%s", err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerShutdown(t *testing.T) {
+	for _, started := range []bool{false, true} {
+		/* nothing listens there, the worker misses its deadline */
+		scheduler := NewScheduler("127.0.0.1:1", "", 50*time.Millisecond)
+		start := time.Now()
+		if err := scheduler.Init(); err == nil {
+			t.Fatalf("worker connected to nothing")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("init took %s", elapsed)
+		}
+		if started {
+			if err := scheduler.Start(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			scheduler.Close()
+			scheduler.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("closing a scheduler started %v hangs", started)
+		}
+	}
+}
@@ -1,19 +1,67 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var serverManagerLog = NewLogger("server_manager")
+
 type ServerManager struct {
-	HttpServers     []*HttpServer
-	InfluxdbSyncers []*InfluxdbSyncer
+	HttpServers []*HttpServer
+	Schedulers  []*Scheduler
+	Election    *Election
+	Sharding    *Sharding
+
+	/* with an election or sharding the schedulers only run what this instance owns */
+	lock          sync.Mutex
+	leading       bool
+	outputConfigs []*OutputConfig
+	closing       bool
+
+	notifier *systemdNotifier
 }
 
 func (this *ServerManager) AddHttpServer(server *HttpServer) {
 	this.HttpServers = append(this.HttpServers, server)
 }
 
-func (this *ServerManager) AddInfluxdbSyncer(server *InfluxdbSyncer) {
-	this.InfluxdbSyncers = append(this.InfluxdbSyncers, server)
+func (this *ServerManager) AddScheduler(scheduler *Scheduler) {
+	this.Schedulers = append(this.Schedulers, scheduler)
+}
+
+/* SetElection makes outputs run only on the instance elected leader */
+func (this *ServerManager) SetElection(election *Election, outputs []*OutputConfig) {
+	this.Election = election
+	this.outputConfigs = outputs
+}
+
+/* SetSharding makes outputs run only on the instance owning their cluster */
+func (this *ServerManager) SetSharding(sharding *Sharding, outputs []*OutputConfig) {
+	this.Sharding = sharding
+	this.outputConfigs = outputs
+}
+
+func (this *ServerManager) outputs() []Output {
+	outputs := []Output{}
+	for _, scheduler := range this.Schedulers {
+		outputs = append(outputs, scheduler.Outputs()...)
+	}
+	return outputs
 }
 
 func (this *ServerManager) Init() error {
+	for _, server := range this.HttpServers {
+		server.SetOutputs(this.outputs())
+		server.SetElection(this.Election)
+		server.SetSharding(this.Sharding)
+		server.SetComponents(this.Status)
+	}
+
 	for _, server := range this.HttpServers {
 		err := server.Init()
 
@@ -22,12 +70,28 @@ func (this *ServerManager) Init() error {
 		}
 	}
 
-	for _, server := range this.InfluxdbSyncers {
+	/* a failing scheduler is started anyway, it keeps retrying on its own */
+	for _, scheduler := range this.Schedulers {
 
-		err := server.Init()
+		err := scheduler.Init()
 
 		if err != nil {
-			return err
+			serverManagerLog.With("scheduler", scheduler.Key()).Warnf("scheduler is degraded:%s", err.Error())
+		}
+	}
+
+	/* without zookeeper this instance runs no outputs, Start keeps connecting */
+	if this.Election != nil {
+		err := this.Election.Init()
+		if err != nil {
+			serverManagerLog.Warnf("election is degraded:%s", err.Error())
+		}
+	}
+
+	if this.Sharding != nil {
+		err := this.Sharding.Init()
+		if err != nil {
+			serverManagerLog.Warnf("sharding is degraded:%s", err.Error())
 		}
 	}
 
@@ -42,30 +106,377 @@ func (this *ServerManager) Start() error {
 		}
 	}
 
-	for _, server := range this.InfluxdbSyncers {
-		err := server.Start()
+	for _, scheduler := range this.Schedulers {
+		err := scheduler.Start()
 		if err != nil {
 			return err
 		}
 	}
 
+	if this.Election != nil {
+		err := this.Election.Start(this.leaderChanged)
+		if err != nil {
+			return err
+		}
+	}
+
+	if this.Sharding != nil {
+		err := this.Sharding.Start(this.shardsChanged)
+		if err != nil {
+			return err
+		}
+	}
+
+	this.notifier = newSystemdNotifier(this)
+	return this.notifier.Start()
+}
+
+/* the outputs this instance runs, every configured one without election and sharding */
+func (this *ServerManager) ownedOutputs() []*OutputConfig {
+	if this.Election != nil && !this.leading {
+		return nil
+	}
+	if this.Sharding == nil {
+		return this.outputConfigs
+	}
+
+	owned := []*OutputConfig{}
+	for _, config := range this.outputConfigs {
+		config.setDefaults()
+		if this.Sharding.OwnsCluster(config.Zookeeper) {
+			owned = append(owned, config)
+		}
+	}
+	return owned
+}
+
+/* starts the outputs on becoming the leader and stops them on losing it */
+func (this *ServerManager) leaderChanged(isLeader bool) {
+	this.lock.Lock()
+
+	if isLeader == this.leading || this.closing {
+		this.lock.Unlock()
+		return
+	}
+	this.leading = isLeader
+
+	var errs []string
+	var stopped []*Scheduler
+	if isLeader {
+		serverManagerLog.Infof("elected leader, starting outputs")
+		errs, stopped = this.applyOutputs(this.ownedOutputs())
+	} else {
+		serverManagerLog.Infof("not the leader any more, stopping outputs")
+		errs, stopped = this.applyOutputs(nil)
+	}
+	this.lock.Unlock()
+
+	stopSchedulers(stopped)
+	if len(errs) > 0 {
+		serverManagerLog.Errorf("start outputs failed:%s", strings.Join(errs, "; "))
+	}
+}
+
+/* moves the outputs of the clusters that changed owner */
+func (this *ServerManager) shardsChanged() {
+	this.lock.Lock()
+
+	if this.closing {
+		this.lock.Unlock()
+		return
+	}
+
+	owned := this.ownedOutputs()
+	serverManagerLog.Infof("members changed, running %d of %d outputs", len(owned), len(this.outputConfigs))
+	errs, stopped := this.applyOutputs(owned)
+	this.lock.Unlock()
+
+	stopSchedulers(stopped)
+	if len(errs) > 0 {
+		serverManagerLog.Errorf("start outputs failed:%s", strings.Join(errs, "; "))
+	}
+}
+
+/*
+Reload applies a validated config to the running servers: the http server
+is replaced only if its config changed, schedulers are matched by
+zookeeper, cluster and interval and keep their unchanged outputs. Parts
+failing to start are left out and reported in the returned error, the
+rest of the new config is applied anyway. With an election or sharding
+only the outputs this instance owns are started, the others are kept for
+when it becomes their owner.
+*/
+func (this *ServerManager) Reload(config *Config) error {
+	this.lock.Lock()
+
+	/* http server */
+	stoppedServers, errs := this.reloadHttpServer(&config.HttpServer)
+
+	/* election and sharding */
+	if config.Election.Zookeeper != "" {
+		config.Election.setDefaults()
+	}
+	if this.Election == nil && config.Election.Zookeeper != "" || this.Election != nil && *this.Election.config != config.Election {
+		serverManagerLog.Warnf("reload: election changes take effect after a restart")
+	}
+	if config.Sharding.Zookeeper != "" {
+		config.Sharding.setDefaults()
+	}
+	if this.Sharding == nil && config.Sharding.Zookeeper != "" || this.Sharding != nil && *this.Sharding.config != config.Sharding {
+		serverManagerLog.Warnf("reload: sharding changes take effect after a restart")
+	}
+
+	/* schedulers */
+	this.outputConfigs = config.AllOutputs()
+	schedulerErrs, stopped := this.applyOutputs(this.ownedOutputs())
+	errs = append(errs, schedulerErrs...)
+	this.lock.Unlock()
+
+	/* what was replaced drains without the lock, the status page and the systemd notifier need it */
+	for _, server := range stoppedServers {
+		serverManagerLog.Infof("reload: stop http server on %s", server.config.ListenAddr)
+		server.Close()
+	}
+	stopSchedulers(stopped)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
 	return nil
 }
 
-func (this *ServerManager) Close() error {
-	for _, server := range this.HttpServers {
-		err := server.Close()
+/*
+reloadHttpServer starts the http server of config before the one it
+replaces is stopped, the old one keeps serving if the new one can't
+listen. Only when both need the same address is the old one stopped
+first. It returns the servers left to stop.
+*/
+func (this *ServerManager) reloadHttpServer(config *HttpServerConfig) ([]*HttpServer, []string) {
+	kept := []*HttpServer{}
+	replaced := []*HttpServer{}
+	for _, old := range this.HttpServers {
+		if config.ListenAddr != "" && *old.config == *NewHttpServer(config).config {
+			kept = append(kept, old)
+			continue
+		}
+		replaced = append(replaced, old)
+	}
+	if config.ListenAddr == "" || len(kept) > 0 {
+		this.HttpServers = kept
+		return replaced, nil
+	}
+
+	serverManagerLog.Infof("reload: start http server on %s", config.ListenAddr)
+	server := NewHttpServer(config)
+	server.SetElection(this.Election)
+	server.SetSharding(this.Sharding)
+	server.SetComponents(this.Status)
+	err := server.Init()
+	if err == nil {
+		err = server.Start()
+		if err != nil && sharesHttpAddr(replaced, config) {
+			for _, old := range replaced {
+				serverManagerLog.Infof("reload: stop http server on %s to free its address", old.config.ListenAddr)
+				old.Close()
+			}
+			replaced = nil
+			err = server.Start()
+		}
+	}
+	if err != nil {
+		this.HttpServers = replaced
+		return nil, []string{fmt.Sprintf("http server %s: %s", config.ListenAddr, err.Error())}
+	}
+
+	this.HttpServers = []*HttpServer{server}
+	return replaced, nil
+}
+
+/* sharesHttpAddr tells if one of servers listens on an address config needs */
+func sharesHttpAddr(servers []*HttpServer, config *HttpServerConfig) bool {
+	for _, server := range servers {
+		for _, addr := range []string{server.config.ListenAddr, server.config.AdminListenAddr} {
+			if addr != "" && (addr == config.ListenAddr || addr == config.AdminListenAddr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+applyOutputs makes the running schedulers match configs, keeping the
+schedulers and outputs that did not change. It returns the errors of the
+parts that failed to start, the rest is applied anyway, and the schedulers
+no longer running, for the caller to stop once it released the lock.
+*/
+func (this *ServerManager) applyOutputs(configs []*OutputConfig) ([]string, []*Scheduler) {
+	errs := []string{}
+
+	running := map[string]*Scheduler{}
+	for _, scheduler := range this.Schedulers {
+		running[scheduler.Key()] = scheduler
+	}
+
+	schedulers := []*Scheduler{}
+	keys, groups := groupOutputConfigs(configs)
+	for _, key := range keys {
+		configs := groups[key]
+
+		interval, err := time.ParseDuration(configs[0].Interval)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Sprintf("scheduler %s: %s", key, err.Error()))
+			continue
+		}
+		runningKey := NewScheduler(configs[0].Zookeeper, configs[0].Cluster, interval).Key()
+		if old, ok := running[runningKey]; ok {
+			delete(running, runningKey)
+			err = old.ReplaceOutputs(configs)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("scheduler %s: %s", key, err.Error()))
+			}
+			schedulers = append(schedulers, old)
+			continue
+		}
+
+		serverManagerLog.Infof("start scheduler for %s", key)
+		scheduler, err := newSchedulerFromConfigs(configs)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("scheduler %s: %s", key, err.Error()))
+			continue
+		}
+		scheduler.SetSharding(this.Sharding)
+		err = scheduler.Init()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("scheduler %s is degraded: %s", key, err.Error()))
+		}
+		err = scheduler.Start()
+		if err != nil {
+			scheduler.Close()
+			errs = append(errs, fmt.Sprintf("scheduler %s: %s", key, err.Error()))
+			continue
+		}
+		schedulers = append(schedulers, scheduler)
+	}
+
+	stopped := []*Scheduler{}
+	for _, scheduler := range running {
+		stopped = append(stopped, scheduler)
+	}
+	this.Schedulers = schedulers
+
+	for _, server := range this.HttpServers {
+		server.SetOutputs(this.outputs())
+	}
+
+	return errs, stopped
+}
+
+/* stopSchedulers closes the schedulers applyOutputs took out, each flushing its last cycle */
+func stopSchedulers(schedulers []*Scheduler) {
+	for _, scheduler := range schedulers {
+		serverManagerLog.Infof("stop scheduler for %s", scheduler.Key())
+		scheduler.Close()
+	}
+}
+
+/*
+Status returns the health of the election or sharding, of the workers and
+outputs of every scheduler and of the cluster breakers
+*/
+func (this *ServerManager) Status() []*ComponentStatus {
+	this.lock.Lock()
+	schedulers := this.Schedulers
+	this.lock.Unlock()
+
+	status := []*ComponentStatus{}
+	if this.Election != nil {
+		status = append(status, this.Election.Health())
+	}
+	if this.Sharding != nil {
+		status = append(status, this.Sharding.Health())
+	}
+	for _, scheduler := range schedulers {
+		status = append(status, scheduler.Status()...)
+	}
+	return append(status, breakerStatus()...)
+}
+
+/* stalledSchedulers returns the keys of the schedulers that stopped making progress */
+func (this *ServerManager) stalledSchedulers() []string {
+	this.lock.Lock()
+	schedulers := this.Schedulers
+	this.lock.Unlock()
+
+	now := time.Now()
+	stalled := []string{}
+	for _, scheduler := range schedulers {
+		if scheduler.Stalled(now) {
+			stalled = append(stalled, scheduler.Key())
 		}
 	}
+	return stalled
+}
+
+func (this *ServerManager) Close() error {
+	return this.Shutdown(context.Background())
+}
+
+/*
+Shutdown stops in order: the http servers stop accepting connections and
+drain the requests in flight, the schedulers finish their running cycle
+and flush their outputs before closing their workers, and only then this
+instance leaves the election or sharding, so the others take over once
+its last data is written. Whatever is still running when ctx is done is
+left behind.
+*/
+func (this *ServerManager) Shutdown(ctx context.Context) error {
+	if this.notifier != nil {
+		this.notifier.Close()
+	}
 
-	for _, server := range this.InfluxdbSyncers {
-		err := server.Close()
+	this.lock.Lock()
+	this.closing = true
+	servers := this.HttpServers
+	schedulers := this.Schedulers
+	this.lock.Unlock()
+
+	errs := []string{}
+	for _, server := range servers {
+		serverManagerLog.Infof("shutdown: draining http server on %s", server.config.ListenAddr)
+		err := server.Shutdown(ctx)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Sprintf("http server %s: %s", server.config.ListenAddr, err.Error()))
 		}
 	}
 
+	/* side by side, so a slow output does not use up the time of the others */
+	serverManagerLog.Infof("shutdown: stopping %d schedulers", len(schedulers))
+	var wg sync.WaitGroup
+	var errsLock sync.Mutex
+	for _, scheduler := range schedulers {
+		wg.Add(1)
+		go func(scheduler *Scheduler) {
+			defer wg.Done()
+			err := scheduler.Shutdown(ctx)
+			if err != nil {
+				errsLock.Lock()
+				errs = append(errs, fmt.Sprintf("scheduler %s: %s", scheduler.Key(), err.Error()))
+				errsLock.Unlock()
+			}
+		}(scheduler)
+	}
+	wg.Wait()
+
+	if this.Election != nil {
+		this.Election.Close()
+	}
+	if this.Sharding != nil {
+		this.Sharding.Close()
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
 	return nil
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+/* freeAddr returns a local address nothing listens on */
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func serving(addr string, pattern string) bool {
+	res, err := http.Get("http://" + addr + pattern)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == 200
+}
+
+func TestReloadHttpServer(t *testing.T) {
+	first := freeAddr(t)
+	manager := &ServerManager{}
+	if err := manager.Reload(&Config{HttpServer: HttpServerConfig{ListenAddr: first}}); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	if !serving(first, "/health") {
+		t.Fatalf("not serving on %s", first)
+	}
+
+	/* the old server keeps serving when the new one can't listen */
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if err := manager.Reload(&Config{HttpServer: HttpServerConfig{ListenAddr: busy.Addr().String()}}); err == nil {
+		t.Errorf("reload on a busy address succeeded")
+	}
+	if len(manager.HttpServers) != 1 || !serving(first, "/health") {
+		t.Fatalf("old server stopped")
+	}
+
+	/* a new address is served before the old one stops */
+	second := freeAddr(t)
+	if err := manager.Reload(&Config{HttpServer: HttpServerConfig{ListenAddr: second}}); err != nil {
+		t.Fatal(err)
+	}
+	if !serving(second, "/health") || serving(first, "/health") {
+		t.Errorf("serving %s: %v, %s: %v", second, serving(second, "/health"), first, serving(first, "/health"))
+	}
+
+	/* the same address is freed by the old server first */
+	if err := manager.Reload(&Config{HttpServer: HttpServerConfig{ListenAddr: second, PatternHealth: "/healthz"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !serving(second, "/healthz") {
+		t.Errorf("new pattern not served on %s", second)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+type ShardingConfig struct {
+	Zookeeper      string `json:"zookeeper"`
+	Path           string `json:"path"`
+	SessionTimeout string `json:"sessionTimeout"`
+	Id             string `json:"id"`
+	AdvertiseAddr  string `json:"advertiseAddr"`
+	By             string `json:"by"`
+	VirtualNodes   int    `json:"virtualNodes"`
+}
+
+func (this *ShardingConfig) setDefaults() {
+	if this.Path == "" {
+		this.Path = "/kafka-offset-mon/shards"
+	}
+	if this.SessionTimeout == "" {
+		this.SessionTimeout = "10s"
+	}
+	if this.Id == "" {
+		hostname, _ := os.Hostname()
+		this.Id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if this.By == "" {
+		this.By = "cluster"
+	}
+	if this.VirtualNodes == 0 {
+		this.VirtualNodes = 100
+	}
+}
+
+func (this *ShardingConfig) Validate() error {
+	if this.Zookeeper == "" {
+		return nil
+	}
+	if this.Path != "" && (!strings.HasPrefix(this.Path, "/") || strings.HasSuffix(this.Path, "/")) {
+		return fmt.Errorf("invalid path %q: should start and not end with /", this.Path)
+	}
+	switch this.By {
+	case "", "cluster", "group":
+	default:
+		return fmt.Errorf("unknown by %s, should be cluster or group", this.By)
+	}
+	if this.VirtualNodes < 0 {
+		return fmt.Errorf("invalid virtualNodes %d", this.VirtualNodes)
+	}
+	err := validateAddr("advertiseAddr", this.AdvertiseAddr)
+	if err != nil {
+		return err
+	}
+	return validateDuration("sessionTimeout", this.SessionTimeout)
+}
+
+/* advertiseAddr is where the other members reach an http server listening on listenAddr */
+func advertiseAddr(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host, _ = os.Hostname()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+type ShardMember struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type ShardingStatus struct {
+	Id      string         `json:"id"`
+	By      string         `json:"by"`
+	Joined  bool           `json:"joined"`
+	Members []*ShardMember `json:"members"`
+}
+
+/*
+Sharding splits the monitored clusters, or the consumer groups of every
+cluster, among the monitor instances sharing a zookeeper path. Each key
+belongs to one member by consistent hashing, so a member joining or
+leaving only moves the keys it takes or leaves. An instance disconnected
+from zookeeper owns nothing, its keys go to the others once its session
+expires.
+*/
+type Sharding struct {
+	config     *ShardingConfig
+	membership *zkMembership
+	onChange   func()
+	logger     *Logger
+
+	lock    sync.RWMutex
+	joined  bool
+	members []*ShardMember
+	ring    *hashRing
+}
+
+func NewSharding(config *ShardingConfig) *Sharding {
+	config.setDefaults()
+
+	timeout, err := time.ParseDuration(config.SessionTimeout)
+	if err != nil {
+		timeout = time.Second * 10
+	}
+
+	data, _ := json.Marshal(&ShardMember{Id: config.Id, Addr: config.AdvertiseAddr})
+
+	logger := NewLogger("sharding").With("id", config.Id)
+
+	return &Sharding{
+		config:     config,
+		logger:     logger,
+		membership: newZkMembership(logger, "sharding", config.Zookeeper, config.Path, data, timeout),
+		ring:       newHashRing(nil, config.VirtualNodes),
+	}
+}
+
+func (this *Sharding) Init() error {
+	return this.membership.Init()
+}
+
+/* Start joins in the background, onChange is called whenever the owners may have changed */
+func (this *Sharding) Start(onChange func()) error {
+	this.onChange = onChange
+
+	err := this.membership.Start(this.membersChanged)
+	if err != nil {
+		return err
+	}
+
+	this.logger.Infof("sharding by %s for %s started", this.config.By, this.membership.path)
+	return nil
+}
+
+func (this *Sharding) membersChanged(zkMembers []zkMember, self int) {
+	members := []*ShardMember{}
+	for _, zkMember := range zkMembers {
+		member := &ShardMember{}
+		err := json.Unmarshal(zkMember.data, member)
+		if err != nil || member.Id == "" {
+			this.logger.Warnf("ignore member %s with bad data %q", zkMember.node, zkMember.data)
+			continue
+		}
+		members = append(members, member)
+	}
+	sort.Sort(shardMembersById(members))
+	joined := self >= 0
+
+	this.lock.Lock()
+	if joined == this.joined && sameShardMembers(members, this.members) {
+		this.lock.Unlock()
+		return
+	}
+	this.joined = joined
+	this.members = members
+	this.ring = newHashRing(members, this.config.VirtualNodes)
+	this.lock.Unlock()
+
+	metrics.SetGauge([]string{"sharding", "members"}, float32(len(members)))
+	if joined {
+		this.logger.Infof("%d members:%s", len(members), shardMemberIds(members))
+	} else {
+		this.logger.Warnf("no member, owning nothing")
+	}
+
+	this.onChange()
+}
+
+/* Owner returns the member owning key, nil while this instance is no member */
+func (this *Sharding) Owner(key string) *ShardMember {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if !this.joined {
+		return nil
+	}
+	return this.ring.owner(key)
+}
+
+func (this *Sharding) Id() string {
+	return this.config.Id
+}
+
+func (this *Sharding) IsSelf(member *ShardMember) bool {
+	return member != nil && member.Id == this.config.Id
+}
+
+func (this *Sharding) owns(key string) bool {
+	return this.IsSelf(this.Owner(key))
+}
+
+/* GroupsSharded tells whether the consumer groups of a cluster are split among the members */
+func (this *Sharding) GroupsSharded() bool {
+	return this.config.By == "group"
+}
+
+/* OwnsCluster tells whether this instance collects the cluster at all */
+func (this *Sharding) OwnsCluster(zookeeper string) bool {
+	if this.GroupsSharded() {
+		this.lock.RLock()
+		defer this.lock.RUnlock()
+		return this.joined
+	}
+	return this.owns(zookeeper)
+}
+
+/* OwnsLatestOffset tells whether this instance reports the topics of the cluster */
+func (this *Sharding) OwnsLatestOffset(zookeeper string) bool {
+	return this.owns(zookeeper)
+}
+
+func (this *Sharding) OwnsGroup(zookeeper string, group string) bool {
+	if this.GroupsSharded() {
+		return this.owns(zookeeper + "|" + group)
+	}
+	return this.owns(zookeeper)
+}
+
+func (this *Sharding) Members() []*ShardMember {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return append([]*ShardMember{}, this.members...)
+}
+
+func (this *Sharding) Status() *ShardingStatus {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return &ShardingStatus{
+		Id:      this.config.Id,
+		By:      this.config.By,
+		Joined:  this.joined,
+		Members: append([]*ShardMember{}, this.members...),
+	}
+}
+
+/* Health is the state of the connection to zookeeper, as shown on the status page */
+func (this *Sharding) Health() *ComponentStatus {
+	return this.membership.health.Status()
+}
+
+/* Close leaves the members, the others take over at once */
+func (this *Sharding) Close() error {
+	return this.membership.Close()
+}
+
+/* hashRing places every member at virtualNodes points of a circle */
+type hashRing struct {
+	points []uint32
+	owners map[uint32]*ShardMember
+}
+
+/* members must be sorted by id, so colliding points go to the same member everywhere */
+func newHashRing(members []*ShardMember, virtualNodes int) *hashRing {
+	ring := &hashRing{owners: map[uint32]*ShardMember{}}
+	for _, member := range members {
+		for i := 0; i < virtualNodes; i++ {
+			point := ringHash(member.Id + "#" + strconv.Itoa(i))
+			if _, ok := ring.owners[point]; ok {
+				continue
+			}
+			ring.owners[point] = member
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Sort(uint32s(ring.points))
+	return ring
+}
+
+/* the owner of key is the first member point clockwise from the key */
+func (this *hashRing) owner(key string) *ShardMember {
+	if len(this.points) == 0 {
+		return nil
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(this.points), func(i int) bool { return this.points[i] >= hash })
+	if i == len(this.points) {
+		i = 0
+	}
+	return this.owners[this.points[i]]
+}
+
+/* md5 spreads the similar ids and keys far better than crc32 */
+func ringHash(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+type uint32s []uint32
+
+func (this uint32s) Len() int           { return len(this) }
+func (this uint32s) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this uint32s) Less(i, j int) bool { return this[i] < this[j] }
+
+type shardMembersById []*ShardMember
+
+func (this shardMembersById) Len() int           { return len(this) }
+func (this shardMembersById) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this shardMembersById) Less(i, j int) bool { return this[i].Id < this[j].Id }
+
+func sameShardMembers(a []*ShardMember, b []*ShardMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func shardMemberIds(members []*ShardMember) string {
+	ids := []string{}
+	for _, member := range members {
+		ids = append(ids, member.Id)
+	}
+	return strings.Join(ids, ",")
+}
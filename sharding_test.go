@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testShardMembers(n int) []*ShardMember {
+	members := []*ShardMember{}
+	for i := 0; i < n; i++ {
+		members = append(members, &ShardMember{Id: fmt.Sprintf("member-%02d", i)})
+	}
+	return members
+}
+
+func testRingOwners(ring *hashRing, keys int) map[string]string {
+	owners := map[string]string{}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("zk%d/kafka|group-%d", i%3, i)
+		if owner := ring.owner(key); owner != nil {
+			owners[key] = owner.Id
+		}
+	}
+	return owners
+}
+
+func TestHashRingOwner(t *testing.T) {
+	if owner := newHashRing(nil, 100).owner("key"); owner != nil {
+		t.Errorf("empty ring owner = %s, want nil", owner.Id)
+	}
+	if owner := newHashRing(testShardMembers(3), 0).owner("key"); owner != nil {
+		t.Errorf("ring without virtual nodes owner = %s, want nil", owner.Id)
+	}
+
+	single := testShardMembers(1)
+	for key, id := range testRingOwners(newHashRing(single, 10), 100) {
+		if id != single[0].Id {
+			t.Errorf("single member ring: %s owned by %s", key, id)
+		}
+	}
+
+	/* the owners only depend on the member ids */
+	a := testRingOwners(newHashRing(testShardMembers(5), 100), 1000)
+	b := testRingOwners(newHashRing(testShardMembers(5), 100), 1000)
+	if len(a) != 1000 {
+		t.Fatalf("%d keys owned, want 1000", len(a))
+	}
+	for key, id := range a {
+		if b[key] != id {
+			t.Errorf("%s owned by %s and %s", key, id, b[key])
+		}
+	}
+}
+
+func TestHashRingBalance(t *testing.T) {
+	members := testShardMembers(4)
+	counts := map[string]int{}
+	for _, id := range testRingOwners(newHashRing(members, 100), 10000) {
+		counts[id]++
+	}
+	for _, member := range members {
+		/* 2500 each when perfectly balanced */
+		if counts[member.Id] < 1500 || counts[member.Id] > 3500 {
+			t.Errorf("%s owns %d of 10000 keys", member.Id, counts[member.Id])
+		}
+	}
+}
+
+func TestHashRingMovesOnlyChangedMember(t *testing.T) {
+	members := testShardMembers(5)
+	before := testRingOwners(newHashRing(members[:4], 100), 5000)
+
+	/* a joining member only takes keys */
+	after := testRingOwners(newHashRing(members, 100), 5000)
+	moved := 0
+	for key, id := range after {
+		if id == before[key] {
+			continue
+		}
+		moved++
+		if id != members[4].Id {
+			t.Errorf("%s moved from %s to %s", key, before[key], id)
+		}
+	}
+	if moved == 0 {
+		t.Errorf("no key moved to the new member")
+	}
+
+	/* a leaving member only gives its keys away */
+	left := testRingOwners(newHashRing(append(members[:1:1], members[2:]...), 100), 5000)
+	for key, id := range after {
+		if id != members[1].Id && left[key] != id {
+			t.Errorf("%s moved from %s to %s", key, id, left[key])
+		}
+		if left[key] == members[1].Id {
+			t.Errorf("%s still owned by the member that left", key)
+		}
+	}
+}
+
+func testSharding(by string, self string, ids ...string) *Sharding {
+	sharding := NewSharding(&ShardingConfig{Zookeeper: "127.0.0.1:2181", Id: self, By: by})
+	sharding.onChange = func() {}
+
+	zkMembers := []zkMember{}
+	index := -1
+	for i, id := range ids {
+		if id == self {
+			index = i
+		}
+		zkMembers = append(zkMembers, zkMember{node: fmt.Sprintf("m%010d", i), data: []byte(`{"id":"` + id + `"}`)})
+	}
+	sharding.membersChanged(zkMembers, index)
+	return sharding
+}
+
+func TestShardingOwners(t *testing.T) {
+	clusters := []string{"zk1:2181/kafka", "zk2:2181/kafka", "zk3:2181/kafka", "zk4:2181/kafka"}
+	groups := []string{}
+	for i := 0; i < 50; i++ {
+		groups = append(groups, fmt.Sprintf("group-%d", i))
+	}
+
+	for _, by := range []string{"cluster", "group"} {
+		ids := []string{"a", "b", "c"}
+		shardings := []*Sharding{}
+		for _, id := range ids {
+			shardings = append(shardings, testSharding(by, id, ids...))
+		}
+
+		for _, zookeeper := range clusters {
+			latest, collecting := 0, 0
+			for _, sharding := range shardings {
+				if sharding.OwnsLatestOffset(zookeeper) {
+					latest++
+				}
+				if sharding.OwnsCluster(zookeeper) {
+					collecting++
+				}
+			}
+			if latest != 1 {
+				t.Errorf("by %s: %d members own the topics of %s, want 1", by, latest, zookeeper)
+			}
+			if by == "cluster" && collecting != 1 || by == "group" && collecting != len(ids) {
+				t.Errorf("by %s: %d members collect %s", by, collecting, zookeeper)
+			}
+
+			for _, group := range groups {
+				owners := 0
+				for _, sharding := range shardings {
+					if sharding.OwnsGroup(zookeeper, group) {
+						owners++
+						if by == "cluster" && !sharding.OwnsCluster(zookeeper) {
+							t.Errorf("by cluster: %s owns %s of %s without the cluster", sharding.Id(), group, zookeeper)
+						}
+					}
+				}
+				if owners != 1 {
+					t.Errorf("by %s: %d members own %s of %s, want 1", by, owners, group, zookeeper)
+				}
+			}
+		}
+	}
+
+	/* members agree on the owner whatever order zookeeper lists them in */
+	a := testSharding("group", "a", "a", "b", "c")
+	c := testSharding("group", "c", "c", "b", "a")
+	for _, group := range groups {
+		if x, y := a.Owner(group), c.Owner(group); x.Id != y.Id {
+			t.Errorf("%s owned by %s and %s", group, x.Id, y.Id)
+		}
+	}
+
+	/* an instance that is no member owns nothing */
+	outside := testSharding("group", "d", "a", "b", "c")
+	if outside.Owner("key") != nil || outside.OwnsCluster(clusters[0]) || outside.OwnsLatestOffset(clusters[0]) {
+		t.Errorf("instance outside the members owns keys")
+	}
+	outside.membersChanged(nil, -1)
+	if outside.Owner("key") != nil {
+		t.Errorf("instance without members owns keys")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/* the datasets of a cluster served by the http api */
+const (
+	kindLatestOffset          = "latest_offset"
+	kindConsumerGroupOffset   = "consumer_group_offset"
+	kindConsumerGroupDistance = "consumer_group_distance"
+)
+
+type cachedData struct {
+	data interface{}
+	time time.Time
+}
+
+/*
+snapshotCache keeps the last complete dataset read from every cluster, by
+a scheduler or by the http api, so the http api can still answer while
+the breaker of the cluster is open.
+*/
+var snapshotCache = struct {
+	sync.RWMutex
+	entries map[string]*cachedData
+}{entries: map[string]*cachedData{}}
+
+func cacheData(zookeeper string, kind string, data interface{}, t time.Time) {
+	snapshotCache.Lock()
+	defer snapshotCache.Unlock()
+
+	key := zookeeper + "|" + kind
+	if old, ok := snapshotCache.entries[key]; ok && old.time.After(t) {
+		return
+	}
+	snapshotCache.entries[key] = &cachedData{data: data, time: t}
+}
+
+func cacheSnapshot(snapshot *Snapshot) {
+	cacheData(snapshot.Zookeeper, kindLatestOffset, snapshot.LatestOffset, snapshot.Time)
+	cacheData(snapshot.Zookeeper, kindConsumerGroupOffset, snapshot.ConsumerGroupOffset, snapshot.Time)
+	cacheData(snapshot.Zookeeper, kindConsumerGroupDistance, snapshot.ConsumerGroupDistance, snapshot.Time)
+}
+
+func getCachedData(zookeeper string, kind string) (*cachedData, bool) {
+	snapshotCache.RLock()
+	defer snapshotCache.RUnlock()
+
+	cached, ok := snapshotCache.entries[zookeeper+"|"+kind]
+	return cached, ok
+}
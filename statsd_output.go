@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/armon/go-metrics"
+)
+
+func init() {
+	RegisterOutput("statsd", "5s", func() OutputOptions { return &StatsdOutputConfig{} })
+}
+
+type StatsdOutputConfig struct {
+	StatsdHost   string            `json:"statsdHost"`
+	StatsdFlavor string            `json:"statsdFlavor"`
+	StatsdPrefix string            `json:"statsdPrefix"`
+	StatsdMTU    int               `json:"statsdMtu"`
+	StatsdTags   map[string]string `json:"statsdTags"`
+
+	Labels    map[string]string     `json:"labels"`
+	Templates MetricTemplatesConfig `json:"templates"`
+}
+
+func (this *StatsdOutputConfig) Validate() error {
+	switch this.StatsdFlavor {
+	case "", "statsd", "dogstatsd":
+	default:
+		return fmt.Errorf("unknown statsdFlavor %s, should be statsd or dogstatsd", this.StatsdFlavor)
+	}
+	if this.StatsdMTU < 0 {
+		return fmt.Errorf("invalid statsdMtu %d", this.StatsdMTU)
+	}
+	err := validateAddr("statsdHost", this.StatsdHost)
+	if err != nil {
+		return err
+	}
+	if this.Templates.ConsumerGroupOffset != nil {
+		return errors.New("templates.consumerGroupOffset: statsd does not send consumer group offsets")
+	}
+	/* plain statsd has no tags, its template renders the whole path */
+	err = this.Templates.checkKeys(false, this.StatsdFlavor == "dogstatsd", nil)
+	if err != nil {
+		return err
+	}
+	templates, err := newStatsdTemplates(&this.Templates, this.StatsdFlavor)
+	if err != nil {
+		return err
+	}
+	return templates.Validate("cluster", this.Labels)
+}
+
+func newStatsdTemplates(config *MetricTemplatesConfig, flavor string) (*MetricTemplates, error) {
+	if flavor == "dogstatsd" {
+		return NewMetricTemplatesWithDefaults(config,
+			tagMetricTemplate("topic"),
+			tagMetricTemplate("group", "topic", "partition"))
+	}
+	return NewMetricTemplatesWithDefaults(config, tagMetricTemplate(), tagMetricTemplate())
+}
+
+func (this *StatsdOutputConfig) NewOutput() Output {
+	return NewStatsdOutput(this)
+}
+
+type StatsdOutput struct {
+	config    *StatsdOutputConfig
+	conn      net.Conn
+	tags      []string
+	templates *MetricTemplates
+}
+
+var (
+	statsdInvalidChars     = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+	statsdInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_\-.]`)
+	statsdInvalidTagChars  = regexp.MustCompile(`[,|#\s]`)
+)
+
+func sanitizeStatsdNode(name string) string {
+	return statsdInvalidChars.ReplaceAllString(name, "_")
+}
+
+func sanitizeStatsdName(name string) string {
+	return statsdInvalidNameChars.ReplaceAllString(name, "_")
+}
+
+func sanitizeStatsdTag(value string) string {
+	return statsdInvalidTagChars.ReplaceAllString(value, "_")
+}
+
+func NewStatsdOutput(config *StatsdOutputConfig) *StatsdOutput {
+	if config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	if config.StatsdHost == "" {
+		config.StatsdHost = "127.0.0.1:8125"
+	}
+	if config.StatsdFlavor == "" {
+		config.StatsdFlavor = "statsd"
+	}
+	if config.StatsdPrefix == "" {
+		config.StatsdPrefix = "kafka_monitor"
+	}
+	if config.StatsdMTU == 0 {
+		config.StatsdMTU = 1432
+	}
+
+	s := &StatsdOutput{config: config}
+	return s
+}
+
+func (this *StatsdOutput) Init() error {
+
+	/* init templates */
+	templates, err := newStatsdTemplates(&this.config.Templates, this.config.StatsdFlavor)
+	if err != nil {
+		return err
+	}
+	this.templates = templates
+
+	/* init udp socket */
+	conn, err := net.Dial("udp", this.config.StatsdHost)
+	if err != nil {
+		return err
+	}
+	this.conn = conn
+
+	/* constant dogstatsd tags, sorted so datagrams are stable */
+	for k, v := range this.config.StatsdTags {
+		this.tags = append(this.tags, sanitizeStatsdTag(k)+":"+sanitizeStatsdTag(v))
+	}
+	sort.Strings(this.tags)
+
+	return nil
+}
+
+func (this *StatsdOutput) Write(snapshot *Snapshot) error {
+	lines, err := this.collect(snapshot)
+	if err != nil {
+		return err
+	}
+	return this.write(lines)
+}
+
+/*
+statsd:    <prefix>.<cluster>.<name>.<node>...:<value>|g
+dogstatsd: <prefix>.<name>:<value>|g|#cluster:<cluster>,<tag>:<value>...
+
+For statsd the template renders the whole path from values already made
+safe as path nodes, for dogstatsd the name and the tags. A signed value
+changes a statsd gauge instead of setting it, the negative distances of
+groups read after the latest offsets are sent as 0.
+*/
+func (this *StatsdOutput) gauge(tpl *MetricTemplate, ctx *MetricContext, name string, nodes []string, value int64) (string, error) {
+	if value < 0 {
+		value = 0
+	}
+	if this.config.StatsdFlavor == "dogstatsd" {
+		ctx.Measurement = this.config.StatsdPrefix + "." + name
+		m, err := tpl.Render(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		keys := make([]string, 0, len(m.Tags))
+		for k := range m.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		tags := make([]string, 0, len(this.tags)+len(keys)+1)
+		tags = append(tags, "cluster:"+sanitizeStatsdTag(ctx.Cluster))
+		tags = append(tags, this.tags...)
+		for _, k := range keys {
+			tags = append(tags, sanitizeStatsdTag(k)+":"+sanitizeStatsdTag(m.Tags[k]))
+		}
+		return fmt.Sprintf("%s:%d|g|#%s", sanitizeStatsdName(m.Measurement), value, strings.Join(tags, ",")), nil
+	}
+
+	safe := &MetricContext{
+		Cluster:   sanitizeStatsdNode(ctx.Cluster),
+		Topic:     sanitizeStatsdNode(ctx.Topic),
+		Group:     sanitizeStatsdNode(ctx.Group),
+		Partition: sanitizeStatsdNode(ctx.Partition),
+		Labels:    ctx.Labels,
+	}
+	parts := []string{this.config.StatsdPrefix, safe.Cluster, name}
+	for _, node := range nodes {
+		parts = append(parts, sanitizeStatsdNode(node))
+	}
+	safe.Measurement = strings.Join(parts, ".")
+	m, err := tpl.Render(safe)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d|g", sanitizeStatsdName(m.Measurement), value), nil
+}
+
+func (this *StatsdOutput) collect(snapshot *Snapshot) ([]string, error) {
+	newContext := func(group string, topic string, partition string) *MetricContext {
+		return &MetricContext{
+			Cluster:   snapshot.Cluster,
+			Topic:     topic,
+			Group:     group,
+			Partition: partition,
+			Labels:    this.config.Labels,
+		}
+	}
+
+	lines := []string{}
+	if !snapshot.SkipTopics {
+		for topic, partitionItem := range snapshot.LatestOffset {
+			line, err := this.gauge(this.templates.LatestOffset, newContext("", topic, "total"),
+				"latest_offset", []string{topic}, partitionItem["total"])
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+		}
+	}
+	for group, topicItem := range snapshot.ConsumerGroupDistance {
+		for topic, partitionItem := range topicItem {
+			for partition, offset := range partitionItem {
+				line, err := this.gauge(this.templates.ConsumerGroupDistance, newContext(group, topic, partition),
+					"consumer_group_distance", []string{group, topic, partition}, offset)
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	return lines, nil
+}
+
+/* packs newline separated metrics into datagrams no larger than the mtu */
+func (this *StatsdOutput) write(lines []string) error {
+	var buf bytes.Buffer
+	var lastErr error
+	sent := 0
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		_, err := this.conn.Write(buf.Bytes())
+		if err != nil {
+			lastErr = err
+		}
+		buf.Reset()
+	}
+
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > this.config.StatsdMTU {
+			flush()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+		sent++
+	}
+	flush()
+
+	if lastErr != nil {
+		return lastErr
+	}
+	metrics.IncrCounter([]string{"output", "statsd", "points"}, float32(sent))
+	return nil
+}
+
+func (this *StatsdOutput) Close() error {
+
+	if this.conn != nil {
+		this.conn.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdCollect(t *testing.T) {
+	snapshot := &Snapshot{
+		Cluster:      "main",
+		Time:         time.Unix(1700000000, 0),
+		LatestOffset: map[string]map[string]int64{"orders": {"0": 100, "total": 100}},
+		ConsumerGroupDistance: map[string]map[string]map[string]int64{
+			"billing": {"orders": {"0": 5, "1": -3}},
+		},
+	}
+	for _, c := range []struct {
+		flavor string
+		want   []string
+	}{
+		{"statsd", []string{
+			"kafka_monitor.main.consumer_group_distance.billing.orders.0:5|g",
+			/* a signed value would change the gauge instead of setting it */
+			"kafka_monitor.main.consumer_group_distance.billing.orders.1:0|g",
+			"kafka_monitor.main.latest_offset.orders:100|g",
+		}},
+		{"dogstatsd", []string{
+			"kafka_monitor.consumer_group_distance:0|g|#cluster:main,env:prod,group:billing,partition:1,topic:orders",
+			"kafka_monitor.consumer_group_distance:5|g|#cluster:main,env:prod,group:billing,partition:0,topic:orders",
+			"kafka_monitor.latest_offset:100|g|#cluster:main,env:prod,topic:orders",
+		}},
+	} {
+		output := NewStatsdOutput(&StatsdOutputConfig{StatsdFlavor: c.flavor, StatsdTags: map[string]string{"env": "prod"}})
+		if err := output.Init(); err != nil {
+			t.Fatal(err)
+		}
+		lines, err := output.collect(snapshot)
+		output.Close()
+		if err != nil {
+			t.Errorf("%s: %s", c.flavor, err)
+			continue
+		}
+		sort.Strings(lines)
+		if strings.Join(lines, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%s:\n got %s\nwant %s", c.flavor, strings.Join(lines, "\n     "), strings.Join(c.want, "\n     "))
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* how often the status is sent when systemd does not expect keepalives */
+const systemdStatusInterval = 10 * time.Second
+
+var systemdLog = NewLogger("systemd")
+
+/*
+sdNotify sends a state like READY=1 to the service manager over the
+datagram socket in $NOTIFY_SOCKET. It does nothing when the variable is
+not set, that is when not running as a systemd service of Type=notify.
+*/
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	/* a leading @ is an abstract socket, net handles it */
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+/*
+sdWatchdogInterval returns the interval systemd expects keepalives at, 0
+when WatchdogSec is not set for this process.
+*/
+func sdWatchdogInterval() time.Duration {
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+/*
+systemdNotifier tells systemd the service is ready, keeps its STATUS up to
+date with the health of the components and sends watchdog keepalives at
+half the WatchdogSec interval. Keepalives are held back while a scheduler
+is stalled, so systemd restarts a process whose cycles hang instead of a
+process that merely runs.
+*/
+type systemdNotifier struct {
+	manager  *ServerManager
+	watchdog time.Duration
+	done     chan struct{}
+	stopped  chan struct{}
+
+	started bool
+	status  string
+	stalled bool
+}
+
+func newSystemdNotifier(manager *ServerManager) *systemdNotifier {
+	return &systemdNotifier{
+		manager:  manager,
+		watchdog: sdWatchdogInterval(),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+/* Start sends READY=1, it is called once the servers and schedulers started */
+func (this *systemdNotifier) Start() error {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return nil
+	}
+
+	this.status = this.statusLine()
+	this.notify("READY=1\nSTATUS=" + this.status)
+
+	interval := systemdStatusInterval
+	if this.watchdog > 0 {
+		interval = this.watchdog / 2
+		systemdLog.Infof("watchdog keepalives every %s", interval)
+	}
+
+	this.started = true
+	go func() {
+		defer close(this.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				this.tick()
+			case <-this.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (this *systemdNotifier) tick() {
+	states := []string{}
+	if status := this.statusLine(); status != this.status {
+		this.status = status
+		states = append(states, "STATUS="+status)
+	}
+
+	if this.watchdog > 0 {
+		stalled := this.manager.stalledSchedulers()
+		if len(stalled) == 0 {
+			states = append(states, "WATCHDOG=1")
+			if this.stalled {
+				systemdLog.Infof("schedulers are making progress again")
+			}
+		} else if !this.stalled {
+			systemdLog.Errorf("schedulers stalled, holding back watchdog keepalives:%s", strings.Join(stalled, ", "))
+		}
+		this.stalled = len(stalled) > 0
+	}
+
+	if len(states) > 0 {
+		this.notify(strings.Join(states, "\n"))
+	}
+}
+
+/* statusLine sums up the components, naming the degraded ones */
+func (this *systemdNotifier) statusLine() string {
+	ok := 0
+	degraded := []string{}
+	for _, component := range this.manager.Status() {
+		if component.State == "ok" {
+			ok++
+		} else {
+			degraded = append(degraded, fmt.Sprintf("%s %s %s", component.Component, component.Name, component.State))
+		}
+	}
+
+	status := fmt.Sprintf("%d components ok, %d not ok", ok, len(degraded))
+	if len(degraded) > 0 {
+		status += ": " + strings.Join(degraded, ", ")
+	}
+	return status
+}
+
+func (this *systemdNotifier) notify(state string) {
+	err := sdNotify(state)
+	if err != nil {
+		systemdLog.Warnf("notify failed:%s", err.Error())
+	}
+}
+
+/* Close sends STOPPING=1 and stops the updates */
+func (this *systemdNotifier) Close() error {
+	select {
+	case <-this.done:
+		return nil
+	default:
+	}
+
+	this.notify("STOPPING=1")
+	close(this.done)
+	if this.started {
+		<-this.stopped
+	}
+	return nil
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+runTop shows the consumer groups of a cluster full screen, refreshed every
+interval: their lag, how fast it grows and a sparkline of its recent
+history, with a drill-down to the partitions of a group. It only needs a
+terminal understanding ANSI escapes, stty switches it to read single keys.
+*/
+func runTop(name string, args []string, out io.Writer) int {
+	var groups, topics, sortBy string
+	var zookeeper string
+	var interval, timeout time.Duration
+	var history int
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&zookeeper, "zookeeper", defaultHttpZookeeper, "the zookeeper of the cluster, with its chroot")
+	flags.StringVar(&groups, "group", "", "only these consumer groups, comma separated")
+	flags.StringVar(&topics, "topic", "", "only these topics, comma separated")
+	flags.StringVar(&sortBy, "sort", "lag", "lag, growth or name")
+	flags.DurationVar(&interval, "interval", 5*time.Second, "refresh interval")
+	flags.DurationVar(&timeout, "timeout", 30*time.Second, "timeout of one refresh")
+	flags.IntVar(&history, "history", 60, "refreshes kept for the sparklines and the growth")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [options]\n\n", os.Args[0], name)
+		flags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nKeys: up/down or j/k select, enter show partitions, esc back, s sort,\n/ filter, p or space pause, q quit\n")
+	}
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		return 2
+	}
+	sortIndex := -1
+	for i, s := range topSorts {
+		if s == sortBy {
+			sortIndex = i
+		}
+	}
+	if sortIndex < 0 {
+		fmt.Fprintf(os.Stderr, "unknown sort %s, should be %s\n", sortBy, strings.Join(topSorts, ", "))
+		return 2
+	}
+	if interval <= 0 || history < 2 {
+		fmt.Fprintf(os.Stderr, "interval should be positive and history at least 2\n")
+		return 2
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(out) {
+		fmt.Fprintf(os.Stderr, "%s needs a terminal, use lag or groups with --watch otherwise\n", name)
+		return 2
+	}
+
+	quietLogs()
+
+	restore, err := ttyCbreak()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can not read keys from the terminal: %s\n", err.Error())
+		return 1
+	}
+	defer restore()
+
+	/* the alternate screen keeps the shell scrollback intact */
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	view := newTopView(zookeeper, interval, history)
+	view.sort = sortIndex
+	options := &cliOptions{zookeeper: zookeeper, groups: splitList(groups), topics: splitList(topics)}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH)
+	defer signal.Stop(signals)
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte{}, buf[:n]...)
+		}
+	}()
+
+	/* one refresh at a time, so the worker is never used concurrently */
+	var worker *Worker
+	samples := make(chan *topSample, 1)
+	fetching := false
+	fetch := func() {
+		if fetching || view.paused {
+			return
+		}
+		fetching = true
+		go func() {
+			sample := &topSample{time: time.Now()}
+			if worker == nil {
+				worker = NewWorker(zookeeper)
+				sample.err = worker.Init()
+				if sample.err != nil {
+					worker = nil
+				}
+			}
+			if sample.err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				sample.latestOffset, sample.err = worker.GetLatestOffsetContext(ctx)
+				if sample.err == nil {
+					filter := func(group string) bool { return inList(options.groups, group) }
+					sample.groupOffset, sample.err = worker.GetConsumerGroupsOffsetContext(ctx, filter)
+				}
+				cancel()
+				if sample.err != nil {
+					/* start over with new connections */
+					worker.Close()
+					worker = nil
+				}
+			}
+			samples <- sample
+		}()
+	}
+	defer func() {
+		if worker != nil && !fetching {
+			worker.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	rows, cols := ttySize()
+	fetch()
+	for {
+		var screen bytes.Buffer
+		view.render(&screen, cols, rows)
+		out.Write(screen.Bytes())
+
+		select {
+		case sample := <-samples:
+			fetching = false
+			view.update(sample, options)
+
+		case <-ticker.C:
+			fetch()
+
+		case b, ok := <-keys:
+			if !ok {
+				return 0
+			}
+			paused := view.paused
+			for _, key := range parseKeys(b) {
+				if view.key(key) {
+					return 0
+				}
+			}
+			if paused && !view.paused {
+				fetch()
+			}
+
+		case sig := <-signals:
+			if sig != syscall.SIGWINCH {
+				return 0
+			}
+			rows, cols = ttySize()
+		}
+	}
+}
+
+/* ttyCbreak makes the terminal hand over every key at once without echoing it */
+func ttyCbreak() (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	_, err = stty("-icanon", "-echo", "min", "1")
+	if err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(state)) }, nil
+}
+
+func ttySize() (int, int) {
+	size, err := stty("size")
+	if err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(size, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+/* parseKeys splits what the terminal sent into keys: a character, or up, down, enter, esc, backspace */
+func parseKeys(b []byte) []string {
+	keys := []string{}
+	for len(b) > 0 {
+		switch {
+		case bytes.HasPrefix(b, []byte("\x1b[A")), bytes.HasPrefix(b, []byte("\x1bOA")):
+			keys, b = append(keys, "up"), b[3:]
+		case bytes.HasPrefix(b, []byte("\x1b[B")), bytes.HasPrefix(b, []byte("\x1bOB")):
+			keys, b = append(keys, "down"), b[3:]
+		case bytes.HasPrefix(b, []byte("\x1b[5~")):
+			keys, b = append(keys, "pgup"), b[4:]
+		case bytes.HasPrefix(b, []byte("\x1b[6~")):
+			keys, b = append(keys, "pgdown"), b[4:]
+		case bytes.HasPrefix(b, []byte("\x1b[")), bytes.HasPrefix(b, []byte("\x1bO")):
+			/* another sequence, skip up to its final byte */
+			i := 2
+			for i < len(b) && (b[i] < 0x40 || b[i] > 0x7e) {
+				i++
+			}
+			if i < len(b) {
+				i++
+			}
+			b = b[i:]
+		case b[0] == 0x1b:
+			keys, b = append(keys, "esc"), b[1:]
+		case b[0] == '\r' || b[0] == '\n':
+			keys, b = append(keys, "enter"), b[1:]
+		case b[0] == 0x7f || b[0] == 0x08:
+			keys, b = append(keys, "backspace"), b[1:]
+		case b[0] == 0x03:
+			keys, b = append(keys, "ctrl-c"), b[1:]
+		default:
+			r, n := utf8.DecodeRune(b)
+			keys, b = append(keys, string(r)), b[n:]
+		}
+	}
+	return keys
+}
+
+type topSample struct {
+	time         time.Time
+	latestOffset map[string]map[string]int64
+	groupOffset  map[string]map[string]map[string]int64
+	err          error
+}
+
+type topPoint struct {
+	time time.Time
+	lag  int64
+}
+
+/* topSeries is the recent lag of a group or a partition, oldest first */
+type topSeries []topPoint
+
+/* growth is the lag change per second over the series */
+func (this topSeries) growth() float64 {
+	if len(this) < 2 {
+		return 0
+	}
+	first, last := this[0], this[len(this)-1]
+	seconds := last.time.Sub(first.time).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(last.lag-first.lag) / seconds
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+/* sparkline draws the last width points, scaled between their minimum and maximum */
+func (this topSeries) sparkline(width int) string {
+	if len(this) > width {
+		this = this[len(this)-width:]
+	}
+	if len(this) == 0 {
+		return ""
+	}
+	min, max := this[0].lag, this[0].lag
+	for _, p := range this {
+		if p.lag < min {
+			min = p.lag
+		}
+		if p.lag > max {
+			max = p.lag
+		}
+	}
+	line := make([]rune, len(this))
+	for i, p := range this {
+		level := 0
+		if max > min {
+			level = int((p.lag - min) * int64(len(sparkBlocks)-1) / (max - min))
+		}
+		line[i] = sparkBlocks[level]
+	}
+	return string(line)
+}
+
+type topPartition struct {
+	topic     string
+	partition int64
+	offset    int64
+	latest    int64
+	lag       int64
+}
+
+type topGroup struct {
+	name       string
+	topics     int
+	lag        int64
+	partitions []*topPartition
+}
+
+var topSorts = []string{"lag", "growth", "name"}
+
+/* topView is the state of the screen, changed by samples and keys only */
+type topView struct {
+	zookeeper string
+	interval  time.Duration
+	history   int
+
+	groups  map[string]*topGroup
+	series  map[string]topSeries
+	updated time.Time
+	err     error
+
+	sort      int
+	paused    bool
+	filter    string
+	editing   bool
+	group     string
+	selected  int
+	scroll    int
+	rowsShown int
+}
+
+func newTopView(zookeeper string, interval time.Duration, history int) *topView {
+	return &topView{
+		zookeeper: zookeeper,
+		interval:  interval,
+		history:   history,
+		groups:    map[string]*topGroup{},
+		series:    map[string]topSeries{},
+	}
+}
+
+func (this *topView) update(sample *topSample, options *cliOptions) {
+	if sample.err != nil {
+		this.err = sample.err
+		return
+	}
+	this.err = nil
+	this.updated = sample.time
+
+	groups := map[string]*topGroup{}
+	for name, topics := range sample.groupOffset {
+		group := &topGroup{name: name}
+		for topic, partitions := range topics {
+			if !inList(options.topics, topic) {
+				continue
+			}
+			group.topics++
+			for partition, offset := range partitions {
+				if partition == "total" {
+					continue
+				}
+				latest := sample.latestOffset[topic][partition]
+				p := &topPartition{topic: topic, partition: partitionNumber(partition), offset: offset, latest: latest, lag: latest - offset}
+				group.partitions = append(group.partitions, p)
+				group.lag += p.lag
+				this.record(partitionKey(name, p), sample.time, p.lag)
+			}
+		}
+		if group.topics == 0 && len(options.topics) > 0 {
+			continue
+		}
+		groups[name] = group
+		this.record(name, sample.time, group.lag)
+	}
+	this.groups = groups
+
+	/* forget the groups and partitions that are gone */
+	for key, series := range this.series {
+		if series[len(series)-1].time != sample.time {
+			delete(this.series, key)
+		}
+	}
+}
+
+func (this *topView) record(key string, t time.Time, lag int64) {
+	series := append(this.series[key], topPoint{time: t, lag: lag})
+	if len(series) > this.history {
+		series = series[len(series)-this.history:]
+	}
+	this.series[key] = series
+}
+
+func partitionKey(group string, p *topPartition) string {
+	return group + "|" + p.topic + "|" + strconv.FormatInt(p.partition, 10)
+}
+
+/* key handles a key and returns true to quit */
+func (this *topView) key(key string) bool {
+	if this.editing {
+		switch key {
+		case "enter":
+			this.editing = false
+		case "esc":
+			this.editing = false
+			this.filter = ""
+		case "backspace":
+			if this.filter != "" {
+				_, n := utf8.DecodeLastRuneInString(this.filter)
+				this.filter = this.filter[:len(this.filter)-n]
+			}
+		case "ctrl-c":
+			return true
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				this.filter += key
+			}
+		}
+		this.selected, this.scroll = 0, 0
+		return false
+	}
+
+	switch key {
+	case "q", "ctrl-c":
+		return true
+	case "up", "k":
+		this.selected--
+	case "down", "j":
+		this.selected++
+	case "pgup":
+		this.selected -= this.rowsShown
+	case "pgdown":
+		this.selected += this.rowsShown
+	case "enter", "l":
+		if this.group == "" {
+			rows := this.rows()
+			if this.selected >= 0 && this.selected < len(rows) {
+				this.group = rows[this.selected].name
+				this.selected, this.scroll, this.filter = 0, 0, ""
+			}
+		}
+	case "esc", "backspace", "h":
+		if this.group != "" {
+			previous := this.group
+			this.group, this.filter = "", ""
+			this.selected, this.scroll = 0, 0
+			for i, row := range this.rows() {
+				if row.name == previous {
+					this.selected = i
+				}
+			}
+		} else {
+			this.filter = ""
+		}
+	case "s":
+		this.sort = (this.sort + 1) % len(topSorts)
+	case "/":
+		this.editing = true
+		this.filter = ""
+	case "p", " ":
+		this.paused = !this.paused
+	}
+	return false
+}
+
+/* topRow is a line of the current screen, a group or a partition of the selected group */
+type topRow struct {
+	name   string
+	cells  []string
+	lag    int64
+	growth float64
+	series topSeries
+}
+
+func (this *topView) rows() []*topRow {
+	rows := []*topRow{}
+	if this.group == "" {
+		for _, group := range this.groups {
+			if this.filter != "" && !strings.Contains(group.name, this.filter) {
+				continue
+			}
+			series := this.series[group.name]
+			rows = append(rows, &topRow{
+				name:   group.name,
+				cells:  []string{group.name, strconv.Itoa(group.topics), strconv.Itoa(len(group.partitions))},
+				lag:    group.lag,
+				growth: series.growth(),
+				series: series,
+			})
+		}
+	} else if group, ok := this.groups[this.group]; ok {
+		for _, p := range group.partitions {
+			if this.filter != "" && !strings.Contains(p.topic, this.filter) {
+				continue
+			}
+			series := this.series[partitionKey(group.name, p)]
+			partition := strconv.FormatInt(p.partition, 10)
+			rows = append(rows, &topRow{
+				name:   p.topic + " " + partition,
+				cells:  []string{p.topic, partition, strconv.FormatInt(p.offset, 10), strconv.FormatInt(p.latest, 10)},
+				lag:    p.lag,
+				growth: series.growth(),
+				series: series,
+			})
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		switch topSorts[this.sort] {
+		case "lag":
+			if rows[i].lag != rows[j].lag {
+				return rows[i].lag > rows[j].lag
+			}
+		case "growth":
+			if rows[i].growth != rows[j].growth {
+				return rows[i].growth > rows[j].growth
+			}
+		}
+		return naturalLess(rows[i].name, rows[j].name)
+	})
+	return rows
+}
+
+/* naturalLess orders "orders 2" before "orders 10" */
+func naturalLess(a string, b string) bool {
+	as, bs := strings.Fields(a), strings.Fields(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		x, errX := strconv.ParseInt(as[i], 10, 64)
+		y, errY := strconv.ParseInt(bs[i], 10, 64)
+		if errX == nil && errY == nil {
+			return x < y
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
+
+/* render draws the whole screen of width by height characters */
+func (this *topView) render(out *bytes.Buffer, width int, height int) {
+	lines := []string{}
+
+	title := fmt.Sprintf("kafka-offset-mon top  %s  every %s", this.zookeeper, this.interval)
+	if !this.updated.IsZero() {
+		title += "  " + this.updated.Format("15:04:05")
+	}
+	if this.paused {
+		title += "  [paused]"
+	}
+	lines = append(lines, "\x1b[1m"+fitWidth(title, width)+"\x1b[0m")
+
+	state := fmt.Sprintf("%d groups  sort: %s", len(this.groups), topSorts[this.sort])
+	if this.group != "" {
+		state = fmt.Sprintf("group %s  sort: %s", this.group, topSorts[this.sort])
+	}
+	if this.editing || this.filter != "" {
+		state += "  filter: " + this.filter
+		if this.editing {
+			state += "_"
+		}
+	}
+	if this.err != nil {
+		state += "  error: " + this.err.Error()
+	} else if this.updated.IsZero() {
+		state += "  loading..."
+	}
+	lines = append(lines, fitWidth(state, width))
+
+	var header []string
+	var widths []int
+	if this.group == "" {
+		header = []string{"GROUP", "TOPICS", "PARTS"}
+	} else {
+		header = []string{"TOPIC", "PARTITION", "OFFSET", "LATEST"}
+	}
+	header = append(header, "LAG", "GROWTH/S")
+	widths = make([]int, len(header))
+	for i, h := range header {
+		widths[i] = len(h)
+	}
+
+	rows := this.rows()
+	cells := make([][]string, len(rows))
+	for i, row := range rows {
+		cells[i] = append(append([]string{}, row.cells...), strconv.FormatInt(row.lag, 10), fmt.Sprintf("%+.1f", row.growth))
+		for j, cell := range cells[i] {
+			if len(cell) > widths[j] {
+				widths[j] = len(cell)
+			}
+		}
+	}
+
+	format := func(values []string) string {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			if i == 0 {
+				parts[i] = fmt.Sprintf("%-*s", widths[i], v)
+			} else {
+				parts[i] = fmt.Sprintf("%*s", widths[i], v)
+			}
+		}
+		return strings.Join(parts, "  ")
+	}
+
+	tableWidth := len(format(header))
+	sparkWidth := width - tableWidth - 4
+	if sparkWidth > this.history {
+		sparkWidth = this.history
+	}
+	headerLine := "  " + format(header)
+	if sparkWidth > 0 {
+		headerLine += "  HISTORY"
+	}
+	lines = append(lines, "\x1b[7m"+padWidth(headerLine, width)+"\x1b[0m")
+
+	/* rows fill the screen between the header and the help line */
+	this.rowsShown = height - len(lines) - 1
+	if this.rowsShown < 1 {
+		this.rowsShown = 1
+	}
+	if this.selected >= len(rows) {
+		this.selected = len(rows) - 1
+	}
+	if this.selected < 0 {
+		this.selected = 0
+	}
+	if this.selected < this.scroll {
+		this.scroll = this.selected
+	}
+	if this.selected >= this.scroll+this.rowsShown {
+		this.scroll = this.selected - this.rowsShown + 1
+	}
+
+	for i := this.scroll; i < len(rows) && i < this.scroll+this.rowsShown; i++ {
+		line := "  " + format(cells[i])
+		if sparkWidth > 0 {
+			line += "  " + rows[i].series.sparkline(sparkWidth)
+		}
+		if i == this.selected {
+			lines = append(lines, "\x1b[7m"+padWidth("> "+line[2:], width)+"\x1b[0m")
+		} else {
+			lines = append(lines, fitWidth(line, width))
+		}
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+
+	help := "q quit  j/k select  enter partitions  s sort  / filter  p pause"
+	if this.group != "" {
+		help = "q quit  j/k select  esc groups  s sort  / filter topics  p pause"
+	}
+	if this.editing {
+		help = "type to filter  enter apply  esc clear"
+	}
+	lines = append(lines, "\x1b[2m"+fitWidth(help, width)+"\x1b[0m")
+
+	out.WriteString("\x1b[H")
+	for i, line := range lines {
+		out.WriteString(line)
+		/* clear the rest of the line instead of the screen, so it does not flicker */
+		out.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			out.WriteString("\r\n")
+		}
+	}
+	out.WriteString("\x1b[J")
+}
+
+/* fitWidth cuts s to width characters */
+func fitWidth(s string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
+
+/* padWidth fits s to exactly width characters, for highlighted lines */
+func padWidth(s string, width int) string {
+	s = fitWidth(s, width)
+	if n := utf8.RuneCountInString(s); n < width {
+		s += strings.Repeat(" ", width-n)
+	}
+	return s
+}
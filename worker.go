@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/wvanbergen/kazoo-go"
 	"gopkg.in/Shopify/sarama.v1"
@@ -12,8 +15,11 @@ type Worker struct {
 	kazooClient *kazoo.Kazoo
 	kafkaClient sarama.Client
 
-	zookeeper string
+	zookeeper  string
+	brokerList []string
 
+	/* Close may run while a request abandoned at its deadline still reads the clients */
+	lock      sync.RWMutex
 	connected bool
 }
 
@@ -21,7 +27,12 @@ func NewWorker(zk string) *Worker {
 	return &Worker{zookeeper: zk}
 }
 
+/* Init connects to zookeeper and kafka, it fails at once while the breaker of the cluster is open */
 func (this *Worker) Init() error {
+	return clusterBreakerFor(this.zookeeper).Run(context.Background(), this.init)
+}
+
+func (this *Worker) init() error {
 
 	kazooConfig := kazoo.NewConfig()
 	kazooClient, err := kazoo.NewKazooFromConnectionString(this.zookeeper, kazooConfig)
@@ -32,44 +43,104 @@ func (this *Worker) Init() error {
 	kafkaClientConfig := sarama.NewConfig()
 	brokerList, err := kazooClient.BrokerList()
 	if nil != err {
+		kazooClient.Close()
 		return err
 	}
 
 	kafkaClient, err := sarama.NewClient(brokerList, kafkaClientConfig)
 
 	if nil != err {
+		kazooClient.Close()
 		return err
 	}
 
+	this.lock.Lock()
 	this.kafkaClient = kafkaClient
 	this.kazooClient = kazooClient
+	this.brokerList = brokerList
 	this.connected = true
+	this.lock.Unlock()
 
 	return nil
 }
 
-func (this *Worker) GetLatestOffset() (map[string]map[string]int64, error) {
+var errWorkerNotConnected = errors.New("not connected,call Init first")
+
+func (this *Worker) clients() (sarama.Client, *kazoo.Kazoo, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.connected == false {
+		return nil, nil, errWorkerNotConnected
+	}
+	return this.kafkaClient, this.kazooClient, nil
+}
+
+func (this *Worker) BrokerList() ([]string, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	if this.connected == false {
-		return nil, errors.New("not connected,call Init first")
+		return nil, errWorkerNotConnected
+	}
+	return this.brokerList, nil
+}
+
+func (this *Worker) GetLatestOffset() (map[string]map[string]int64, error) {
+	return this.GetLatestOffsetContext(context.Background())
+}
+
+/*
+GetLatestOffsetContext stops between two kafka requests once ctx is done,
+a single request hanging is only interrupted by Close.
+*/
+func (this *Worker) GetLatestOffsetContext(ctx context.Context) (map[string]map[string]int64, error) {
+	var rtn map[string]map[string]int64
+	err := clusterBreakerFor(this.zookeeper).Run(ctx, func() error {
+		var err error
+		rtn, err = this.getLatestOffset(ctx)
+		return err
+	})
+	return rtn, err
+}
+
+func (this *Worker) getLatestOffset(ctx context.Context) (map[string]map[string]int64, error) {
+	kafkaClient, _, err := this.clients()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	rtn := map[string]map[string]int64{}
-	kafkaClient := this.kafkaClient
 
+	start := time.Now()
 	topics, err := kafkaClient.Topics()
+	measureCall([]string{"worker", "kafka", "topics"}, start, err)
 	if nil != err {
 		return nil, err
 	}
 	for _, topic := range topics {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		item := map[string]int64{}
 
+		start := time.Now()
 		partitions, err := kafkaClient.Partitions(topic)
+		measureCall([]string{"worker", "kafka", "partitions"}, start, err)
 		if nil != err {
 			return nil, err
 		}
 		var offset_total int64
 		offset_total = 0
 		for _, partition := range partitions {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			start := time.Now()
 			offset, err := kafkaClient.GetOffset(topic, partition, sarama.OffsetNewest)
+			measureCall([]string{"worker", "kafka", "get_offset"}, start, err)
 			if nil != err {
 				return nil, err
 			}
@@ -86,36 +157,74 @@ func (this *Worker) GetLatestOffset() (map[string]map[string]int64, error) {
 	return rtn, nil
 }
 func (this *Worker) GetConsumerGroupsOffset() (map[string]map[string]map[string]int64, error) {
+	return this.GetConsumerGroupsOffsetContext(context.Background(), nil)
+}
 
-	if this.connected == false {
-		return nil, errors.New("not connected,call Init first")
+/*
+GetConsumerGroupsOffsetContext only reads the groups filter accepts, all
+of them if it is nil, and stops between two zookeeper requests once ctx
+is done.
+*/
+func (this *Worker) GetConsumerGroupsOffsetContext(ctx context.Context, filter func(group string) bool) (map[string]map[string]map[string]int64, error) {
+	var rtn map[string]map[string]map[string]int64
+	err := clusterBreakerFor(this.zookeeper).Run(ctx, func() error {
+		var err error
+		rtn, err = this.getConsumerGroupsOffset(ctx, filter)
+		return err
+	})
+	return rtn, err
+}
+
+func (this *Worker) getConsumerGroupsOffset(ctx context.Context, filter func(group string) bool) (map[string]map[string]map[string]int64, error) {
+
+	_, kazooClient, err := this.clients()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	rtn := map[string]map[string]map[string]int64{}
 
-	kazooClient := this.kazooClient
-
+	start := time.Now()
 	groups, err := kazooClient.Consumergroups()
+	measureCall([]string{"worker", "zookeeper", "consumergroups"}, start, err)
 	if nil != err {
 		return nil, err
 	}
 
 	for _, group := range groups {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if filter != nil && !filter(group.Name) {
+			continue
+		}
 		groupItem := map[string]map[string]int64{}
+		start := time.Now()
 		topics, err := group.Topics()
+		measureCall([]string{"worker", "zookeeper", "group_topics"}, start, err)
 		if nil != err {
 			return nil, err
 		}
 		for _, topic := range topics {
 			topicItem := map[string]int64{}
+			start := time.Now()
 			partitions, err := topic.Partitions()
+			measureCall([]string{"worker", "zookeeper", "topic_partitions"}, start, err)
 			if nil != err {
 				return nil, err
 			}
 			var offset_total int64
 			offset_total = 0
 			for _, partition := range partitions {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				start := time.Now()
 				offset, err := group.FetchOffset(topic.Name, partition.ID)
+				measureCall([]string{"worker", "zookeeper", "fetch_offset"}, start, err)
 				if nil != err {
 					return nil, err
 				}
@@ -131,12 +240,31 @@ func (this *Worker) GetConsumerGroupsOffset() (map[string]map[string]map[string]
 }
 
 func (this *Worker) GetConsumerGroupsOffsetDistance() (map[string]map[string]map[string]int64, error) {
+	return this.GetConsumerGroupsOffsetDistanceContext(context.Background(), nil)
+}
 
-	if this.connected == false {
-		return nil, errors.New("not connected,call Init first")
+/* GetConsumerGroupsOffsetDistanceContext is GetConsumerGroupsOffsetContext for the distances */
+func (this *Worker) GetConsumerGroupsOffsetDistanceContext(ctx context.Context, filter func(group string) bool) (map[string]map[string]map[string]int64, error) {
+	var rtn map[string]map[string]map[string]int64
+	err := clusterBreakerFor(this.zookeeper).Run(ctx, func() error {
+		var err error
+		rtn, err = this.getConsumerGroupsOffsetDistance(ctx, filter)
+		return err
+	})
+	return rtn, err
+}
+
+func (this *Worker) getConsumerGroupsOffsetDistance(ctx context.Context, filter func(group string) bool) (map[string]map[string]map[string]int64, error) {
+
+	_, kazooClient, err := this.clients()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	latest_offset, err := this.GetLatestOffset()
+	latest_offset, err := this.getLatestOffset(ctx)
 
 	if err != nil {
 		return nil, err
@@ -144,30 +272,45 @@ func (this *Worker) GetConsumerGroupsOffsetDistance() (map[string]map[string]map
 
 	rtn := map[string]map[string]map[string]int64{}
 
-	kazooClient := this.kazooClient
-
+	start := time.Now()
 	groups, err := kazooClient.Consumergroups()
+	measureCall([]string{"worker", "zookeeper", "consumergroups"}, start, err)
 	if nil != err {
 		return nil, err
 	}
 
 	for _, group := range groups {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if filter != nil && !filter(group.Name) {
+			continue
+		}
 
 		groupItem := map[string]map[string]int64{}
+		start := time.Now()
 		topics, err := group.Topics()
+		measureCall([]string{"worker", "zookeeper", "group_topics"}, start, err)
 		if nil != err {
 			return nil, err
 		}
 		for _, topic := range topics {
 			topicItem := map[string]int64{}
+			start := time.Now()
 			partitions, err := topic.Partitions()
+			measureCall([]string{"worker", "zookeeper", "topic_partitions"}, start, err)
 			if nil != err {
 				return nil, err
 			}
 			var distance_total, distance int64
 			distance_total = 0
 			for _, partition := range partitions {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				start := time.Now()
 				offset, err := group.FetchOffset(topic.Name, partition.ID)
+				measureCall([]string{"worker", "zookeeper", "fetch_offset"}, start, err)
 				if nil != err {
 					return nil, err
 				}
@@ -184,10 +327,48 @@ func (this *Worker) GetConsumerGroupsOffsetDistance() (map[string]map[string]map
 	return rtn, nil
 }
 
-func (this *Worker) Close() {
-	this.connected = false
+/*
+ComputeConsumerGroupsOffsetDistance derives the same result as
+GetConsumerGroupsOffsetDistance from data that was already fetched, so a
+caller that needs all three datasets only reads them once per cycle.
+*/
+func ComputeConsumerGroupsOffsetDistance(latestOffset map[string]map[string]int64, groupOffset map[string]map[string]map[string]int64) map[string]map[string]map[string]int64 {
+	rtn := map[string]map[string]map[string]int64{}
+
+	for group, topicItem := range groupOffset {
+		groupItem := map[string]map[string]int64{}
+		for topic, partitionItem := range topicItem {
+			distanceItem := map[string]int64{}
+			var distance_total int64
+			for partition, offset := range partitionItem {
+				if partition == "total" {
+					continue
+				}
+				distance := latestOffset[topic][partition] - offset
+				distance_total += distance
+				distanceItem[partition] = distance
+			}
+			distanceItem["total"] = distance_total
+			groupItem[topic] = distanceItem
+		}
+		rtn[group] = groupItem
+	}
+	return rtn
+}
+
+/* Close closes the kafka client first, its brokers were found through zookeeper */
+func (this *Worker) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var err error
 	if this.connected == true {
-		this.kafkaClient.Close()
-		this.kazooClient.Close()
+		err = this.kafkaClient.Close()
+		zkErr := this.kazooClient.Close()
+		if err == nil {
+			err = zkErr
+		}
 	}
+	this.connected = false
+	return err
 }
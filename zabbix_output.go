@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+type ZabbixThresholdConfig struct {
+	Group    string `json:"group"`
+	Topic    string `json:"topic"`
+	Distance int64  `json:"distance"`
+}
+
+func init() {
+	RegisterOutput("zabbix", "60s", func() OutputOptions { return &ZabbixOutputConfig{} })
+}
+
+type ZabbixOutputConfig struct {
+	ZabbixServer            string                  `json:"zabbixServer"`
+	ZabbixHostname          string                  `json:"zabbixHostname"`
+	ZabbixTimeout           string                  `json:"zabbixTimeout"`
+	ZabbixBatchSize         int                     `json:"zabbixBatchSize"`
+	ZabbixDistanceThreshold int64                   `json:"zabbixDistanceThreshold"`
+	ZabbixThresholds        []ZabbixThresholdConfig `json:"zabbixThresholds"`
+	ZabbixBlacklist         map[string][]string     `json:"zabbixBlacklist"`
+}
+
+func (this *ZabbixOutputConfig) Validate() error {
+	if this.ZabbixBatchSize < 0 {
+		return fmt.Errorf("invalid zabbixBatchSize %d", this.ZabbixBatchSize)
+	}
+	for i, t := range this.ZabbixThresholds {
+		if t.Group == "" && t.Topic == "" {
+			return fmt.Errorf("zabbixThresholds[%d] needs a group or a topic", i)
+		}
+	}
+	err := validateAddr("zabbixServer", this.ZabbixServer)
+	if err != nil {
+		return err
+	}
+	return validateDuration("zabbixTimeout", this.ZabbixTimeout)
+}
+
+func (this *ZabbixOutputConfig) NewOutput() Output {
+	return NewZabbixOutput(this)
+}
+
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+}
+
+type zabbixSenderRequest struct {
+	Request string        `json:"request"`
+	Data    []*zabbixItem `json:"data"`
+	Clock   int64         `json:"clock"`
+}
+
+type zabbixSenderResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+type ZabbixOutput struct {
+	config  *ZabbixOutputConfig
+	timeout time.Duration
+
+	/* last snapshot written, served to low-level discovery */
+	snapshotLock sync.RWMutex
+	snapshot     *Snapshot
+}
+
+const zabbixHeader = "ZBXD\x01"
+
+var zabbixLog = NewLogger("output").With("syncer", "zabbix")
+
+var zabbixFailedInfo = regexp.MustCompile(`failed: (\d+)`)
+
+func NewZabbixOutput(config *ZabbixOutputConfig) *ZabbixOutput {
+	if config.ZabbixServer == "" {
+		config.ZabbixServer = "127.0.0.1:10051"
+	}
+	if config.ZabbixHostname == "" {
+		config.ZabbixHostname, _ = os.Hostname()
+	}
+	if config.ZabbixTimeout == "" {
+		config.ZabbixTimeout = "10s"
+	}
+	if config.ZabbixBatchSize == 0 {
+		config.ZabbixBatchSize = 250
+	}
+	if config.ZabbixDistanceThreshold == 0 {
+		config.ZabbixDistanceThreshold = 2000
+	}
+
+	s := &ZabbixOutput{config: config}
+	return s
+}
+
+func (this *ZabbixOutput) Init() error {
+
+	timeout, err := time.ParseDuration(this.config.ZabbixTimeout)
+	if err != nil {
+		timeout = time.Second * 10
+	}
+	this.timeout = timeout
+
+	return nil
+}
+
+func (this *ZabbixOutput) Write(snapshot *Snapshot) error {
+	this.snapshotLock.Lock()
+	this.snapshot = snapshot
+	this.snapshotLock.Unlock()
+
+	items := this.collect(snapshot)
+
+	var lastErr error
+	for i := 0; i < len(items); i += this.config.ZabbixBatchSize {
+		end := i + this.config.ZabbixBatchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		err := this.send(items[i:end])
+		if err != nil {
+			zabbixLog.Errorf("send failed:%s", err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+/* zabbix item key parameters containing , ] or starting with a quote, [ or a space must be quoted */
+func zabbixKeyParam(param string) string {
+	if param == "" || strings.ContainsAny(param, ",]") || strings.ContainsAny(param[:1], "\"[ ") {
+		return "\"" + strings.Replace(param, "\"", "\\\"", -1) + "\""
+	}
+	return param
+}
+
+func zabbixKey(params ...string) string {
+	quoted := make([]string, len(params))
+	for i, p := range params {
+		quoted[i] = zabbixKeyParam(p)
+	}
+	return "kafka_monitor[" + strings.Join(quoted, ",") + "]"
+}
+
+func (this *ZabbixOutput) blacklisted(group string, topic string) bool {
+	for _, t := range this.config.ZabbixBlacklist[group] {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *ZabbixOutput) distanceThreshold(group string, topic string) int64 {
+	for _, t := range this.config.ZabbixThresholds {
+		if (t.Group == "" || t.Group == group) && (t.Topic == "" || t.Topic == topic) {
+			return t.Distance
+		}
+	}
+	return this.config.ZabbixDistanceThreshold
+}
+
+/*
+keys match the item prototypes of the discovery rules served by HttpServer:
+
+	kafka_monitor[latest_offset,{#CLUSTER},{#TOPIC}]
+	kafka_monitor[distance,{#CLUSTER},{#GROUP},{#TOPIC}]
+*/
+func (this *ZabbixOutput) collect(snapshot *Snapshot) []*zabbixItem {
+	cluster := snapshot.Cluster
+	clock := snapshot.Time.Unix()
+	items := []*zabbixItem{}
+
+	if !snapshot.SkipTopics {
+		for topic, partitionItem := range snapshot.LatestOffset {
+			items = append(items, &zabbixItem{
+				Host:  this.config.ZabbixHostname,
+				Key:   zabbixKey("latest_offset", cluster, topic),
+				Value: strconv.FormatInt(partitionItem["total"], 10),
+				Clock: clock,
+			})
+		}
+	}
+	for group, topicItem := range snapshot.ConsumerGroupDistance {
+		for topic, partitionItem := range topicItem {
+			if this.blacklisted(group, topic) {
+				continue
+			}
+			items = append(items, &zabbixItem{
+				Host:  this.config.ZabbixHostname,
+				Key:   zabbixKey("distance", cluster, group, topic),
+				Value: strconv.FormatInt(partitionItem["total"], 10),
+				Clock: clock,
+			})
+		}
+	}
+
+	return items
+}
+
+func (this *ZabbixOutput) send(items []*zabbixItem) error {
+	body, err := json.Marshal(&zabbixSenderRequest{
+		Request: "sender data",
+		Data:    items,
+		Clock:   time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", this.config.ZabbixServer, this.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(this.timeout))
+
+	_, err = conn.Write(encodeZabbixPacket(body))
+	if err != nil {
+		return err
+	}
+
+	content, err := decodeZabbixPacket(conn)
+	if err != nil {
+		return err
+	}
+
+	var res zabbixSenderResponse
+	err = json.Unmarshal(content, &res)
+	if err != nil {
+		return err
+	}
+	if res.Response != "success" {
+		return fmt.Errorf("zabbix server %s responded %s:%s", this.config.ZabbixServer, res.Response, res.Info)
+	}
+
+	failed := 0
+	if m := zabbixFailedInfo.FindStringSubmatch(res.Info); m != nil {
+		failed, _ = strconv.Atoi(m[1])
+	}
+	metrics.IncrCounter([]string{"output", "zabbix", "points"}, float32(len(items)-failed))
+	if failed > 0 {
+		return fmt.Errorf("zabbix server %s rejected items:%s", this.config.ZabbixServer, res.Info)
+	}
+	return nil
+}
+
+/* ZBXD\x01, 8 byte little-endian data length, data */
+func encodeZabbixPacket(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(zabbixHeader)
+	binary.Write(&buf, binary.LittleEndian, uint64(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func decodeZabbixPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, len(zabbixHeader)+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(zabbixHeader)]) != zabbixHeader {
+		return nil, errors.New("invalid zabbix response header")
+	}
+	size := binary.LittleEndian.Uint64(header[len(zabbixHeader):])
+	return ioutil.ReadAll(io.LimitReader(r, int64(size)))
+}
+
+/*
+Discovery returns zabbix low-level discovery rows for kind, which is one
+of clusters, topics or groups, built from the last snapshot written. It
+is empty until the first cycle has completed.
+*/
+func (this *ZabbixOutput) Discovery(kind string) ([]map[string]string, error) {
+	this.snapshotLock.RLock()
+	snapshot := this.snapshot
+	this.snapshotLock.RUnlock()
+
+	switch kind {
+	case "clusters", "topics", "groups":
+	default:
+		return nil, fmt.Errorf("unknown discovery type %s, should be clusters, topics or groups", kind)
+	}
+
+	rows := []map[string]string{}
+	if snapshot == nil {
+		return rows, nil
+	}
+
+	switch kind {
+	case "clusters":
+		rows = append(rows, map[string]string{"{#CLUSTER}": snapshot.Cluster})
+
+	case "topics":
+		if snapshot.SkipTopics {
+			break
+		}
+		for topic := range snapshot.LatestOffset {
+			rows = append(rows, map[string]string{
+				"{#CLUSTER}": snapshot.Cluster,
+				"{#TOPIC}":   topic,
+			})
+		}
+
+	case "groups":
+		for group, topicItem := range snapshot.ConsumerGroupOffset {
+			for topic := range topicItem {
+				if this.blacklisted(group, topic) {
+					continue
+				}
+				rows = append(rows, map[string]string{
+					"{#CLUSTER}":            snapshot.Cluster,
+					"{#GROUP}":              group,
+					"{#TOPIC}":              topic,
+					"{#DISTANCE_THRESHOLD}": strconv.FormatInt(this.distanceThreshold(group, topic), 10),
+				})
+			}
+		}
+	}
+
+	sort.Sort(zabbixDiscoveryRows(rows))
+	return rows, nil
+}
+
+func (this *ZabbixOutput) Close() error {
+	return nil
+}
+
+type zabbixDiscoveryRows []map[string]string
+
+func (this zabbixDiscoveryRows) Len() int      { return len(this) }
+func (this zabbixDiscoveryRows) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this zabbixDiscoveryRows) Less(i, j int) bool {
+	for _, k := range []string{"{#CLUSTER}", "{#GROUP}", "{#TOPIC}"} {
+		if this[i][k] != this[j][k] {
+			return this[i][k] < this[j][k]
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeZabbixPacket(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		want []byte
+	}{
+		{"", []byte("ZBXD\x01\x00\x00\x00\x00\x00\x00\x00\x00")},
+		{`{"request":"sender data"}`, append([]byte("ZBXD\x01\x19\x00\x00\x00\x00\x00\x00\x00"), `{"request":"sender data"}`...)},
+	} {
+		got := encodeZabbixPacket([]byte(c.data))
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("encodeZabbixPacket(%q) = %q, want %q", c.data, got, c.want)
+		}
+	}
+
+	/* the length header is little-endian and covers more than one byte */
+	data := []byte(strings.Repeat("x", 0x1234))
+	packet := encodeZabbixPacket(data)
+	if !bytes.Equal(packet[:13], []byte("ZBXD\x01\x34\x12\x00\x00\x00\x00\x00\x00")) {
+		t.Errorf("header = %q", packet[:13])
+	}
+
+	got, err := decodeZabbixPacket(bytes.NewReader(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decoded %d bytes, want %d", len(got), len(data))
+	}
+
+	/* bytes after the announced length are not part of the packet */
+	got, err = decodeZabbixPacket(bytes.NewReader(append(encodeZabbixPacket([]byte("ok")), "trailing"...)))
+	if err != nil || string(got) != "ok" {
+		t.Errorf("decoded %q, %v, want ok", got, err)
+	}
+
+	for _, bad := range []string{"", "ZBXD", "HTTP/1.1 400 Bad Request\r\n", "ZBXD\x02\x00\x00\x00\x00\x00\x00\x00\x00"} {
+		if _, err := decodeZabbixPacket(strings.NewReader(bad)); err == nil {
+			t.Errorf("decodeZabbixPacket(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestZabbixKey(t *testing.T) {
+	for _, c := range []struct {
+		param string
+		want  string
+	}{
+		{"topic", "topic"},
+		{"my-group.v2", "my-group.v2"},
+		{"", `""`},
+		{"a,b", `"a,b"`},
+		{"a]b", `"a]b"`},
+		{`"quoted"`, `"\"quoted\""`},
+		{`in"side`, `in"side`},
+		{"[array", `"[array"`},
+		{"a[0]", `"a[0]"`},
+		{"a[0", "a[0"},
+		{" leading", `" leading"`},
+		{"trailing ", "trailing "},
+		{`x,"y"`, `"x,\"y\""`},
+	} {
+		if got := zabbixKeyParam(c.param); got != c.want {
+			t.Errorf("zabbixKeyParam(%q) = %s, want %s", c.param, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		params []string
+		want   string
+	}{
+		{[]string{"latest_offset", "cluster", "topic"}, "kafka_monitor[latest_offset,cluster,topic]"},
+		{[]string{"distance", "cluster", "group,1", "topic"}, `kafka_monitor[distance,cluster,"group,1",topic]`},
+		{[]string{"distance", "", "group", "topic"}, `kafka_monitor[distance,"",group,topic]`},
+	} {
+		if got := zabbixKey(c.params...); got != c.want {
+			t.Errorf("zabbixKey(%q) = %s, want %s", c.params, got, c.want)
+		}
+	}
+}